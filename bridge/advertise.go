@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// BRIDGE_SERVICE_TYPE is the mDNS service type the bridge announces itself with,
+// so UIs and other bridges can find it on the LAN without manual setup.
+const BRIDGE_SERVICE_TYPE = "_xzg-mt._tcp"
+
+// BRIDGE_API_PATH is the base path of the HTTP/WebSocket API.
+const BRIDGE_API_PATH = "/"
+
+var bridgeAdvertiser *zeroconf.Server
+
+// getBridgeFeatures returns the capability tokens announced in the TXT records.
+func getBridgeFeatures() []string {
+	return []string{"ws", "mdns", "serial", "sc", "gpio", "framing", "pacing", "probe", "echo-cancel", "udp", "sessions", "record", "resilient", "mux", "tuning", "close-codes", "mdns-resolve", "mdns-stream", "federation", "version", "profiles"}
+}
+
+func getBridgeTxtRecords() []string {
+	return []string{
+		"version=" + VERSION,
+		"id=" + bridgeID,
+		"path=" + BRIDGE_API_PATH,
+		"tls=" + boolToTxt(tlsEnabled),
+		"auth=" + boolToTxt(isAuthEnabled()),
+		"features=" + strings.Join(getBridgeFeatures(), ","),
+	}
+}
+
+func boolToTxt(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+func getBridgeInstanceName() string {
+	if mdnsName != "" {
+		return mdnsName
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = getAdvertiseHost()
+	}
+	return fmt.Sprintf("XZG-MT Bridge (%s)", hostname)
+}
+
+// startBridgeAdvertiser registers the bridge as a _xzg-mt._tcp service on the
+// mDNS interfaces. When an advertise host is configured it is announced as the
+// only address, otherwise zeroconf announces the addresses of those interfaces.
+func startBridgeAdvertiser(port int) {
+	if !mdnsAdvertise {
+		return
+	}
+
+	instance := getBridgeInstanceName()
+	txt := getBridgeTxtRecords()
+	ifaces := multicastInterfaces()
+
+	var server *zeroconf.Server
+	var err error
+	if ip := net.ParseIP(advertiseHost); ip != nil {
+		hostname, _ := os.Hostname()
+		if hostname == "" {
+			hostname = "xzg-mt"
+		}
+		server, err = zeroconf.RegisterProxy(instance, BRIDGE_SERVICE_TYPE, "local.", port, hostname, []string{ip.String()}, txt, ifaces)
+	} else {
+		server, err = zeroconf.Register(instance, BRIDGE_SERVICE_TYPE, "local.", port, txt, ifaces)
+	}
+	if err != nil {
+		log.Printf("[mdns] failed to advertise bridge: %v\n", err)
+		return
+	}
+
+	bridgeAdvertiser = server
+	log.Printf("[mdns] advertising %q as %s on port %d\n", instance, BRIDGE_SERVICE_TYPE, port)
+	if debugMode {
+		log.Printf("[mdns] TXT: %v\n", txt)
+	}
+}
+
+func stopBridgeAdvertiser() {
+	if bridgeAdvertiser != nil {
+		bridgeAdvertiser.Shutdown()
+		bridgeAdvertiser = nil
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Authentication modes for the per-port serial TCP servers.
+const (
+	TCP_AUTH_NONE  = "none"  // no authentication (default)
+	TCP_AUTH_TOKEN = "token" // client sends "AUTH <token>\n" first, bridge answers "OK\n"
+	TCP_AUTH_TLS   = "tls"   // TLS with client certificates signed by -tcp-client-ca
+)
+
+// HA_SUPERVISOR_IP is the address Home Assistant ingress requests come from.
+const HA_SUPERVISOR_IP = "172.30.32.2"
+
+// TCP_AUTH_TIMEOUT bounds the token handshake on serial TCP connections.
+const TCP_AUTH_TIMEOUT = 5 * time.Second
+
+var (
+	apiKeyList   []string
+	tcpTLSConfig *tls.Config
+)
+
+// initAuth validates the authentication options. It must be called once at startup.
+func initAuth() error {
+	apiKeyList = splitList(apiKeys)
+	if authToken != "" {
+		apiKeyList = append(apiKeyList, authToken)
+	}
+
+	switch tcpAuthMode {
+	case "", TCP_AUTH_NONE:
+		tcpAuthMode = TCP_AUTH_NONE
+	case TCP_AUTH_TOKEN:
+		if len(apiKeyList) == 0 {
+			return fmt.Errorf("tcp-auth=token requires -auth-token or -api-keys")
+		}
+	case TCP_AUTH_TLS:
+		if tcpTLSCert == "" || tcpTLSKey == "" || tcpClientCA == "" {
+			return fmt.Errorf("tcp-auth=tls requires -tcp-tls-cert, -tcp-tls-key and -tcp-client-ca")
+		}
+		cert, err := tls.LoadX509KeyPair(tcpTLSCert, tcpTLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to load TCP TLS certificate: %v", err)
+		}
+		caPEM, err := os.ReadFile(tcpClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to read TCP client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in %s", tcpClientCA)
+		}
+		tcpTLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+			MinVersion:   tls.VersionTLS12,
+		}
+	default:
+		return fmt.Errorf("unknown tcp-auth mode %q (supported: none, token, tls)", tcpAuthMode)
+	}
+	return nil
+}
+
+// isAuthEnabled reports whether HTTP/WebSocket requests need a credential.
+func isAuthEnabled() bool {
+	return len(apiKeyList) > 0
+}
+
+// isValidCredential compares a credential with every configured key in constant time.
+func isValidCredential(credential string) bool {
+	if credential == "" {
+		return false
+	}
+	valid := false
+	for _, key := range apiKeyList {
+		if subtle.ConstantTimeCompare([]byte(credential), []byte(key)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// requestCredential extracts a credential from the Authorization bearer header,
+// the X-API-Key header or the token query parameter (browsers can't set
+// headers on WebSocket connections).
+func requestCredential(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, token, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("token")
+}
+
+// isIngressRequest reports whether the request was proxied by Home Assistant
+// ingress. Only the direct peer address is checked, never forwarded headers.
+func isIngressRequest(r *http.Request) bool {
+	if r.Header.Get("X-Ingress-Path") == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err == nil && host == HA_SUPERVISOR_IP
+}
+
+// requireAuth is the Echo middleware protecting the API endpoints.
+func requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isAuthEnabled() || isIngressRequest(c.Request()) || isValidCredential(requestCredential(c.Request())) {
+			return next(c)
+		}
+		c.Response().Header().Set("WWW-Authenticate", `Bearer realm="xzg-mt"`)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Unauthorized",
+		})
+	}
+}
+
+// wrapSerialListener tunes the connections of a serial TCP listener and adds
+// TLS with client certificates when configured.
+func wrapSerialListener(l net.Listener) net.Listener {
+	l = tunedListener{l}
+	if tcpAuthMode == TCP_AUTH_TLS && tcpTLSConfig != nil {
+		return tls.NewListener(l, tcpTLSConfig)
+	}
+	return l
+}
+
+// tunedListener sets the serial TCP options on the raw connection, before a
+// TLS wrapper hides the *net.TCPConn.
+type tunedListener struct {
+	net.Listener
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		// disable Nagle to reduce latency, enlarge buffers a bit (ignore errors)
+		_ = tcpConn.SetNoDelay(true)
+		_ = tcpConn.SetReadBuffer(64 * 1024)
+		_ = tcpConn.SetWriteBuffer(64 * 1024)
+		// keepalive helps persistent connections
+		_ = tcpConn.SetKeepAlive(true)
+	}
+	return conn, err
+}
+
+// readHandshakeLine reads one handshake line byte by byte, so no payload
+// following it is consumed.
+func readHandshakeLine(conn net.Conn) (string, error) {
+	line := make([]byte, 0, 128)
+	b := make([]byte, 1)
+	for len(line) < 512 {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// authenticateSerialClient performs the token or TLS handshake on a serial TCP connection.
+func authenticateSerialClient(conn net.Conn) error {
+	switch tcpAuthMode {
+	case TCP_AUTH_TOKEN:
+		_ = conn.SetReadDeadline(time.Now().Add(TCP_AUTH_TIMEOUT))
+		defer conn.SetReadDeadline(time.Time{})
+
+		line, err := readHandshakeLine(conn)
+		if err != nil {
+			return fmt.Errorf("auth handshake: %v", err)
+		}
+		cmd, token, _ := strings.Cut(line, " ")
+		if cmd != "AUTH" || !isValidCredential(strings.TrimSpace(token)) {
+			_, _ = conn.Write([]byte("ERR\n"))
+			return fmt.Errorf("auth handshake: invalid token")
+		}
+		_, err = conn.Write([]byte("OK\n"))
+		return err
+	case TCP_AUTH_TLS:
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			_ = conn.SetDeadline(time.Now().Add(TCP_AUTH_TIMEOUT))
+			defer conn.SetDeadline(time.Time{})
+			return tlsConn.Handshake()
+		}
+	}
+	return nil
+}
+
+// dialSerialServer connects the WebSocket bridge to one of the bridge's own
+// serial TCP servers, authenticating the same way an external client would.
+func dialSerialServer(target string, timeout time.Duration) (net.Conn, error) {
+	var token string
+	if len(apiKeyList) > 0 {
+		token = apiKeyList[0]
+	}
+	return dialSerialServerAuth(target, timeout, tcpAuthMode, token)
+}
+
+// dialSerialServerAuth connects to a serial TCP server using the -tcp-auth
+// mode of that server: token sends the given token, tls presents the bridge's
+// serial TCP certificate.
+func dialSerialServerAuth(target string, timeout time.Duration, mode, token string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	switch mode {
+	case TCP_AUTH_TLS:
+		if tcpTLSConfig == nil {
+			return nil, fmt.Errorf("%w: no client certificate, -tcp-auth tls is not configured", errSerialAuth)
+		}
+		// present the bridge certificate; -tcp-client-ca must trust it
+		return tls.DialWithDialer(dialer, "tcp", target, &tls.Config{
+			Certificates:       tcpTLSConfig.Certificates,
+			InsecureSkipVerify: true,
+		})
+	case TCP_AUTH_TOKEN:
+		if token == "" {
+			return nil, fmt.Errorf("%w: no token", errSerialAuth)
+		}
+		conn, err := dialer.Dial("tcp", target)
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Now().Add(TCP_AUTH_TIMEOUT))
+		if _, err := conn.Write([]byte("AUTH " + token + "\n")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		reply, err := readHandshakeLine(conn)
+		if err != nil || reply != "OK" {
+			conn.Close()
+			return nil, errSerialAuth
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+	return dialer.Dial("tcp", target)
+}
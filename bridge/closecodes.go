@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Application close codes sent to /ws clients, so the UI can tell why a
+// session ended.
+const (
+	CLOSE_ERROR         = 4000 // unclassified error
+	CLOSE_DNS           = 4001 // target host name could not be resolved
+	CLOSE_REFUSED       = 4002 // target refused the connection
+	CLOSE_TIMEOUT       = 4003 // dial timed out
+	CLOSE_POLICY        = 4004 // target blocked by the bridge target policy
+	CLOSE_SERIAL_BUSY   = 4005 // serial port busy or unavailable
+	CLOSE_UNREACHABLE   = 4006 // host or network unreachable
+	CLOSE_AUTH          = 4007 // serial TCP server rejected the bridge credentials
+	CLOSE_TARGET_CLOSED = 4008 // target closed the connection
+	CLOSE_LIMIT         = 4029 // session limit reached
+)
+
+// DEFAULT_DIAL_TIMEOUT_MS is the default for -dial-timeout.
+const DEFAULT_DIAL_TIMEOUT_MS = 5000
+
+// maxCloseReason is the longest reason that fits into a close frame.
+const maxCloseReason = 123
+
+// errSerialAuth is returned when a serial TCP server rejects the bridge.
+var errSerialAuth = errors.New("serial server rejected the bridge credentials")
+
+// classifyDialError maps a dial error to a close code and a readable reason.
+func classifyDialError(err error) (int, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errSerialAuth):
+		return CLOSE_AUTH, "serial server authentication failed"
+	case errors.As(err, &dnsErr):
+		return CLOSE_DNS, "cannot resolve " + dnsErr.Name
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CLOSE_REFUSED, "connection refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return CLOSE_UNREACHABLE, "host unreachable"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CLOSE_TIMEOUT, "connection timed out"
+	}
+	return CLOSE_ERROR, err.Error()
+}
+
+// closeWebSocket sends a close frame with code and reason, logs it and closes the connection.
+func closeWebSocket(ws *websocket.Conn, target string, code int, reason string) {
+	log.Printf("[websocket] closing %s: %d %s\n", target, code, reason)
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	_ = ws.Close()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyDialError(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		name   string
+		err    error
+		code   int
+		reason string
+	}{
+		{"auth", fmt.Errorf("dial: %w", errSerialAuth), CLOSE_AUTH, "serial server authentication failed"},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "xzg.local"}}, CLOSE_DNS, "cannot resolve xzg.local"},
+		{"refused", opErr(syscall.ECONNREFUSED), CLOSE_REFUSED, "connection refused"},
+		{"host unreachable", opErr(syscall.EHOSTUNREACH), CLOSE_UNREACHABLE, "host unreachable"},
+		{"network unreachable", opErr(syscall.ENETUNREACH), CLOSE_UNREACHABLE, "host unreachable"},
+		{"timeout", &net.OpError{Op: "dial", Err: timeoutError{}}, CLOSE_TIMEOUT, "connection timed out"},
+		{"other", errors.New("boom"), CLOSE_ERROR, "boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reason := classifyDialError(tt.err)
+			if code != tt.code || reason != tt.reason {
+				t.Errorf("classifyDialError = %d %q, want %d %q", code, reason, tt.code, tt.reason)
+			}
+		})
+	}
+}
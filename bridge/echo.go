@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ECHO_TIMEOUT is how long transmitted bytes wait for their echo before they
+// are no longer expected (measured from the last transmit or matched byte).
+const ECHO_TIMEOUT = 250 * time.Millisecond
+
+// maxEchoPending caps the amount of transmitted data remembered for matching.
+const maxEchoPending = 64 * 1024
+
+// EchoStats counts echo suppression results for a serial port.
+type EchoStats struct {
+	Dropped    uint64 `json:"dropped"`    // echoed bytes removed from RX
+	Mismatches uint64 `json:"mismatches"` // RX bytes that differed from the expected echo
+	Expired    uint64 `json:"expired"`    // expected echo bytes that never arrived (timeout or resync)
+}
+
+func (s *EchoStats) snapshot() EchoStats {
+	return EchoStats{
+		Dropped:    atomic.LoadUint64(&s.Dropped),
+		Mismatches: atomic.LoadUint64(&s.Mismatches),
+		Expired:    atomic.LoadUint64(&s.Expired),
+	}
+}
+
+// echoCanceler removes the local echo of half-duplex/single-wire adapters
+// (e.g. Telink uart2swire) from the RX stream before it reaches clients.
+type echoCanceler struct {
+	mu       sync.Mutex
+	pending  []byte
+	activity time.Time
+	stats    *EchoStats
+}
+
+func newEchoCanceler(stats *EchoStats) *echoCanceler {
+	return &echoCanceler{stats: stats}
+}
+
+// Transmitted records bytes about to be written so their echo can be matched.
+// It must be called before the data is written to the port.
+func (e *echoCanceler) Transmitted(data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, data...)
+	if over := len(e.pending) - maxEchoPending; over > 0 {
+		atomic.AddUint64(&e.stats.Expired, uint64(over))
+		e.pending = consume(e.pending, over)
+	}
+	e.activity = time.Now()
+}
+
+// Filter drops the expected echo from received data and returns the rest.
+// On a mismatch the byte is forwarded and the remaining expected echo is
+// discarded, so real data is never swallowed.
+func (e *echoCanceler) Filter(data []byte) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.pending) > 0 && time.Since(e.activity) > ECHO_TIMEOUT {
+		atomic.AddUint64(&e.stats.Expired, uint64(len(e.pending)))
+		e.pending = e.pending[:0]
+	}
+	if len(e.pending) == 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	matched, dropped := 0, 0
+	for _, b := range data {
+		if matched < len(e.pending) {
+			if b == e.pending[matched] {
+				matched++
+				dropped++
+				continue
+			}
+			// resync: stop expecting the rest of this echo
+			atomic.AddUint64(&e.stats.Mismatches, 1)
+			atomic.AddUint64(&e.stats.Expired, uint64(len(e.pending)-matched))
+			matched = len(e.pending)
+		}
+		out = append(out, b)
+	}
+	if dropped > 0 {
+		atomic.AddUint64(&e.stats.Dropped, uint64(dropped))
+		e.activity = time.Now()
+	}
+	e.pending = consume(e.pending, matched)
+	return out
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Data paths for serial ports of peer bridges (-peer-mode).
+const (
+	PEER_MODE_DIRECT = "direct" // clients connect to the peer's serial TCP port
+	PEER_MODE_PROXY  = "proxy"  // clients connect to a local port relayed to the peer
+)
+
+const (
+	PEER_POLL_INTERVAL   = 15 * time.Second
+	PEER_REQUEST_TIMEOUT = 5 * time.Second
+	// services of a peer that stops answering are kept this long
+	PEER_STALE_AFTER = 3 * PEER_POLL_INTERVAL
+)
+
+// bridgeID identifies this bridge process, so it never federates with itself.
+var bridgeID = newBridgeID()
+
+func newBridgeID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// bridgeIdentity is reported by /mdns so peers can tell bridges apart.
+type bridgeIdentity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ServiceBridge tags a service with the peer bridge that owns it.
+type ServiceBridge struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Mode string `json:"mode"`
+}
+
+// PeerStatus is reported by /mdns for every peer bridge.
+type PeerStatus struct {
+	Name   string    `json:"name"`
+	URL    string    `json:"url"`
+	Ports  int       `json:"ports"`
+	LastOK time.Time `json:"lastOk"`
+	// Error is the last failure reaching the peer, empty while it answers
+	Error string `json:"error,omitempty"`
+	// RelayError is the last failure of a proxy relay to one of its serial
+	// ports, empty once a relay connects
+	RelayError string `json:"relayError,omitempty"`
+}
+
+type bridgePeer struct {
+	url      string
+	name     string
+	id       string
+	services []ServiceInfo // local serial services as reported by the peer
+	lastOK   time.Time
+	lastErr  string
+}
+
+// peerProxy relays a local TCP port to a serial TCP server of a peer.
+type peerProxy struct {
+	listener net.Listener
+	port     int
+	peerURL  string
+	target   string // host:port of the peer's serial server
+	peerPort int
+	auth     string // -tcp-auth mode of the peer's serial server
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	lastErr string
+	errTime time.Time
+}
+
+type federation struct {
+	static   []string
+	discover bool
+	mode     string
+	client   *http.Client
+
+	mu      sync.Mutex
+	peers   map[string]*bridgePeer // by URL
+	proxies map[string]*peerProxy  // by peer serial server host:port
+}
+
+var federationInstance *federation
+
+// bridgeServiceType is BRIDGE_SERVICE_TYPE as browsed by the mDNS browser.
+var bridgeServiceType = ServiceType{Type: strings.TrimPrefix(strings.TrimSuffix(BRIDGE_SERVICE_TYPE, "._tcp"), "_"), Protocol: "tcp"}
+
+// startFederation merges the local serial ports of the -peers and, with
+// discover, of every bridge announcing itself via mDNS into /mdns?types=local.
+func startFederation(peers []string, discover bool, mode string) error {
+	switch mode {
+	case "", PEER_MODE_DIRECT:
+		mode = PEER_MODE_DIRECT
+	case PEER_MODE_PROXY:
+	default:
+		return fmt.Errorf("invalid peer mode %q (direct or proxy)", mode)
+	}
+	tlsConfig, err := newPeerTLSConfig(peerCA, splitList(peerPins))
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	f := &federation{
+		discover: discover,
+		mode:     mode,
+		client:   &http.Client{Timeout: PEER_REQUEST_TIMEOUT, Transport: transport},
+		peers:    make(map[string]*bridgePeer),
+		proxies:  make(map[string]*peerProxy),
+	}
+	for _, p := range peers {
+		u, err := parsePeerURL(p)
+		if err != nil {
+			return err
+		}
+		f.static = append(f.static, u)
+	}
+	if len(f.static) == 0 && !discover {
+		return nil
+	}
+	if discover {
+		if b := mdnsBrowserInstance; b != nil {
+			b.addTypes([]ServiceType{bridgeServiceType})
+		} else {
+			log.Printf("[peers] mDNS browser not running, only -peers are used\n")
+		}
+	}
+
+	federationInstance = f
+	log.Printf("[peers] federation enabled (%d static peers, discovery: %v, mode: %s)\n", len(f.static), discover, mode)
+	go f.run()
+	return nil
+}
+
+// peerCertError is returned when an HTTPS peer presents a certificate that is
+// neither signed by a trusted CA nor pinned.
+type peerCertError struct {
+	fingerprint string
+	err         error
+}
+
+func (e *peerCertError) Error() string {
+	return fmt.Sprintf("untrusted certificate (SHA-256 %s): %v; trust it with -peer-ca or -peer-cert-sha256", e.fingerprint, e.err)
+}
+
+func (e *peerCertError) Unwrap() error { return e.err }
+
+// newPeerTLSConfig verifies HTTPS peers against the system roots and the
+// certificates in caFile. A certificate whose SHA-256 fingerprint is pinned is
+// trusted whatever its issuer and names, so a peer's self-signed certificate
+// can be trusted by the fingerprint its /cert shows.
+func newPeerTLSConfig(caFile string, pins []string) (*tls.Config, error) {
+	var roots *x509.CertPool
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read peer CA: %v", err)
+		}
+		if roots, err = x509.SystemCertPool(); err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	pinned := make(map[string]bool)
+	for _, pin := range pins {
+		sum, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid peer certificate fingerprint %q, expected a SHA-256 in hex", pin)
+		}
+		pinned[string(sum)] = true
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// verified in VerifyConnection, which also accepts pinned certificates
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("peer sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			sum := sha256.Sum256(leaf.Raw)
+			if pinned[string(sum[:])] {
+				return nil
+			}
+			opts := x509.VerifyOptions{Roots: roots, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			if _, err := leaf.Verify(opts); err != nil {
+				return &peerCertError{fingerprint: formatFingerprint(sum[:]), err: err}
+			}
+			return nil
+		},
+	}, nil
+}
+
+// parsePeerURL accepts host, host:port or an http(s) URL.
+func parsePeerURL(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("invalid peer %q, expected host[:port] or http(s)://host:port", s)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = strconv.Itoa(DEFAULT_WS_PORT)
+	}
+	return u.Scheme + "://" + net.JoinHostPort(host, port), nil
+}
+
+func (f *federation) run() {
+	ticker := time.NewTicker(PEER_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		f.poll()
+		select {
+		case <-ticker.C:
+		case <-bridgeCtx.Done():
+			f.mu.Lock()
+			for target, p := range f.proxies {
+				p.close()
+				delete(f.proxies, target)
+			}
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// peerURLs returns the static peers and the bridges found via mDNS.
+func (f *federation) peerURLs() map[string]string {
+	urls := make(map[string]string) // URL -> announced name
+	for _, u := range f.static {
+		urls[u] = ""
+	}
+	if b := mdnsBrowserInstance; f.discover && b != nil {
+		for _, info := range b.services([]ServiceType{bridgeServiceType}) {
+			if info.TXT["id"] == bridgeID {
+				continue
+			}
+			scheme := "http"
+			if info.TXT["tls"] == "1" {
+				scheme = "https"
+			}
+			urls[scheme+"://"+net.JoinHostPort(info.Host, strconv.Itoa(info.Port))] = info.Name
+		}
+	}
+	return urls
+}
+
+func (f *federation) poll() {
+	type result struct {
+		url      string
+		name     string
+		identity bridgeIdentity
+		services []ServiceInfo
+		err      error
+	}
+	urls := f.peerURLs()
+	results := make(chan result, len(urls))
+	var wg sync.WaitGroup
+	for u, name := range urls {
+		wg.Add(1)
+		go func(u, name string) {
+			defer wg.Done()
+			identity, services, err := f.fetchPeer(u)
+			results <- result{url: u, name: name, identity: identity, services: services, err: err}
+		}(u, name)
+	}
+	wg.Wait()
+	close(results)
+
+	// a bridge reachable under several URLs is kept under the same one every
+	// poll: a -peers entry first, then the lowest URL
+	static := make(map[string]bool)
+	for _, u := range f.static {
+		static[u] = true
+	}
+	var ordered []result
+	for r := range results {
+		ordered = append(ordered, r)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if static[ordered[i].url] != static[ordered[j].url] {
+			return static[ordered[i].url]
+		}
+		return ordered[i].url < ordered[j].url
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for u, p := range f.peers {
+		if _, ok := urls[u]; !ok {
+			log.Printf("[peers] %s (%s) left\n", p.name, u)
+			delete(f.peers, u)
+		}
+	}
+	seenIDs := make(map[string]string)
+	for _, r := range ordered {
+		p := f.peers[r.url]
+		if p == nil {
+			p = &bridgePeer{url: r.url, name: r.name}
+			f.peers[r.url] = p
+		}
+		if r.err != nil {
+			if p.lastErr == "" {
+				log.Printf("[peers] %s: %v\n", r.url, r.err)
+			}
+			p.lastErr = r.err.Error()
+			if time.Since(p.lastOK) > PEER_STALE_AFTER {
+				p.services = nil
+			}
+			continue
+		}
+		// the same bridge may be listed and discovered under another address
+		if r.identity.ID == bridgeID || (r.identity.ID != "" && seenIDs[r.identity.ID] != "") {
+			delete(f.peers, r.url)
+			continue
+		}
+		seenIDs[r.identity.ID] = r.url
+		if p.lastOK.IsZero() || p.lastErr != "" {
+			log.Printf("[peers] %s: %d serial ports\n", r.url, len(r.services))
+		}
+		if r.identity.Name != "" {
+			p.name = r.identity.Name
+		}
+		if p.name == "" {
+			p.name = r.url
+		}
+		p.id = r.identity.ID
+		p.services = r.services
+		p.lastOK = time.Now()
+		p.lastErr = ""
+		if f.mode == PEER_MODE_DIRECT {
+			for _, s := range r.services {
+				rememberDiscoveredTarget(s.Host, s.Port)
+			}
+		}
+	}
+	if f.mode == PEER_MODE_PROXY {
+		f.syncProxies()
+	}
+}
+
+// fetchPeer reads the peer's own local serial services; peers=0 keeps the
+// peer from adding the services of its peers.
+func (f *federation) fetchPeer(peerURL string) (bridgeIdentity, []ServiceInfo, error) {
+	var body struct {
+		Bridge  bridgeIdentity `json:"bridge"`
+		Devices []ServiceInfo  `json:"devices"`
+	}
+	resp, err := f.peerGet(peerURL + "/mdns?types=local&peers=0")
+	if err != nil {
+		return body.Bridge, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return body.Bridge, nil, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return body.Bridge, nil, fmt.Errorf("invalid peer response: %v", err)
+	}
+
+	peerHost := peerURL[strings.Index(peerURL, "://")+3:]
+	peerHost, _, _ = net.SplitHostPort(peerHost)
+	own := peerAddresses(peerHost)
+	var services []ServiceInfo
+	for _, s := range body.Devices {
+		if s.Bridge != nil {
+			continue
+		}
+		// a serial port is reached at the peer itself: a peer without a usable
+		// advertise host, or one reporting another host, must not make the
+		// bridge dial or allow arbitrary targets
+		if !own[s.Host] {
+			s.Host = peerHost
+		}
+		services = append(services, s)
+	}
+	return body.Bridge, services, nil
+}
+
+// peerAddresses returns the host of a peer URL and the addresses it
+// resolves to.
+func peerAddresses(host string) map[string]bool {
+	own := map[string]bool{host: true}
+	if ip, ok := parseTargetIP(host); ok {
+		own[ip.String()] = true
+		return own
+	}
+	addrs, _ := lookupTargetIPs(host)
+	for _, a := range addrs {
+		own[a.String()] = true
+	}
+	return own
+}
+
+func (f *federation) peerGet(u string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(bridgeCtx, PEER_REQUEST_TIMEOUT)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if token := f.peerAuthToken(u); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// peerAuthToken returns the bearer token for a request to a peer: -peer-token
+// for every peer, otherwise -auth-token for the -peers only. A bridge found
+// via mDNS never gets the bridge's own credential.
+func (f *federation) peerAuthToken(u string) string {
+	if peerToken != "" {
+		return peerToken
+	}
+	for _, s := range f.static {
+		if strings.HasPrefix(u, s+"/") || u == s {
+			return authToken
+		}
+	}
+	return ""
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// status reports every peer, sorted by URL.
+func (f *federation) status() []PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := make([]PeerStatus, 0, len(f.peers))
+	for _, p := range f.peers {
+		name := p.name
+		if name == "" {
+			name = p.url
+		}
+		status := PeerStatus{Name: name, URL: p.url, Ports: len(p.services), LastOK: p.lastOK, Error: p.lastErr}
+		var errTime time.Time
+		for _, proxy := range f.proxies {
+			if proxy.peerURL != p.url {
+				continue
+			}
+			proxy.mu.Lock()
+			if proxy.lastErr != "" && proxy.errTime.After(errTime) {
+				status.RelayError, errTime = proxy.lastErr, proxy.errTime
+			}
+			proxy.mu.Unlock()
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+	return list
+}
+
+// services returns the serial services of all peers, tagged with their
+// bridge. In proxy mode host and port point to the local relay.
+func (f *federation) services() []ServiceInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	urls := make([]string, 0, len(f.peers))
+	for u := range f.peers {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+
+	var results []ServiceInfo
+	for _, u := range urls {
+		p := f.peers[u]
+		for _, s := range p.services {
+			s.Bridge = &ServiceBridge{Name: p.name, URL: p.url, Mode: f.mode}
+			if f.mode == PEER_MODE_PROXY {
+				proxy := f.proxies[net.JoinHostPort(s.Host, strconv.Itoa(s.Port))]
+				if proxy == nil {
+					continue
+				}
+				s.Host = getAdvertiseHost()
+				s.Port = proxy.port
+			}
+			results = append(results, s)
+		}
+	}
+	return results
+}
+
+// syncProxies opens a relay for every peer serial service and closes relays
+// of services that are gone. Called with f.mu held.
+func (f *federation) syncProxies() {
+	wanted := make(map[string]*bridgePeer)
+	services := make(map[string]ServiceInfo)
+	for _, p := range f.peers {
+		for _, s := range p.services {
+			target := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+			wanted[target] = p
+			services[target] = s
+		}
+	}
+	for target, proxy := range f.proxies {
+		if p := wanted[target]; p == nil || p.url != proxy.peerURL || proxy.auth != peerSerialAuth(services[target]) {
+			proxy.close()
+			delete(f.proxies, target)
+		}
+	}
+	for target, p := range wanted {
+		if f.proxies[target] != nil {
+			continue
+		}
+		proxy, err := openPeerProxy(p.url, target, services[target].Port, peerSerialAuth(services[target]))
+		if err != nil {
+			log.Printf("[peers] relay for %s: %v\n", target, err)
+			continue
+		}
+		f.proxies[target] = proxy
+		log.Printf("[peers] relaying port %d to %s (%s)\n", proxy.port, target, p.name)
+	}
+}
+
+// proxyForPort returns the relay listening on a local port, if any.
+func (f *federation) proxyForPort(port int) *peerProxy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.proxies {
+		if p.port == port {
+			return p
+		}
+	}
+	return nil
+}
+
+// findPeerProxy returns the relay listening on a local port, if any.
+func findPeerProxy(port int) *peerProxy {
+	if f := federationInstance; f != nil {
+		return f.proxyForPort(port)
+	}
+	return nil
+}
+
+// peerSerialAuth returns the -tcp-auth mode a peer reports for a serial port.
+// Peers that don't report it are assumed to use the bridge's own mode.
+func peerSerialAuth(s ServiceInfo) string {
+	if mode := s.TXT["tcp_auth"]; mode != "" {
+		return mode
+	}
+	return tcpAuthMode
+}
+
+func openPeerProxy(peerURL, target string, peerPort int, auth string) (*peerProxy, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	p := &peerProxy{
+		listener: wrapSerialListener(l),
+		port:     l.Addr().(*net.TCPAddr).Port,
+		peerURL:  peerURL,
+		target:   target,
+		peerPort: peerPort,
+		auth:     auth,
+		conns:    make(map[net.Conn]bool),
+	}
+	go p.serve()
+	return p, nil
+}
+
+// serve accepts clients like a serial TCP server of the bridge itself and
+// relays them to the peer, authenticating with the peer credential.
+func (p *peerProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *peerProxy) handle(c net.Conn) {
+	defer c.Close()
+	if err := authenticateSerialClient(c); err != nil {
+		log.Printf("[peers] rejected %s: %v\n", c.RemoteAddr(), err)
+		return
+	}
+	if !isBridgeConn(c.RemoteAddr(), time.Duration(dialTimeoutMs)*time.Millisecond) {
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		release, err := reserveSession(ip, p.target, "")
+		if err != nil {
+			log.Printf("[peers] rejected %s: %v\n", c.RemoteAddr(), err)
+			return
+		}
+		defer release()
+	}
+
+	upstream, err := p.dial()
+	p.setError(err)
+	if err != nil {
+		log.Printf("[peers] relay to %s failed: %v\n", p.target, err)
+		return
+	}
+	defer upstream.Close()
+	if !p.track(c, upstream) {
+		return
+	}
+	defer p.untrack(c, upstream)
+	if debugMode {
+		log.Printf("[peers] %s relayed to %s\n", c.RemoteAddr(), p.target)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(c, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	c.Close()
+	upstream.Close()
+	<-done
+}
+
+// dial connects to the peer's serial server with the peer's -tcp-auth mode
+// and the token used for the peer's API (-peer-token).
+func (p *peerProxy) dial() (net.Conn, error) {
+	var token string
+	if f := federationInstance; f != nil {
+		token = f.peerAuthToken(p.peerURL)
+	}
+	conn, err := dialSerialServerAuth(p.target, time.Duration(dialTimeoutMs)*time.Millisecond, p.auth, token)
+	if errors.Is(err, errSerialAuth) && p.auth == TCP_AUTH_TOKEN {
+		err = fmt.Errorf("%w (peer uses tcp-auth token, check -peer-token)", err)
+	}
+	return conn, err
+}
+
+// setError records the outcome of the last relay attempt for /mdns.
+func (p *peerProxy) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.lastErr, p.errTime = fmt.Sprintf("relay to %s: %v", p.target, err), time.Now()
+	} else {
+		p.lastErr = ""
+	}
+}
+
+func (p *peerProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		return false // closed
+	}
+	for _, c := range conns {
+		p.conns[c] = true
+	}
+	return true
+}
+
+func (p *peerProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// close stops the listener and drops the relayed connections.
+func (p *peerProxy) close() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// forwardPeerControl passes a /sc request for a relayed port on to the peer.
+func forwardPeerControl(c echo.Context, p *peerProxy) error {
+	query := c.QueryParams()
+	query.Del("token")
+	query.Del("path")
+	query.Set("port", strconv.Itoa(p.peerPort))
+
+	resp, err := federationInstance.peerGet(p.peerURL + "/sc?" + query.Encode())
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error": fmt.Sprintf("peer bridge %s: %v", p.peerURL, err),
+		})
+	}
+	defer resp.Body.Close()
+	contentType := resp.Header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = echo.MIMEApplicationJSON
+	}
+	return c.Stream(resp.StatusCode, contentType, resp.Body)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPeer serves /mdns?types=local like a peer bridge and records the
+// Authorization header of the last request.
+func newTestPeer(t *testing.T, id string, devices []ServiceInfo, auth *string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			*auth = r.Header.Get("Authorization")
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"bridge":  bridgeIdentity{ID: id, Name: "peer " + id},
+			"devices": devices,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func newTestFederation(static ...string) *federation {
+	return &federation{
+		static:  static,
+		mode:    PEER_MODE_DIRECT,
+		client:  http.DefaultClient,
+		peers:   make(map[string]*bridgePeer),
+		proxies: make(map[string]*peerProxy),
+	}
+}
+
+func TestPeerAuthToken(t *testing.T) {
+	savedPeer, savedAuth := peerToken, authToken
+	t.Cleanup(func() { peerToken, authToken = savedPeer, savedAuth })
+	f := newTestFederation("http://10.0.0.2:8765")
+
+	tests := []struct {
+		name      string
+		peerToken string
+		url       string
+		want      string
+	}{
+		{"static peer gets the auth token", "", "http://10.0.0.2:8765/mdns", "secret"},
+		{"discovered peer gets nothing", "", "http://10.0.0.3:8765/mdns", ""},
+		{"lookalike port gets nothing", "", "http://10.0.0.2:87650/mdns", ""},
+		{"explicit peer token goes to every peer", "peers", "http://10.0.0.3:8765/mdns", "peers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peerToken, authToken = tt.peerToken, "secret"
+			if got := f.peerAuthToken(tt.url); got != tt.want {
+				t.Errorf("peerAuthToken(%s) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchPeerKeepsServicesOnThePeer(t *testing.T) {
+	u := newTestPeer(t, "p1", []ServiceInfo{
+		{Name: "/dev/ttyUSB0", Host: "127.0.0.1", Port: 6638},
+		{Name: "/dev/ttyUSB1", Host: "", Port: 6639},
+		{Name: "router", Host: "192.168.1.1", Port: 22},
+		{Name: "relayed", Host: "10.0.0.9", Port: 6640, Bridge: &ServiceBridge{Name: "other"}},
+	}, nil)
+	f := newTestFederation(u)
+
+	_, services, err := f.fetchPeer(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 3 {
+		t.Fatalf("%d services, want 3 (ports of the peer's peers are skipped)", len(services))
+	}
+	for _, s := range services {
+		if s.Host != "127.0.0.1" {
+			t.Errorf("%s on host %q, want the peer's address", s.Name, s.Host)
+		}
+	}
+}
+
+func TestPollResolvesDuplicatePeersDeterministically(t *testing.T) {
+	a := newTestPeer(t, "same", nil, nil)
+	b := newTestPeer(t, "same", nil, nil)
+	urls := []string{a, b}
+	sort.Strings(urls)
+
+	for i := 0; i < 5; i++ {
+		f := newTestFederation(urls[1], urls[0])
+		f.poll()
+		if len(f.peers) != 1 || f.peers[urls[0]] == nil {
+			t.Fatalf("poll %d kept %v, want only %s", i, f.peers, urls[0])
+		}
+	}
+}
+
+func TestPeerTLSTrust(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"bridge":  bridgeIdentity{ID: "tls", Name: "peer tls"},
+			"devices": []ServiceInfo{},
+		})
+	}))
+	defer srv.Close()
+	der := srv.Certificate().Raw
+	sum := sha256.Sum256(der)
+	caFile := filepath.Join(t.TempDir(), "peer.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		caFile  string
+		pins    []string
+		trusted bool
+	}{
+		{"system roots only", "", nil, false},
+		{"peer certificate as CA", caFile, nil, true},
+		{"pinned fingerprint", "", []string{formatFingerprint(sum[:])}, true},
+		{"other fingerprint", "", []string{formatFingerprint(make([]byte, sha256.Size))}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := newPeerTLSConfig(tt.caFile, tt.pins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := newTestFederation(srv.URL)
+			f.client = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+			_, _, err = f.fetchPeer(srv.URL)
+			var certErr *peerCertError
+			switch {
+			case tt.trusted && err != nil:
+				t.Errorf("fetchPeer: %v", err)
+			case !tt.trusted && !errors.As(err, &certErr):
+				t.Errorf("fetchPeer error = %v, want an untrusted certificate error", err)
+			}
+		})
+	}
+}
+
+func TestNewPeerTLSConfigRejectsInvalidPins(t *testing.T) {
+	if _, err := newPeerTLSConfig("", []string{"AB:CD"}); err == nil {
+		t.Error("short fingerprint accepted")
+	}
+}
+
+// newTestSerialServer accepts one token handshake per connection like a peer
+// with -tcp-auth token and echoes the data of authenticated clients.
+func newTestSerialServer(t *testing.T, token string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, err := readHandshakeLine(c)
+				if err != nil || line != "AUTH "+token {
+					_, _ = c.Write([]byte("ERR\n"))
+					return
+				}
+				_, _ = c.Write([]byte("OK\n"))
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPeerProxyAuthenticatesWithPeerToken(t *testing.T) {
+	savedPeer, savedKeys, savedMode, savedFed := peerToken, apiKeyList, tcpAuthMode, federationInstance
+	t.Cleanup(func() {
+		peerToken, apiKeyList, tcpAuthMode, federationInstance = savedPeer, savedKeys, savedMode, savedFed
+	})
+	apiKeyList, tcpAuthMode = []string{"own"}, TCP_AUTH_NONE
+
+	target := newTestSerialServer(t, "peer-secret")
+	peerURL := "http://" + target
+	f := newTestFederation(peerURL)
+	f.peers[peerURL] = &bridgePeer{url: peerURL, name: "peer"}
+	federationInstance = f
+
+	// relay opens a relay with the given peer token and sends data through it
+	relay := func(token string) ([]byte, error) {
+		peerToken = token // before the relay's goroutines start
+		proxy, err := openPeerProxy(peerURL, target, 6638, TCP_AUTH_TOKEN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.mu.Lock()
+		f.proxies[target] = proxy
+		f.mu.Unlock()
+		defer proxy.close()
+
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxy.port)))
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Write([]byte("hi")); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(c, buf)
+		return buf, err
+	}
+
+	if _, err := relay("wrong"); err == nil {
+		t.Fatal("relay with the wrong peer token succeeded")
+	}
+	if s := f.status(); len(s) != 1 || !strings.Contains(s[0].RelayError, "-peer-token") {
+		t.Errorf("status = %+v, want a relay error naming -peer-token", s)
+	}
+	if got, err := relay("peer-secret"); err != nil || string(got) != "hi" {
+		t.Fatalf("relay = %q, %v, want the echo", got, err)
+	}
+	if s := f.status(); s[0].RelayError != "" {
+		t.Errorf("relay error %q kept after a successful relay", s[0].RelayError)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Framer splits a byte stream into complete protocol frames, so that every
+// outgoing TCP write or WebSocket message carries exactly one frame.
+type Framer interface {
+	// Push appends data to the internal buffer and returns all complete frames.
+	// Bytes that can never start a valid frame are returned as their own chunk
+	// instead of being dropped.
+	Push(data []byte) [][]byte
+	// Flush returns the buffered bytes of an incomplete frame and resets the framer.
+	Flush() []byte
+	// Buffered returns the number of bytes held for an incomplete frame.
+	Buffered() int
+}
+
+// REASSEMBLY_TIMEOUT is how long an incomplete frame is held without new data
+// before it is forwarded as-is.
+const REASSEMBLY_TIMEOUT = 100 * time.Millisecond
+
+// MAX_FRAMER_BUFFER caps the bytes a delimiter-based framer holds while waiting
+// for the end of a frame; longer runs are forwarded as-is. Length-based
+// framers are bounded by their length field.
+const MAX_FRAMER_BUFFER = 4096
+
+// framerNames lists the framers accepted by newFramer (aliases included).
+var framerNames = []string{"hdlc", "spinel", "ash", "mt", "ti-bsl", "slip", "length-prefixed"}
+
+// reassemblerNames lists the names accepted by newReassembler.
+var reassemblerNames = []string{"none", "ti-bsl", "mt", "ash", "hdlc", "slip", "length-prefixed"}
+
+// newFramer creates a framer by name. An empty name or "none" returns nil,
+// meaning the stream is forwarded as-is.
+func newFramer(name string) (Framer, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return nil, nil
+	case "hdlc", "spinel":
+		// HDLC-lite as used by Spinel: 0x7E delimited, frames re-emitted with both flags
+		return &delimFramer{flag: 0x7E, opening: true}, nil
+	case "ash":
+		return &ashFramer{}, nil
+	case "mt":
+		return &mtFramer{}, nil
+	case "ti-bsl":
+		return &tiBslFramer{}, nil
+	case "slip":
+		return &delimFramer{flag: 0xC0}, nil
+	case "length-prefixed":
+		return &lengthPrefixFramer{}, nil
+	}
+	return nil, fmt.Errorf("unknown framer %q (supported: none, %s)", name, strings.Join(framerNames, ", "))
+}
+
+// newReassembler creates the framer that groups WebSocket data into whole
+// packets before it is written to the TCP target. "ti-bsl" keeps the original
+// bridge rule (0x00 0xCC <len> packets, everything else passes through) so
+// existing clients see no change; other names share the newFramer registry.
+func newReassembler(name string) (Framer, error) {
+	if strings.ToLower(strings.TrimSpace(name)) == "ti-bsl" {
+		return &bslPacketFramer{}, nil
+	}
+	if f, err := newFramer(name); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown reassemble mode %q (supported: %s)", name, strings.Join(reassemblerNames, ", "))
+}
+
+// readFramed reads from conn until the framer returns at least one chunk.
+// While an incomplete frame is buffered the read gives up after
+// REASSEMBLY_TIMEOUT and the partial frame is returned as-is; on a read error
+// the partial frame is returned together with the error.
+func readFramed(conn net.Conn, buf []byte, framer Framer) ([][]byte, error) {
+	for {
+		pending := framer.Buffered() > 0
+		if pending {
+			_ = conn.SetReadDeadline(time.Now().Add(REASSEMBLY_TIMEOUT))
+		}
+		n, err := conn.Read(buf)
+		timedOut := false
+		if pending {
+			_ = conn.SetReadDeadline(time.Time{})
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				timedOut, err = true, nil
+			}
+		}
+		var frames [][]byte
+		if n > 0 {
+			frames = framer.Push(buf[:n])
+		}
+		if (timedOut && n == 0) || err != nil {
+			if rest := framer.Flush(); len(rest) > 0 {
+				frames = append(frames, rest)
+			}
+		}
+		if err != nil || len(frames) > 0 {
+			return frames, err
+		}
+	}
+}
+
+// flushStale returns the framer's incomplete frame once REASSEMBLY_TIMEOUT
+// has passed since the last data, for readers that poll with a timeout.
+func flushStale(framer Framer, lastData time.Time) []byte {
+	if framer == nil || framer.Buffered() == 0 || time.Since(lastData) < REASSEMBLY_TIMEOUT {
+		return nil
+	}
+	return framer.Flush()
+}
+
+// isValidFramer reports whether name can be passed to newFramer.
+func isValidFramer(name string) bool {
+	_, err := newFramer(name)
+	return err == nil
+}
+
+// cloneBytes returns a copy of b that does not alias the framer buffer.
+func cloneBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+// consume drops the first n bytes of buf, reusing its backing array.
+func consume(buf []byte, n int) []byte {
+	return append(buf[:0], buf[n:]...)
+}
+
+// delimFramer handles flag-delimited protocols (HDLC-lite, SLIP).
+// Repeated flags are collapsed; each frame is emitted with a trailing flag and,
+// if opening is set, a leading one as well.
+type delimFramer struct {
+	flag    byte
+	opening bool
+	buf     []byte
+}
+
+func (f *delimFramer) Push(data []byte) [][]byte {
+	var frames [][]byte
+	for _, b := range data {
+		if b != f.flag {
+			f.buf = append(f.buf, b)
+			continue
+		}
+		if len(f.buf) == 0 {
+			// leading or repeated flag, nothing to terminate
+			continue
+		}
+		frame := make([]byte, 0, len(f.buf)+2)
+		if f.opening {
+			frame = append(frame, f.flag)
+		}
+		frame = append(frame, f.buf...)
+		frame = append(frame, f.flag)
+		frames = append(frames, frame)
+		f.buf = f.buf[:0]
+	}
+	if len(f.buf) >= MAX_FRAMER_BUFFER {
+		// no delimiter in sight: line noise or the wrong framer
+		frames = append(frames, f.Flush())
+	}
+	return frames
+}
+
+func (f *delimFramer) Flush() []byte {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	var out []byte
+	if f.opening {
+		out = append(out, f.flag)
+	}
+	out = append(out, f.buf...)
+	f.buf = f.buf[:0]
+	return out
+}
+
+func (f *delimFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// ashFramer handles EZSP ASH frames: byte-stuffed data terminated by a 0x7E flag.
+// A cancel byte (0x1A) terminates the frame in progress and is forwarded together
+// with the discarded bytes so the client can resynchronise the same way.
+type ashFramer struct {
+	buf []byte
+}
+
+const (
+	ashFlag   = 0x7E
+	ashCancel = 0x1A
+)
+
+func (f *ashFramer) Push(data []byte) [][]byte {
+	var frames [][]byte
+	for _, b := range data {
+		if b == ashFlag && len(f.buf) == 0 {
+			continue
+		}
+		f.buf = append(f.buf, b)
+		if b == ashFlag || b == ashCancel || len(f.buf) >= MAX_FRAMER_BUFFER {
+			frames = append(frames, cloneBytes(f.buf))
+			f.buf = f.buf[:0]
+		}
+	}
+	return frames
+}
+
+func (f *ashFramer) Flush() []byte {
+	return flushBuffer(&f.buf)
+}
+
+func (f *ashFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// mtFramer handles Z-Stack MT frames: 0xFE <len> <cmd0> <cmd1> <data...> <fcs>,
+// where FCS is the XOR of everything between SOF and FCS.
+type mtFramer struct {
+	buf []byte
+}
+
+const (
+	mtSOF        = 0xFE
+	mtMaxPayload = 250
+)
+
+func mtFCS(b []byte) byte {
+	var fcs byte
+	for _, v := range b {
+		fcs ^= v
+	}
+	return fcs
+}
+
+func (f *mtFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for len(f.buf) > 0 {
+		sof := bytes.IndexByte(f.buf, mtSOF)
+		if sof < 0 {
+			frames = append(frames, cloneBytes(f.buf))
+			f.buf = f.buf[:0]
+			break
+		}
+		if sof > 0 {
+			// bytes before SOF are not part of any frame
+			frames = append(frames, cloneBytes(f.buf[:sof]))
+			f.buf = consume(f.buf, sof)
+		}
+		if len(f.buf) < 2 {
+			break
+		}
+		plen := int(f.buf[1])
+		if plen > mtMaxPayload {
+			// not a real SOF, resync on the next one
+			frames = append(frames, cloneBytes(f.buf[:1]))
+			f.buf = consume(f.buf, 1)
+			continue
+		}
+		total := plen + 5
+		if len(f.buf) < total {
+			break
+		}
+		if mtFCS(f.buf[1:total-1]) != f.buf[total-1] {
+			frames = append(frames, cloneBytes(f.buf[:1]))
+			f.buf = consume(f.buf, 1)
+			continue
+		}
+		frames = append(frames, cloneBytes(f.buf[:total]))
+		f.buf = consume(f.buf, total)
+	}
+	return frames
+}
+
+func (f *mtFramer) Flush() []byte {
+	return flushBuffer(&f.buf)
+}
+
+func (f *mtFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// tiBslFramer handles the TI serial bootloader (CC2538/CC26xx) protocol:
+// ACK/NACK (0x00 0xCC / 0x00 0x33, or bare 0xCC / 0x33), the 0x55 0x55 sync
+// sequence and packets of the form <size> <checksum> <data...> where size
+// counts the whole packet and checksum is the sum of data.
+type tiBslFramer struct {
+	buf []byte
+}
+
+const (
+	bslAck  = 0xCC
+	bslNack = 0x33
+	bslSync = 0x55
+)
+
+func (f *tiBslFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for len(f.buf) > 0 {
+		n := 0
+		switch first := f.buf[0]; {
+		case first == 0x00:
+			if len(f.buf) < 2 {
+				return frames
+			}
+			if f.buf[1] == bslAck || f.buf[1] == bslNack {
+				n = 2
+			} else {
+				n = 1 // padding byte
+			}
+		case first == bslAck || first == bslNack:
+			n = 1
+		case first == bslSync:
+			if len(f.buf) < 2 {
+				return frames
+			}
+			if f.buf[1] == bslSync {
+				n = 2
+			}
+		}
+		if n == 0 {
+			size := int(f.buf[0])
+			if size < 3 {
+				n = 1
+			} else if len(f.buf) < size {
+				return frames
+			} else {
+				var sum byte
+				for _, v := range f.buf[2:size] {
+					sum += v
+				}
+				if sum == f.buf[1] {
+					n = size
+				} else {
+					n = 1
+				}
+			}
+		}
+		frames = append(frames, cloneBytes(f.buf[:n]))
+		f.buf = consume(f.buf, n)
+	}
+	return frames
+}
+
+func (f *tiBslFramer) Flush() []byte {
+	return flushBuffer(&f.buf)
+}
+
+func (f *tiBslFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// bslPacketFramer is the WebSocket-side TI BSL rule: packets of the form
+// 0x00 0xCC <len> <payload...> are held until complete, any other data
+// (including a bare 0x00 0xCC ACK) is passed through immediately.
+type bslPacketFramer struct {
+	buf []byte
+}
+
+func (f *bslPacketFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for len(f.buf) > 0 {
+		if len(f.buf) < 3 || f.buf[0] != 0x00 || f.buf[1] != bslAck {
+			frames = append(frames, cloneBytes(f.buf))
+			f.buf = f.buf[:0]
+			break
+		}
+		total := 3 + int(f.buf[2])
+		if len(f.buf) < total {
+			break
+		}
+		frames = append(frames, cloneBytes(f.buf[:total]))
+		f.buf = consume(f.buf, total)
+	}
+	return frames
+}
+
+func (f *bslPacketFramer) Flush() []byte {
+	return flushBuffer(&f.buf)
+}
+
+func (f *bslPacketFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// lengthPrefixFramer handles frames carrying a 16-bit big-endian payload length
+// followed by the payload. Frames are emitted with their prefix.
+type lengthPrefixFramer struct {
+	buf []byte
+}
+
+func (f *lengthPrefixFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for len(f.buf) >= 2 {
+		total := 2 + int(binary.BigEndian.Uint16(f.buf))
+		if len(f.buf) < total {
+			break
+		}
+		frames = append(frames, cloneBytes(f.buf[:total]))
+		f.buf = consume(f.buf, total)
+	}
+	return frames
+}
+
+func (f *lengthPrefixFramer) Flush() []byte {
+	return flushBuffer(&f.buf)
+}
+
+func (f *lengthPrefixFramer) Buffered() int {
+	return len(f.buf)
+}
+
+// flushBuffer returns a copy of *buf and empties it.
+func flushBuffer(buf *[]byte) []byte {
+	if len(*buf) == 0 {
+		return nil
+	}
+	out := cloneBytes(*buf)
+	*buf = (*buf)[:0]
+	return out
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFramers(t *testing.T) {
+	tests := []struct {
+		name   string
+		framer string
+		pushes [][]byte
+		want   [][]byte
+		rest   []byte
+	}{
+		{
+			name:   "hdlc collapses flags and re-adds both",
+			framer: "hdlc",
+			pushes: [][]byte{{0x7E, 0x7E, 0x01, 0x02}, {0x03, 0x7E, 0x04}},
+			want:   [][]byte{{0x7E, 0x01, 0x02, 0x03, 0x7E}},
+			rest:   []byte{0x7E, 0x04},
+		},
+		{
+			name:   "slip trailing flag only",
+			framer: "slip",
+			pushes: [][]byte{{0xC0, 0x01, 0xC0, 0x02, 0xC0}},
+			want:   [][]byte{{0x01, 0xC0}, {0x02, 0xC0}},
+		},
+		{
+			name:   "ash flag and cancel",
+			framer: "ash",
+			pushes: [][]byte{{0x7E, 0x01, 0x02, 0x7E, 0x03, 0x1A, 0x04}},
+			want:   [][]byte{{0x01, 0x02, 0x7E}, {0x03, 0x1A}},
+			rest:   []byte{0x04},
+		},
+		{
+			name:   "mt frame split across pushes with leading noise",
+			framer: "mt",
+			pushes: [][]byte{{0x55, 0xFE, 0x01, 0x21}, {0x01, 0x0A, 0x2B}},
+			want:   [][]byte{{0x55}, {0xFE, 0x01, 0x21, 0x01, 0x0A, 0x2B}},
+		},
+		{
+			name:   "mt bad fcs resyncs",
+			framer: "mt",
+			pushes: [][]byte{{0xFE, 0x00, 0x21, 0x01, 0x00}},
+			want:   [][]byte{{0xFE}, {0x00, 0x21, 0x01, 0x00}},
+		},
+		{
+			name:   "ti-bsl ack, sync and packet",
+			framer: "ti-bsl",
+			pushes: [][]byte{{0x00, 0xCC, 0x55, 0x55, 0x03, 0x20, 0x20}},
+			want:   [][]byte{{0x00, 0xCC}, {0x55, 0x55}, {0x03, 0x20, 0x20}},
+		},
+		{
+			name:   "ti-bsl waits for a full packet",
+			framer: "ti-bsl",
+			pushes: [][]byte{{0x05, 0x03, 0x01}},
+			rest:   []byte{0x05, 0x03, 0x01},
+		},
+		{
+			name:   "length-prefixed",
+			framer: "length-prefixed",
+			pushes: [][]byte{{0x00, 0x02, 0xAA}, {0xBB, 0x00, 0x01}},
+			want:   [][]byte{{0x00, 0x02, 0xAA, 0xBB}},
+			rest:   []byte{0x00, 0x01},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFramer(tt.framer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][]byte
+			for _, p := range tt.pushes {
+				got = append(got, f.Push(p)...)
+			}
+			if !equalChunks(got, tt.want) {
+				t.Errorf("frames = %x, want %x", got, tt.want)
+			}
+			if (f.Buffered() > 0) != (len(tt.rest) > 0) {
+				t.Errorf("Buffered() = %d with rest %x", f.Buffered(), tt.rest)
+			}
+			if rest := f.Flush(); !bytes.Equal(rest, tt.rest) {
+				t.Errorf("Flush() = %x, want %x", rest, tt.rest)
+			}
+			if f.Buffered() != 0 {
+				t.Errorf("Buffered() after Flush = %d", f.Buffered())
+			}
+		})
+	}
+}
+
+func TestDelimiterFramersAreBounded(t *testing.T) {
+	noise := bytes.Repeat([]byte{0x01}, MAX_FRAMER_BUFFER*3)
+	for _, name := range []string{"hdlc", "slip", "ash"} {
+		f, _ := newFramer(name)
+		total := 0
+		for _, chunk := range f.Push(noise) {
+			total += len(chunk)
+		}
+		if f.Buffered() >= MAX_FRAMER_BUFFER {
+			t.Errorf("%s: %d bytes buffered", name, f.Buffered())
+		}
+		if total+f.Buffered() < len(noise) {
+			t.Errorf("%s: lost bytes", name)
+		}
+	}
+}
+
+func TestNewReassembler(t *testing.T) {
+	f, err := newReassembler("ti-bsl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := f.Push([]byte{0x00, 0xCC, 0x02, 0x01})
+	if len(got) != 0 {
+		t.Fatalf("incomplete packet forwarded: %x", got)
+	}
+	got = f.Push([]byte{0x02, 0x40})
+	want := [][]byte{{0x00, 0xCC, 0x02, 0x01, 0x02}, {0x40}}
+	if !equalChunks(got, want) {
+		t.Errorf("frames = %x, want %x", got, want)
+	}
+	if _, err := newReassembler("bogus"); err == nil {
+		t.Error("unknown reassembler accepted")
+	}
+}
+
+func TestReadFramedFlushesStaleFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write([]byte{0x7E, 0x01, 0x02})
+	}()
+
+	f, _ := newFramer("hdlc")
+	buf := make([]byte, 64)
+	start := time.Now()
+	frames, err := readFramed(server, buf, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < REASSEMBLY_TIMEOUT {
+		t.Errorf("partial frame forwarded after %v", elapsed)
+	}
+	want := [][]byte{{0x7E, 0x01, 0x02}}
+	if !equalChunks(frames, want) {
+		t.Errorf("frames = %x, want %x", frames, want)
+	}
+}
+
+func equalChunks(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ifaceChoice is an interface the bridge uses (or skips) and why.
+type ifaceChoice struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// virtualIfacePrefixes name interfaces that are skipped automatically: mDNS
+// on them reaches containers, VMs or VPN peers instead of the LAN.
+var virtualIfacePrefixes = []struct {
+	prefix string
+	kind   string
+}{
+	{"docker", "container bridge"},
+	{"br-", "container bridge"},
+	{"podman", "container bridge"},
+	{"cni", "container bridge"},
+	{"hassio", "container bridge"},
+	{"lxcbr", "container bridge"},
+	{"lxdbr", "container bridge"},
+	{"veth", "container link"},
+	{"cali", "container link"},
+	{"flannel", "container overlay"},
+	{"virbr", "VM bridge"},
+	{"vmnet", "VM bridge"},
+	{"vboxnet", "VM host-only network"},
+	{"tun", "VPN tunnel"},
+	{"tap", "VPN tunnel"},
+	{"utun", "VPN tunnel"},
+	{"wg", "WireGuard tunnel"},
+	{"tailscale", "Tailscale tunnel"},
+	{"zt", "ZeroTier network"},
+	{"ppp", "point-to-point link"},
+}
+
+// virtualInterfaceKind returns what kind of virtual interface iface is, or
+// "" for a physical one.
+func virtualInterfaceKind(iface net.Interface) string {
+	name := strings.ToLower(iface.Name)
+	for _, v := range virtualIfacePrefixes {
+		if strings.HasPrefix(name, v.prefix) {
+			return v.kind
+		}
+	}
+	if iface.Flags&net.FlagPointToPoint != 0 {
+		return "point-to-point link"
+	}
+	return ""
+}
+
+// initInterfaces checks that the configured interfaces exist.
+func initInterfaces() error {
+	for _, name := range splitList(mdnsIfaces) {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return fmt.Errorf("-mdns-ifaces: unknown interface %q", name)
+		}
+	}
+	if advertiseIface != "" {
+		if _, err := net.InterfaceByName(advertiseIface); err != nil {
+			return fmt.Errorf("-advertise-iface: unknown interface %q", advertiseIface)
+		}
+	}
+	return nil
+}
+
+// selectMdnsInterfaces returns the interfaces used for mDNS browsing,
+// queries and the advertisement, and the skipped ones with the reason.
+func selectMdnsInterfaces() (used, skipped []ifaceChoice, ifaces []net.Interface) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, nil
+	}
+	configured := make(map[string]bool)
+	for _, name := range splitList(mdnsIfaces) {
+		configured[name] = true
+	}
+
+	var virtual []net.Interface
+	for _, iface := range all {
+		reason := ""
+		switch {
+		case iface.Flags&net.FlagUp == 0:
+			reason = "down"
+		case iface.Flags&net.FlagMulticast == 0:
+			reason = "no multicast"
+		case len(configured) > 0 && !configured[iface.Name]:
+			reason = "not in -mdns-ifaces"
+		case len(configured) > 0:
+			used = append(used, ifaceChoice{Name: iface.Name, Reason: "configured (-mdns-ifaces)"})
+			ifaces = append(ifaces, iface)
+			continue
+		case iface.Flags&net.FlagLoopback != 0:
+			reason = "loopback"
+		case virtualInterfaceKind(iface) != "":
+			virtual = append(virtual, iface)
+			continue
+		}
+		if reason != "" {
+			skipped = append(skipped, ifaceChoice{Name: iface.Name, Reason: reason})
+			continue
+		}
+		used = append(used, ifaceChoice{Name: iface.Name, Reason: "multicast capable"})
+		ifaces = append(ifaces, iface)
+	}
+
+	// e.g. a container with only a bridge network: better than nothing
+	useVirtual := len(ifaces) == 0
+	for _, iface := range virtual {
+		kind := virtualInterfaceKind(iface)
+		if useVirtual {
+			used = append(used, ifaceChoice{Name: iface.Name, Reason: kind + ", used as no physical interface is up"})
+			ifaces = append(ifaces, iface)
+		} else {
+			skipped = append(skipped, ifaceChoice{Name: iface.Name, Reason: kind})
+		}
+	}
+	return used, skipped, ifaces
+}
+
+// chooseAdvertiseAddr picks the IPv4 address announced for the bridge and its
+// serial ports when -advertise-host is not set.
+func chooseAdvertiseAddr() ifaceChoice {
+	note := ""
+	if advertiseIface != "" {
+		if iface, err := net.InterfaceByName(advertiseIface); err == nil {
+			if ip := interfaceIPv4(*iface); ip != "" {
+				return ifaceChoice{Name: iface.Name, Address: ip, Reason: "configured (-advertise-iface)"}
+			}
+		}
+		note = fmt.Sprintf(" (-advertise-iface %s has no IPv4 address)", advertiseIface)
+	}
+
+	_, _, mdnsList := selectMdnsInterfaces()
+	if len(splitList(mdnsIfaces)) > 0 {
+		for _, iface := range mdnsList {
+			if ip := interfaceIPv4(iface); ip != "" {
+				return ifaceChoice{Name: iface.Name, Address: ip, Reason: "first of -mdns-ifaces with an IPv4 address" + note}
+			}
+		}
+	}
+
+	// the interface the system routes LAN/internet traffic through; a UDP
+	// "connection" sends no packets
+	if conn, err := net.Dial("udp4", "192.0.2.1:9"); err == nil {
+		local := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		if iface := interfaceWithIP(local); iface != nil && virtualInterfaceKind(*iface) == "" {
+			return ifaceChoice{Name: iface.Name, Address: local.String(), Reason: "interface of the default route" + note}
+		}
+	}
+
+	var virtual *ifaceChoice
+	all, _ := net.Interfaces()
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ip := interfaceIPv4(iface)
+		if ip == "" {
+			continue
+		}
+		if kind := virtualInterfaceKind(iface); kind != "" {
+			if virtual == nil {
+				virtual = &ifaceChoice{Name: iface.Name, Address: ip, Reason: "first interface with an IPv4 address, a " + kind + note}
+			}
+			continue
+		}
+		return ifaceChoice{Name: iface.Name, Address: ip, Reason: "first physical interface with an IPv4 address" + note}
+	}
+	if virtual != nil {
+		return *virtual
+	}
+	return ifaceChoice{Name: "lo", Address: "127.0.0.1", Reason: "no interface with an IPv4 address" + note}
+}
+
+// interfaceIPv4 returns the first routable IPv4 address of iface.
+func interfaceIPv4(iface net.Interface) string {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		var ip net.IP
+		switch v := a.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		// skip loopback and link-local addresses (169.254.x.x)
+		if ip4 := ip.To4(); ip4 != nil && !ip4.IsLoopback() && !ip4.IsLinkLocalUnicast() {
+			return ip4.String()
+		}
+	}
+	return ""
+}
+
+func interfaceWithIP(ip net.IP) *net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i, iface := range all {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return &all[i]
+			}
+		}
+	}
+	return nil
+}
+
+// logInterfaceChoice logs the advertised host and the mDNS interfaces.
+func logInterfaceChoice() {
+	adv := advertiseChoice()
+	if adv.Name != "" {
+		log.Printf("[XZG-MT] advertise host %s on %s: %s\n", adv.Address, adv.Name, adv.Reason)
+	}
+	used, _, _ := selectMdnsInterfaces()
+	names := make([]string, 0, len(used))
+	for _, u := range used {
+		names = append(names, u.Name)
+	}
+	log.Printf("[mdns] interfaces: %s\n", strings.Join(names, ", "))
+}
+
+// advertiseChoice reports the advertised host and where it comes from.
+func advertiseChoice() ifaceChoice {
+	if advertiseHost != "" {
+		return ifaceChoice{Address: advertiseHost, Reason: "configured (-advertise-host)"}
+	}
+	return chooseAdvertiseAddr()
+}
+
+func handleVersion(c echo.Context) error {
+	used, skipped, _ := selectMdnsInterfaces()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"version":   VERSION,
+		"id":        bridgeID,
+		"name":      getBridgeInstanceName(),
+		"features":  getBridgeFeatures(),
+		"tls":       tlsEnabled,
+		"advertise": advertiseChoice(),
+		"mdns": map[string]interface{}{
+			"interfaces": used,
+			"skipped":    skipped,
+			"browsing":   mdnsBrowserInstance != nil,
+		},
+	})
+}
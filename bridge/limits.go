@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// Default session limits and request rates (0 disables a limit).
+const (
+	DEFAULT_MAX_SESSIONS            = 64
+	DEFAULT_MAX_SESSIONS_PER_IP     = 16
+	DEFAULT_MAX_SESSIONS_PER_TARGET = 8
+	DEFAULT_MAX_SESSIONS_PER_PORT   = 4
+	DEFAULT_MDNS_RATE               = 30  // /mdns requests per minute and client
+	DEFAULT_SC_RATE                 = 600 // /sc requests per minute and client
+)
+
+// sessionSlots counts reserved session slots; a slot is taken before a
+// session dials its target, so limits hold while connections are set up.
+var sessionSlots = struct {
+	sync.Mutex
+	total    int
+	byIP     map[string]int
+	byTarget map[string]int
+	byPort   map[string]int
+}{
+	byIP:     make(map[string]int),
+	byTarget: make(map[string]int),
+	byPort:   make(map[string]int),
+}
+
+// reserveSession takes a session slot for a client IP, a target (host:port)
+// and a serial port path; target and path may be empty. The returned release
+// function frees the slot.
+func reserveSession(ip, target, path string) (release func(), err error) {
+	sessionSlots.Lock()
+	defer sessionSlots.Unlock()
+
+	switch {
+	case maxSessions > 0 && sessionSlots.total >= maxSessions:
+		return nil, fmt.Errorf("too many sessions (limit %d)", maxSessions)
+	case maxSessionsPerIP > 0 && sessionSlots.byIP[ip] >= maxSessionsPerIP:
+		return nil, fmt.Errorf("too many sessions from %s (limit %d)", ip, maxSessionsPerIP)
+	case target != "" && maxSessionsPerTarget > 0 && sessionSlots.byTarget[target] >= maxSessionsPerTarget:
+		return nil, fmt.Errorf("too many sessions to %s (limit %d)", target, maxSessionsPerTarget)
+	case path != "" && maxSessionsPerPort > 0 && sessionSlots.byPort[path] >= maxSessionsPerPort:
+		return nil, fmt.Errorf("too many sessions on %s (limit %d)", path, maxSessionsPerPort)
+	}
+
+	sessionSlots.total++
+	sessionSlots.byIP[ip]++
+	if target != "" {
+		sessionSlots.byTarget[target]++
+	}
+	if path != "" {
+		sessionSlots.byPort[path]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sessionSlots.Lock()
+			defer sessionSlots.Unlock()
+			sessionSlots.total--
+			decrementSlot(sessionSlots.byIP, ip)
+			if target != "" {
+				decrementSlot(sessionSlots.byTarget, target)
+			}
+			if path != "" {
+				decrementSlot(sessionSlots.byPort, path)
+			}
+		})
+	}, nil
+}
+
+func decrementSlot(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+	} else {
+		counts[key]--
+	}
+}
+
+// bridgeConns tracks the bridge's own connections to its serial TCP servers
+// and relays, so the serial side of a /ws session is not limited, listed or
+// recorded a second time.
+var bridgeConns = struct {
+	sync.Mutex
+	dialing int             // dials in progress
+	addrs   map[string]bool // local addresses of established connections
+	changed chan struct{}   // closed when dialing or addrs change
+}{
+	addrs:   make(map[string]bool),
+	changed: make(chan struct{}),
+}
+
+// bridgeConn is a connection dialled by dialBridgeConn.
+type bridgeConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *bridgeConn) Close() error {
+	c.once.Do(func() {
+		bridgeConns.Lock()
+		delete(bridgeConns.addrs, c.LocalAddr().String())
+		bridgeConns.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// dialBridgeConn dials one of the bridge's own serial TCP servers or relays
+// and marks the connection as the bridge's.
+func dialBridgeConn(dial func() (net.Conn, error)) (net.Conn, error) {
+	bridgeConns.Lock()
+	bridgeConns.dialing++
+	bridgeConns.Unlock()
+
+	conn, err := dial()
+
+	bridgeConns.Lock()
+	bridgeConns.dialing--
+	if err == nil {
+		bridgeConns.addrs[conn.LocalAddr().String()] = true
+	}
+	close(bridgeConns.changed)
+	bridgeConns.changed = make(chan struct{})
+	bridgeConns.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &bridgeConn{Conn: conn}, nil
+}
+
+// isBridgeConn reports whether an accepted connection was dialled by the
+// bridge itself. The server may accept it before the dial returns, so while
+// a dial is in progress it waits up to timeout for the dial to finish.
+func isBridgeConn(remote net.Addr, timeout time.Duration) bool {
+	if tcp, ok := remote.(*net.TCPAddr); !ok || !tcp.IP.IsLoopback() {
+		return false
+	}
+	key := remote.String()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		bridgeConns.Lock()
+		own, dialing, changed := bridgeConns.addrs[key], bridgeConns.dialing, bridgeConns.changed
+		bridgeConns.Unlock()
+		if own || dialing == 0 {
+			return own
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// newIPExtractor returns how the client IP of a request is determined for
+// limits and logs: the connection's address, or with proxies (comma-separated
+// CIDRs) the X-Forwarded-For entry added by the last trusted proxy.
+func newIPExtractor(proxies string) (echo.IPExtractor, error) {
+	cidrs := splitList(proxies)
+	if len(cidrs) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// rateLimit returns a middleware allowing perMinute requests per minute and
+// client IP, answering 429 above that. perMinute <= 0 disables the limit.
+func rateLimit(perMinute int) echo.MiddlewareFunc {
+	if perMinute <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(float64(perMinute) / 60),
+			Burst:     perMinute,
+			ExpiresIn: 3 * time.Minute,
+		}),
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			c.Response().Header().Set("Retry-After", "60")
+			return c.JSON(http.StatusTooManyRequests, map[string]string{
+				"error": fmt.Sprintf("rate limit exceeded (%d requests per minute)", perMinute),
+			})
+		},
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReserveSession(t *testing.T) {
+	saved := []int{maxSessions, maxSessionsPerIP, maxSessionsPerTarget, maxSessionsPerPort}
+	t.Cleanup(func() {
+		maxSessions, maxSessionsPerIP, maxSessionsPerTarget, maxSessionsPerPort = saved[0], saved[1], saved[2], saved[3]
+	})
+	maxSessions, maxSessionsPerIP, maxSessionsPerTarget, maxSessionsPerPort = 4, 2, 2, 1
+
+	type reservation struct {
+		ip, target, path string
+		ok               bool
+	}
+	tests := []struct {
+		name  string
+		steps []reservation
+	}{
+		{"per port", []reservation{
+			{"10.0.0.1", "", "/dev/ttyUSB0", true},
+			{"10.0.0.2", "", "/dev/ttyUSB0", false},
+			{"10.0.0.2", "", "/dev/ttyUSB1", true},
+		}},
+		{"per ip", []reservation{
+			{"10.0.0.1", "", "", true},
+			{"10.0.0.1", "", "", true},
+			{"10.0.0.1", "", "", false},
+		}},
+		{"per target", []reservation{
+			{"10.0.0.1", "10.0.1.1:6638", "", true},
+			{"10.0.0.2", "10.0.1.1:6638", "", true},
+			{"10.0.0.3", "10.0.1.1:6638", "", false},
+			{"10.0.0.3", "10.0.1.2:6638", "", true},
+		}},
+		{"total", []reservation{
+			{"10.0.0.1", "", "", true},
+			{"10.0.0.2", "", "", true},
+			{"10.0.0.3", "", "", true},
+			{"10.0.0.4", "", "", true},
+			{"10.0.0.5", "", "", false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var releases []func()
+			for i, r := range tt.steps {
+				release, err := reserveSession(r.ip, r.target, r.path)
+				if (err == nil) != r.ok {
+					t.Errorf("step %d: reserveSession(%q, %q, %q) error = %v, want ok %v", i, r.ip, r.target, r.path, err, r.ok)
+				}
+				if release != nil {
+					releases = append(releases, release)
+				}
+			}
+			for _, release := range releases {
+				release()
+				release() // a second release is a no-op
+			}
+			sessionSlots.Lock()
+			defer sessionSlots.Unlock()
+			if sessionSlots.total != 0 || len(sessionSlots.byIP)+len(sessionSlots.byTarget)+len(sessionSlots.byPort) != 0 {
+				t.Errorf("slots left after release: total %d, ip %v, target %v, port %v", sessionSlots.total, sessionSlots.byIP, sessionSlots.byTarget, sessionSlots.byPort)
+			}
+		})
+	}
+}
+
+func TestNewIPExtractor(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		remote  string
+		xff     string
+		want    string
+	}{
+		{"no proxies ignores the header", "", "192.168.1.20:40000", "10.9.9.9", "192.168.1.20"},
+		{"trusted proxy", "172.30.32.0/24", "172.30.32.2:40000", "10.9.9.9", "10.9.9.9"},
+		{"spoofed chain", "172.30.32.0/24", "172.30.32.2:40000", "10.9.9.9, 192.168.1.20", "192.168.1.20"},
+		{"untrusted sender", "172.30.32.0/24", "192.168.1.20:40000", "10.9.9.9", "192.168.1.20"},
+		{"private ranges are not trusted implicitly", "172.30.32.0/24", "10.0.0.2:40000", "10.9.9.9", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extract, err := newIPExtractor(tt.proxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, _ := http.NewRequest(http.MethodGet, "http://bridge.lan:8765/sc", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-For", tt.xff)
+			if got := extract(r); got != tt.want {
+				t.Errorf("client IP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := newIPExtractor("172.30.32.0/33"); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+func TestIsBridgeConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	own, err := dialBridgeConn(func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-accepted
+	defer c.Close()
+	if !isBridgeConn(c.RemoteAddr(), time.Second) {
+		t.Error("bridge's own connection not recognised")
+	}
+	_ = own.Close()
+	if isBridgeConn(c.RemoteAddr(), time.Second) {
+		t.Error("closed connection still recognised")
+	}
+
+	other, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	c = <-accepted
+	defer c.Close()
+	if isBridgeConn(c.RemoteAddr(), time.Second) {
+		t.Error("other local client recognised as the bridge's")
+	}
+}
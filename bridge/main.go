@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -25,6 +27,57 @@ var (
 	wsPort        int
 	advertiseHost string
 	debugMode     bool
+	mdnsAdvertise bool
+	mdnsName      string
+
+	targetPolicy   string
+	allowCIDRs     string
+	allowPorts     string
+	allowTargets   string
+	allowedOrigins string
+
+	authToken   string
+	apiKeys     string
+	tcpAuthMode string
+	tcpTLSCert  string
+	tcpTLSKey   string
+	tcpClientCA string
+
+	tlsEnabled  bool
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsDir      string
+	httpPort    int
+
+	recordDir string
+
+	dialTimeoutMs int
+
+	shutdownTimeoutMs int
+	shutdownIdleMs    int
+	safeDTRState      string
+	safeRTSState      string
+
+	maxSessions          int
+	maxSessionsPerIP     int
+	maxSessionsPerTarget int
+	maxSessionsPerPort   int
+	mdnsRate             int
+	scRate               int
+	trustedProxies       string
+
+	mdnsTypes      string
+	mdnsIfaces     string
+	advertiseIface string
+
+	peerList      string
+	discoverPeers bool
+	peerMode      string
+	peerToken     string
+	peerCA        string
+	peerPins      string
+
+	profilesFile string
 )
 
 func main() {
@@ -32,6 +85,47 @@ func main() {
 	flag.IntVar(&wsPort, "port", DEFAULT_WS_PORT, "WebSocket server port")
 	flag.StringVar(&advertiseHost, "advertise-host", "", "Advertise host for mDNS")
 	flag.BoolVar(&debugMode, "debug", false, "Enable debug mode")
+	flag.BoolVar(&mdnsAdvertise, "mdns-advertise", true, "Advertise the bridge itself via mDNS")
+	flag.StringVar(&mdnsName, "mdns-name", "", "Instance name used for the mDNS advertisement")
+	flag.StringVar(&targetPolicy, "target-policy", DEFAULT_TARGET_POLICY, "Allowed /ws targets: any, or a comma-separated list of cidr, mdns, devices")
+	flag.StringVar(&allowCIDRs, "allow-cidrs", "", "Comma-separated CIDRs allowed by the cidr target policy")
+	flag.StringVar(&allowPorts, "allow-ports", "", "Comma-separated ports or ranges allowed by the cidr target policy (empty = all)")
+	flag.StringVar(&allowTargets, "allow-targets", "", "Comma-separated host:port targets allowed by the devices target policy")
+	flag.StringVar(&allowedOrigins, "allowed-origins", DEFAULT_ALLOWED_ORIGINS, "Comma-separated browser origins allowed to open WebSockets besides the bridge itself (* = all)")
+	flag.StringVar(&authToken, "auth-token", "", "Bearer token required for the HTTP API and WebSocket bridge")
+	flag.StringVar(&apiKeys, "api-keys", "", "Comma-separated API keys accepted in addition to the auth token")
+	flag.StringVar(&tcpAuthMode, "tcp-auth", TCP_AUTH_NONE, "Authentication for serial TCP servers: none, token or tls")
+	flag.StringVar(&tcpTLSCert, "tcp-tls-cert", "", "Certificate file for serial TCP servers (tcp-auth=tls)")
+	flag.StringVar(&tcpTLSKey, "tcp-tls-key", "", "Private key file for serial TCP servers (tcp-auth=tls)")
+	flag.StringVar(&tcpClientCA, "tcp-client-ca", "", "CA file used to verify client certificates (tcp-auth=tls)")
+	flag.BoolVar(&tlsEnabled, "tls", false, "Serve HTTPS/WSS on the main port")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "TLS certificate file (default: generated self-signed)")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "TLS private key file (default: generated self-signed)")
+	flag.StringVar(&tlsDir, "tls-dir", "", "Directory where the self-signed certificate is stored")
+	flag.IntVar(&httpPort, "http-port", 0, "Additional plain HTTP port when TLS is enabled (0 = disabled)")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory for session recordings (default: <config dir>/xzg-mt/recordings)")
+	flag.IntVar(&dialTimeoutMs, "dial-timeout", DEFAULT_DIAL_TIMEOUT_MS, "Default timeout in ms for connecting to /ws targets")
+	flag.IntVar(&shutdownTimeoutMs, "shutdown-timeout", DEFAULT_SHUTDOWN_TIMEOUT_MS, "How long in ms shutdown waits for busy sessions such as a firmware flash")
+	flag.IntVar(&shutdownIdleMs, "shutdown-idle", DEFAULT_SHUTDOWN_IDLE_MS, "Sessions without data for this many ms are closed at shutdown unless marked busy")
+	flag.StringVar(&safeDTRState, "safe-dtr", "", "DTR state set on open serial ports at shutdown: 0 or 1 (empty = keep)")
+	flag.StringVar(&safeRTSState, "safe-rts", "", "RTS state set on open serial ports at shutdown: 0 or 1 (empty = keep)")
+	flag.IntVar(&maxSessions, "max-sessions", DEFAULT_MAX_SESSIONS, "Maximum concurrent sessions in total (0 = unlimited)")
+	flag.IntVar(&maxSessionsPerIP, "max-sessions-per-ip", DEFAULT_MAX_SESSIONS_PER_IP, "Maximum concurrent sessions per client IP (0 = unlimited)")
+	flag.IntVar(&maxSessionsPerTarget, "max-sessions-per-target", DEFAULT_MAX_SESSIONS_PER_TARGET, "Maximum concurrent /ws sessions per target (0 = unlimited)")
+	flag.IntVar(&maxSessionsPerPort, "max-sessions-per-port", DEFAULT_MAX_SESSIONS_PER_PORT, "Maximum concurrent sessions per serial port (0 = unlimited)")
+	flag.IntVar(&mdnsRate, "mdns-rate", DEFAULT_MDNS_RATE, "Maximum /mdns requests per minute and client (0 = unlimited)")
+	flag.IntVar(&scRate, "sc-rate", DEFAULT_SC_RATE, "Maximum /sc requests per minute and client (0 = unlimited)")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose X-Forwarded-For is trusted")
+	flag.StringVar(&mdnsTypes, "mdns-types", DEFAULT_MDNS_TYPES, "Comma-separated mDNS service types browsed in the background")
+	flag.StringVar(&mdnsIfaces, "mdns-ifaces", "", "Comma-separated interfaces used for mDNS browsing and advertising (default: automatic)")
+	flag.StringVar(&advertiseIface, "advertise-iface", "", "Interface whose IPv4 address is advertised when -advertise-host is not set")
+	flag.StringVar(&profilesFile, "profiles", "", "JSON file with device profiles, checked before the built-in ones")
+	flag.StringVar(&peerList, "peers", "", "Comma-separated peer bridges (host[:port] or URL) whose serial ports are listed by /mdns")
+	flag.BoolVar(&discoverPeers, "discover-peers", false, "Also federate with peer bridges found via mDNS")
+	flag.StringVar(&peerMode, "peer-mode", PEER_MODE_DIRECT, "How clients reach serial ports of peers: direct or proxy")
+	flag.StringVar(&peerToken, "peer-token", "", "Bearer token sent to peer bridges (default: -auth-token, to -peers only)")
+	flag.StringVar(&peerCA, "peer-ca", "", "PEM file with CA or peer certificates trusted for HTTPS peers, in addition to the system roots")
+	flag.StringVar(&peerPins, "peer-cert-sha256", "", "Comma-separated SHA-256 fingerprints of trusted peer certificates (as shown by the peer's /cert)")
 	flag.Parse()
 
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
@@ -48,16 +142,190 @@ func main() {
 		debugMode = true
 
 	}
+	if adv := os.Getenv("MDNS_ADVERTISE"); adv != "" {
+		mdnsAdvertise = adv == "1" || adv == "true" || adv == "yes" || adv == "on"
+	}
+	if name := os.Getenv("MDNS_NAME"); name != "" {
+		mdnsName = name
+	}
+	if policy := os.Getenv("TARGET_POLICY"); policy != "" {
+		targetPolicy = policy
+	}
+	if cidrs := os.Getenv("ALLOW_CIDRS"); cidrs != "" {
+		allowCIDRs = cidrs
+	}
+	if ports := os.Getenv("ALLOW_PORTS"); ports != "" {
+		allowPorts = ports
+	}
+	if targets := os.Getenv("ALLOW_TARGETS"); targets != "" {
+		allowTargets = targets
+	}
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		allowedOrigins = origins
+	}
+	if token := os.Getenv("AUTH_TOKEN"); token != "" {
+		authToken = token
+	}
+	if keys := os.Getenv("API_KEYS"); keys != "" {
+		apiKeys = keys
+	}
+	if mode := os.Getenv("TCP_AUTH"); mode != "" {
+		tcpAuthMode = mode
+	}
+	if cert := os.Getenv("TCP_TLS_CERT"); cert != "" {
+		tcpTLSCert = cert
+	}
+	if key := os.Getenv("TCP_TLS_KEY"); key != "" {
+		tcpTLSKey = key
+	}
+	if ca := os.Getenv("TCP_CLIENT_CA"); ca != "" {
+		tcpClientCA = ca
+	}
+	if v := os.Getenv("TLS"); v == "1" || v == "true" || v == "yes" || v == "on" {
+		tlsEnabled = true
+	}
+	if cert := os.Getenv("TLS_CERT"); cert != "" {
+		tlsCertFile = cert
+	}
+	if key := os.Getenv("TLS_KEY"); key != "" {
+		tlsKeyFile = key
+	}
+	if dir := os.Getenv("TLS_DIR"); dir != "" {
+		tlsDir = dir
+	}
+	if port := os.Getenv("HTTP_PORT"); port != "" {
+		fmt.Sscanf(port, "%d", &httpPort)
+	}
+	if dir := os.Getenv("RECORD_DIR"); dir != "" {
+		recordDir = dir
+	}
+	if ms := os.Getenv("DIAL_TIMEOUT"); ms != "" {
+		fmt.Sscanf(ms, "%d", &dialTimeoutMs)
+	}
+	if dialTimeoutMs <= 0 {
+		dialTimeoutMs = DEFAULT_DIAL_TIMEOUT_MS
+	}
+	if ms := os.Getenv("SHUTDOWN_TIMEOUT"); ms != "" {
+		fmt.Sscanf(ms, "%d", &shutdownTimeoutMs)
+	}
+	if ms := os.Getenv("SHUTDOWN_IDLE"); ms != "" {
+		fmt.Sscanf(ms, "%d", &shutdownIdleMs)
+	}
+	if shutdownIdleMs < 0 {
+		shutdownIdleMs = DEFAULT_SHUTDOWN_IDLE_MS
+	}
+	if v := os.Getenv("SAFE_DTR"); v != "" {
+		safeDTRState = v
+	}
+	if v := os.Getenv("SAFE_RTS"); v != "" {
+		safeRTSState = v
+	}
+	if v := os.Getenv("MAX_SESSIONS"); v != "" {
+		fmt.Sscanf(v, "%d", &maxSessions)
+	}
+	if v := os.Getenv("MAX_SESSIONS_PER_IP"); v != "" {
+		fmt.Sscanf(v, "%d", &maxSessionsPerIP)
+	}
+	if v := os.Getenv("MAX_SESSIONS_PER_TARGET"); v != "" {
+		fmt.Sscanf(v, "%d", &maxSessionsPerTarget)
+	}
+	if v := os.Getenv("MAX_SESSIONS_PER_PORT"); v != "" {
+		fmt.Sscanf(v, "%d", &maxSessionsPerPort)
+	}
+	if v := os.Getenv("MDNS_RATE"); v != "" {
+		fmt.Sscanf(v, "%d", &mdnsRate)
+	}
+	if v := os.Getenv("SC_RATE"); v != "" {
+		fmt.Sscanf(v, "%d", &scRate)
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		trustedProxies = v
+	}
+	if v, ok := os.LookupEnv("MDNS_TYPES"); ok {
+		mdnsTypes = v
+	}
+	if v := os.Getenv("MDNS_IFACES"); v != "" {
+		mdnsIfaces = v
+	}
+	if v := os.Getenv("ADVERTISE_IFACE"); v != "" {
+		advertiseIface = v
+	}
+	if v := os.Getenv("PROFILES"); v != "" {
+		profilesFile = v
+	}
+	if v := os.Getenv("PEERS"); v != "" {
+		peerList = v
+	}
+	if v := os.Getenv("DISCOVER_PEERS"); v != "" {
+		discoverPeers = v == "1" || v == "true" || v == "yes" || v == "on"
+	}
+	if v := os.Getenv("PEER_MODE"); v != "" {
+		peerMode = v
+	}
+	if v := os.Getenv("PEER_TOKEN"); v != "" {
+		peerToken = v
+	}
+	if v := os.Getenv("PEER_CA"); v != "" {
+		peerCA = v
+	}
+	if v := os.Getenv("PEER_CERT_SHA256"); v != "" {
+		peerPins = v
+	}
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		tlsEnabled = true
+	}
+	if err := initTargetPolicy(); err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+	ipExtractor, err := newIPExtractor(trustedProxies)
+	if err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+	if err := initAuth(); err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+	if err := initInterfaces(); err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+	if err := initProfiles(profilesFile); err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+	if err := initSafeLines(); err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+	if tlsEnabled {
+		if err := initTLS(); err != nil {
+			log.Fatalf("[XZG-MT] %v\n", err)
+		}
+	}
 
 	log.Printf("[XZG-MT] Local Bridge Server v%s\n", VERSION)
-	log.Printf("[XZG-MT] access UI at http://%s:%d\n", getAdvertiseHost(), wsPort)
+	if tlsEnabled {
+		log.Printf("[XZG-MT] access UI at https://%s:%d\n", getAdvertiseHost(), wsPort)
+		if httpPort > 0 {
+			log.Printf("[XZG-MT] plain HTTP also at http://%s:%d\n", getAdvertiseHost(), httpPort)
+		}
+	} else {
+		log.Printf("[XZG-MT] access UI at http://%s:%d\n", getAdvertiseHost(), wsPort)
+	}
+
+	logInterfaceChoice()
 
 	if debugMode {
 		log.Println("[XZG-MT] debug mode enabled")
 	}
+	if policyRules[POLICY_ANY] {
+		log.Println("[XZG-MT] target policy any: /ws connects to every host and port")
+	} else {
+		log.Printf("[XZG-MT] target policy: %s\n", targetPolicy)
+	}
+	if isAuthEnabled() {
+		log.Printf("[XZG-MT] authentication enabled (%d keys), serial TCP auth: %s\n", len(apiKeyList), tcpAuthMode)
+	}
 	// Create Echo instance
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = ipExtractor
 
 	// Middleware
 	// if debugMode {
@@ -72,25 +340,53 @@ func main() {
 	// Start serial monitor
 	//go startSerialMonitor()
 
+	// Announce the bridge on the LAN
+	startBridgeAdvertiser(wsPort)
+
+	// Keep a cache of the devices on the LAN for /mdns
+	startMdnsBrowser(parseMdnsTypes(mdnsTypes))
+
+	// List the serial ports of peer bridges as well
+	if err := startFederation(splitList(peerList), discoverPeers, peerMode); err != nil {
+		log.Fatalf("[XZG-MT] %v\n", err)
+	}
+
 	// Start server
-	go func() {
-		if err := e.Start(fmt.Sprintf(":%d", wsPort)); err != nil {
-			log.Fatal(err)
+	if tlsEnabled {
+		e.TLSServer.Addr = fmt.Sprintf(":%d", wsPort)
+		e.TLSServer.TLSConfig = getBridgeTLSConfig()
+		go func() {
+			if err := e.StartServer(e.TLSServer); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		if httpPort > 0 {
+			go func() {
+				if err := e.Start(fmt.Sprintf(":%d", httpPort)); err != nil && err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}()
 		}
-	}()
+	} else {
+		go func() {
+			if err := e.Start(fmt.Sprintf(":%d", wsPort)); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	// a second signal terminates immediately
+	stop()
 
 	log.Println("[shutdown] graceful shutdown starting...")
 
 	// Stop serial monitor
 	//stopSerialMonitor()
 
-	// Close all serial servers
-	closeAllSerialServers()
+	shutdownBridge(e, time.Duration(shutdownTimeoutMs)*time.Millisecond, time.Duration(shutdownIdleMs)*time.Millisecond)
 
 	log.Println("[shutdown] done")
 }
@@ -103,46 +399,5 @@ func getAdvertiseHost() string {
 }
 
 func getPrimaryIPv4() string {
-	// Find first active non-loopback interface with an IPv4 address
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return "127.0.0.1"
-	}
-
-	for _, iface := range ifaces {
-		// skip interfaces that are down or loopback
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, a := range addrs {
-			var ip net.IP
-			switch v := a.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
-			}
-			if ip == nil || ip.IsLoopback() {
-				continue
-			}
-			ip4 := ip.To4()
-			if ip4 == nil {
-				continue // not IPv4
-			}
-			// skip link-local addresses (169.254.x.x)
-			if ip4.IsLinkLocalUnicast() {
-				continue
-			}
-			return ip4.String()
-		}
-	}
-
-	// fallback
-	return "127.0.0.1"
+	return chooseAdvertiseAddr().Address
 }
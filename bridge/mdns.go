@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"sort"
 	"strings"
 	"sync"
@@ -25,6 +26,21 @@ type ServiceInfo struct {
 	Protocol string            `json:"protocol"`
 	FQDN     string            `json:"fqdn"`
 	TXT      map[string]string `json:"txt"`
+	// Set for mDNS services; Host is the first of Addresses
+	Addresses []string `json:"addresses,omitempty"`
+	Hostname  string   `json:"hostname,omitempty"`
+	// Interface is the interface the answer arrived on for the background
+	// browser; otherwise, and when unknown, the local interface whose subnet
+	// contains Host
+	Interface string `json:"interface,omitempty"`
+	// Set for services from the background browser cache
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	TTL       int        `json:"ttl,omitempty"` // record TTL in seconds
+	// Set for serial ports of peer bridges
+	Bridge *ServiceBridge `json:"bridge,omitempty"`
+	// Set when a device profile matches
+	Profile *ServiceProfile `json:"profile,omitempty"`
 }
 
 func parseServiceType(full string) *ServiceType {
@@ -66,6 +82,75 @@ func isLocalSerialToken(s string) bool {
 	return false
 }
 
+// sortAddrs orders addresses best first for dialling: addresses on a subnet
+// of the bridge, then other IPv4, global IPv6 and link-local IPv6 addresses.
+func sortAddrs(addrs []net.IPAddr) []net.IPAddr {
+	subnets := localSubnets()
+	rank := func(a net.IPAddr) int {
+		r := 3
+		switch {
+		case a.IP.To4() != nil:
+			r = 2
+		case a.IP.IsLinkLocalUnicast():
+			return 4
+		}
+		for _, n := range subnets {
+			if n.Contains(a.IP) {
+				return r - 2
+			}
+		}
+		return r
+	}
+	sorted := append([]net.IPAddr(nil), addrs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i]) < rank(sorted[j])
+	})
+	return sorted
+}
+
+// localSubnets returns the routable subnets of the bridge's interfaces.
+func localSubnets() []*net.IPNet {
+	var subnets []*net.IPNet
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			subnets = append(subnets, n)
+		}
+	}
+	return subnets
+}
+
+// interfaceForIP returns the name of the interface whose subnet contains ip.
+func interfaceForIP(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLinkLocalUnicast() && n.Contains(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+func addrStrings(addrs []net.IPAddr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	return out
+}
+
 func scanMdns(typeList []ServiceType, timeoutMs int) []ServiceInfo {
 
 	var results []ServiceInfo
@@ -110,7 +195,7 @@ func scanMdns(typeList []ServiceType, timeoutMs int) []ServiceInfo {
 			serviceName := fmt.Sprintf("_%s._%s", st.Type, st.Protocol)
 
 			// Create a new resolver for each service
-			resolver, err := zeroconf.NewResolver(nil)
+			resolver, err := zeroconf.NewResolver(zeroconf.SelectIfaces(multicastInterfaces()))
 			if err != nil {
 				log.Printf("[mdns] failed to create resolver for %s: %v\n", serviceName, err)
 				return
@@ -148,12 +233,11 @@ func scanMdns(typeList []ServiceType, timeoutMs int) []ServiceInfo {
 
 					mu.Lock()
 
-					// Determine host
+					// Determine host: the best of all announced addresses
+					addrs := sortAddrs(ipAddrs(append(entry.AddrIPv4, entry.AddrIPv6...)))
 					host := ""
-					if len(entry.AddrIPv4) > 0 {
-						host = entry.AddrIPv4[0].String()
-					} else if len(entry.AddrIPv6) > 0 {
-						host = entry.AddrIPv6[0].String()
+					if len(addrs) > 0 {
+						host = addrs[0].String()
 					} else if entry.HostName != "" {
 						host = entry.HostName
 					} else {
@@ -164,26 +248,38 @@ func scanMdns(typeList []ServiceType, timeoutMs int) []ServiceInfo {
 
 					// Avoid duplication
 					if _, exists := foundDevices[key]; !exists {
-						// Parse TXT records
-						txtMap := make(map[string]string)
-						for _, txt := range entry.Text {
-							parts := strings.SplitN(txt, "=", 2)
-							if len(parts) == 2 {
-								txtMap[parts[0]] = parts[1]
-							}
-						}
+						txtMap := parseTxtRecords(entry.Text)
 
 						service := ServiceInfo{
-							Name:     entry.Instance,
-							Host:     host,
-							Port:     entry.Port,
-							Type:     st.Type,
-							Protocol: st.Protocol,
-							FQDN:     entry.Instance,
-							TXT:      txtMap,
+							Name:      entry.Instance,
+							Host:      host,
+							Port:      entry.Port,
+							Type:      st.Type,
+							Protocol:  st.Protocol,
+							FQDN:      strings.TrimSuffix(entry.ServiceInstanceName(), "."),
+							TXT:       txtMap,
+							Addresses: addrStrings(addrs),
+							Hostname:  strings.TrimSuffix(entry.HostName, "."),
+							TTL:       int(entry.TTL),
+						}
+						if len(addrs) > 0 {
+							// zeroconf doesn't report the interface; use the one on the address's subnet
+							service.Interface = interfaceForIP(addrs[0].IP)
 						}
 
 						foundDevices[key] = service
+						rememberDiscoveredTarget(host, entry.Port)
+						if entry.HostName != "" {
+							rememberDiscoveredTarget(strings.TrimSuffix(entry.HostName, "."), entry.Port)
+							// lets /ws dial the host name without another query
+							var routable []net.IPAddr
+							for _, a := range addrs {
+								if !a.IP.IsLinkLocalUnicast() {
+									routable = append(routable, a)
+								}
+							}
+							cacheMdnsHost(entry.HostName, routable, time.Duration(entry.TTL)*time.Second)
+						}
 						log.Printf("[mdns] found: %s on %s:%d (%s, %s)\n", st.Type, host, entry.Port, txtMap["board"], txtMap["serial_number"])
 					}
 
@@ -277,8 +373,10 @@ func listLocalSerialAsServices() []ServiceInfo {
 			TXT: map[string]string{
 				"board":         details.Manufacturer,
 				"serial_number": details.SerialNumber,
+				"product":       details.Product,
 				"vendor_id":     details.VendorID,
 				"product_id":    details.ProductID,
+				"tcp_auth":      tcpAuthMode,
 			},
 		}
 		services = append(services, service)
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSortAddrs(t *testing.T) {
+	ip := func(s string) net.IPAddr { return net.IPAddr{IP: net.ParseIP(s)} }
+	// documentation ranges, never on a local subnet
+	in := []net.IPAddr{ip("fe80::1"), ip("2001:db8::1"), ip("203.0.113.5"), ip("2001:db8::2"), ip("198.51.100.7")}
+	want := []string{"203.0.113.5", "198.51.100.7", "2001:db8::1", "2001:db8::2", "fe80::1"}
+
+	// an address on one of the bridge's subnets comes first
+	for _, n := range localSubnets() {
+		if v4 := n.IP.To4(); v4 != nil {
+			local := net.IPAddr{IP: n.IP}
+			in = append(in, local)
+			want = append([]string{local.String()}, want...)
+			break
+		}
+	}
+
+	got := sortAddrs(in)
+	if len(got) != len(want) {
+		t.Fatalf("sortAddrs returned %d addresses, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("sortAddrs = %v, want %v", got, want)
+			break
+		}
+	}
+	if in[0].String() != "fe80::1" {
+		t.Error("sortAddrs modified its input")
+	}
+}
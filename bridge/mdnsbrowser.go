@@ -0,0 +1,703 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DEFAULT_MDNS_TYPES are the service types browsed from startup: the ones
+// the web UI asks for.
+const DEFAULT_MDNS_TYPES = "_zig_star_gw._tcp,_zigstar_gw._tcp,_uzg-01._tcp,_tubeszb._tcp,_xzg._tcp"
+
+// Timing of the background mDNS browser.
+const (
+	MDNS_QUERY_INTERVAL = 60 * time.Second
+	MDNS_EXPIRE_CHECK   = 5 * time.Second
+	MDNS_REQUERY_HOLD   = time.Second       // minimum time between queries for the same name
+	MDNS_MIN_TTL        = 150 * time.Second // a service survives one unanswered query
+	MDNS_MAX_TTL        = 10 * time.Minute  // a service that vanished without goodbye is dropped after this
+)
+
+// Types added by /mdns requests besides -mdns-types: at most
+// MDNS_MAX_REQUESTED_TYPES are browsed, the least recently requested one is
+// dropped for a new one, and a type not requested for
+// MDNS_REQUESTED_TYPE_TTL is no longer browsed.
+const (
+	MDNS_MAX_REQUESTED_TYPES = 16
+	MDNS_REQUESTED_TYPE_TTL  = 10 * time.Minute
+)
+
+// mdnsInstance is a discovered service instance.
+type mdnsInstance struct {
+	st        ServiceType
+	name      string // instance label, e.g. "XZG-ABCD"
+	fqdn      string // full instance name, e.g. "XZG-ABCD._xzg._tcp.local"
+	iface     string // interface the last answer arrived on
+	host      string // target host name from the SRV record
+	port      int
+	txt       map[string]string
+	ttl       time.Duration
+	firstSeen time.Time
+	lastSeen  time.Time
+	reported  *ServiceInfo // what subscribers last saw
+}
+
+// mdnsHostAddrs holds the addresses announced for a host name.
+type mdnsHostAddrs struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// mdnsBrowser keeps listening to mDNS traffic and queries the browsed service
+// types periodically, so /mdns can answer from its cache.
+type mdnsBrowser struct {
+	mu        sync.Mutex
+	types     map[string]ServiceType // service name ("_xzg._tcp.local.") -> type
+	requested map[string]time.Time   // types added by requests -> last request
+	instances map[string]*mdnsInstance
+	hosts     map[string]*mdnsHostAddrs
+	asked     map[string]time.Time
+
+	v4     *ipv4.PacketConn
+	v6     *ipv6.PacketConn
+	ifaces []net.Interface
+
+	subscribers map[chan mdnsEvent]bool
+}
+
+// Kinds of mdnsEvent.
+const (
+	MDNS_EVENT_FOUND  = "found"
+	MDNS_EVENT_UPDATE = "update"
+	MDNS_EVENT_REMOVE = "remove"
+)
+
+// mdnsEvent is a change of a cached service, delivered to subscribers.
+type mdnsEvent struct {
+	Kind    string
+	Service ServiceInfo
+	Reason  string // why a service was removed: goodbye or expired
+}
+
+var mdnsBrowserInstance *mdnsBrowser
+
+// parseMdnsTypes parses a comma-separated list of service types.
+func parseMdnsTypes(list string) []ServiceType {
+	var types []ServiceType
+	for _, t := range strings.Split(list, ",") {
+		if st := parseServiceType(strings.TrimSpace(t)); st != nil && st.Protocol != "serial" {
+			types = append(types, *st)
+		}
+	}
+	return types
+}
+
+func mdnsServiceName(st ServiceType) string {
+	return fmt.Sprintf("_%s._%s.local.", st.Type, st.Protocol)
+}
+
+// startMdnsBrowser joins the mDNS groups and starts browsing types. Without
+// the browser /mdns falls back to one-shot scans.
+func startMdnsBrowser(types []ServiceType) {
+	b := &mdnsBrowser{
+		types:     make(map[string]ServiceType),
+		requested: make(map[string]time.Time),
+		instances: make(map[string]*mdnsInstance),
+		hosts:     make(map[string]*mdnsHostAddrs),
+		asked:     make(map[string]time.Time),
+		ifaces:    multicastInterfaces(),
+
+		subscribers: make(map[chan mdnsEvent]bool),
+	}
+	if conn, err := net.ListenMulticastUDP("udp4", nil, mdnsIPv4Group); err == nil {
+		b.v4 = ipv4.NewPacketConn(conn)
+		_ = b.v4.SetControlMessage(ipv4.FlagInterface, true)
+		for i := range b.ifaces {
+			_ = b.v4.JoinGroup(&b.ifaces[i], mdnsIPv4Group)
+		}
+	} else if debugMode {
+		log.Printf("[mdns] browser: IPv4 unavailable: %v\n", err)
+	}
+	if conn, err := net.ListenMulticastUDP("udp6", nil, mdnsIPv6Group); err == nil {
+		b.v6 = ipv6.NewPacketConn(conn)
+		_ = b.v6.SetControlMessage(ipv6.FlagInterface, true)
+		for i := range b.ifaces {
+			_ = b.v6.JoinGroup(&b.ifaces[i], mdnsIPv6Group)
+		}
+	} else if debugMode {
+		log.Printf("[mdns] browser: IPv6 unavailable: %v\n", err)
+	}
+	if b.v4 == nil && b.v6 == nil {
+		log.Printf("[mdns] browser disabled: cannot listen on port 5353\n")
+		return
+	}
+	for _, st := range types {
+		b.types[mdnsServiceName(st)] = st
+	}
+	mdnsBrowserInstance = b
+
+	if b.v4 != nil {
+		go b.receive(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, src, err := b.v4.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, src, err
+			}
+			return n, cm.IfIndex, src, err
+		})
+	}
+	if b.v6 != nil {
+		go b.receive(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, src, err := b.v6.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, src, err
+			}
+			return n, cm.IfIndex, src, err
+		})
+	}
+	go b.run()
+	log.Printf("[mdns] browsing %d service types in the background\n", len(types))
+}
+
+// run queries the browsed types periodically and expires stale entries
+// until the bridge shuts down.
+func (b *mdnsBrowser) run() {
+	b.queryTypes(nil)
+	queryTicker := time.NewTicker(MDNS_QUERY_INTERVAL)
+	expireTicker := time.NewTicker(MDNS_EXPIRE_CHECK)
+	defer queryTicker.Stop()
+	defer expireTicker.Stop()
+	for {
+		select {
+		case <-queryTicker.C:
+			b.queryTypes(nil)
+		case <-expireTicker.C:
+			b.expire()
+		case <-bridgeCtx.Done():
+			if b.v4 != nil {
+				_ = b.v4.Close()
+			}
+			if b.v6 != nil {
+				_ = b.v6.Close()
+			}
+			return
+		}
+	}
+}
+
+// addTypes starts browsing types for as long as the bridge runs and reports
+// whether any were not browsed yet.
+func (b *mdnsBrowser) addTypes(types []ServiceType) bool {
+	b.mu.Lock()
+	var added []ServiceType
+	for _, st := range types {
+		name := mdnsServiceName(st)
+		if _, ok := b.types[name]; !ok {
+			b.types[name] = st
+			added = append(added, st)
+		}
+		delete(b.requested, name)
+	}
+	b.mu.Unlock()
+	if len(added) > 0 {
+		b.queryTypes(added)
+	}
+	return len(added) > 0
+}
+
+// requestTypes starts browsing the types a client asked for and reports
+// whether any were not browsed yet. Unlike addTypes they are bounded and
+// expire when no longer requested.
+func (b *mdnsBrowser) requestTypes(types []ServiceType) bool {
+	now := time.Now()
+	b.mu.Lock()
+	var added []ServiceType
+	for _, st := range types {
+		name := mdnsServiceName(st)
+		if _, ok := b.types[name]; ok {
+			if _, ok := b.requested[name]; ok {
+				b.requested[name] = now
+			}
+			continue
+		}
+		if len(b.requested) >= MDNS_MAX_REQUESTED_TYPES {
+			oldest := ""
+			for n, t := range b.requested {
+				if oldest == "" || t.Before(b.requested[oldest]) {
+					oldest = n
+				}
+			}
+			b.dropType(oldest, "type dropped")
+		}
+		b.types[name] = st
+		b.requested[name] = now
+		added = append(added, st)
+	}
+	b.mu.Unlock()
+	if len(added) > 0 {
+		b.queryTypes(added)
+	}
+	return len(added) > 0
+}
+
+// dropType stops browsing a requested type and removes its services; b.mu
+// must be held.
+func (b *mdnsBrowser) dropType(name, why string) {
+	delete(b.types, name)
+	delete(b.requested, name)
+	for key, inst := range b.instances {
+		if mdnsServiceName(inst.st) == name {
+			b.removeInstance(key, why)
+		}
+	}
+	if debugMode {
+		log.Printf("[mdns] stopped browsing %s (%s)\n", name, why)
+	}
+}
+
+// queryTypes sends a PTR query for types (nil = all browsed types).
+func (b *mdnsBrowser) queryTypes(types []ServiceType) {
+	var names []string
+	b.mu.Lock()
+	if types == nil {
+		for name := range b.types {
+			names = append(names, name)
+		}
+	} else {
+		for _, st := range types {
+			names = append(names, mdnsServiceName(st))
+		}
+	}
+	b.mu.Unlock()
+	questions := make([]dns.Question, 0, len(names))
+	for _, name := range names {
+		questions = append(questions, dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	}
+	b.send(questions)
+}
+
+// send multicasts a query with questions on every interface.
+func (b *mdnsBrowser) send(questions []dns.Question) {
+	if len(questions) == 0 {
+		return
+	}
+	msg := new(dns.Msg)
+	msg.Question = questions
+	packet, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	for i := range b.ifaces {
+		if b.v4 != nil {
+			_, _ = b.v4.WriteTo(packet, &ipv4.ControlMessage{IfIndex: b.ifaces[i].Index}, mdnsIPv4Group)
+		}
+		if b.v6 != nil {
+			_, _ = b.v6.WriteTo(packet, &ipv6.ControlMessage{IfIndex: b.ifaces[i].Index}, mdnsIPv6Group)
+		}
+	}
+}
+
+func (b *mdnsBrowser) receive(read func([]byte) (int, int, net.Addr, error)) {
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, _, err := read(buf)
+		if err != nil {
+			if bridgeCtx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !b.onInterface(ifIndex) {
+			continue
+		}
+		var msg dns.Msg
+		if msg.Unpack(buf[:n]) != nil || !msg.Response {
+			continue
+		}
+		b.handleResponse(&msg, ifIndex)
+	}
+}
+
+// onInterface reports whether a packet arrived on one of the mDNS interfaces
+// (0 = unknown, accepted).
+func (b *mdnsBrowser) onInterface(ifIndex int) bool {
+	if ifIndex == 0 {
+		return true
+	}
+	for _, iface := range b.ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// handleResponse updates the cache from a response or announcement and asks
+// for records still missing.
+func (b *mdnsBrowser) handleResponse(msg *dns.Msg, ifIndex int) {
+	now := time.Now()
+	records := append(msg.Answer, msg.Extra...)
+	var zone string
+	if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+		zone = iface.Name
+	}
+
+	b.mu.Lock()
+	// host addresses first, so instances in the same packet resolve at once
+	fresh := make(map[string][]net.IPAddr)
+	changedHosts := make(map[string]bool)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		switch r := rr.(type) {
+		case *dns.A:
+			if r.Hdr.Ttl == 0 {
+				b.removeHostAddr(name, r.A)
+				changedHosts[name] = true
+				continue
+			}
+			fresh[name] = append(fresh[name], net.IPAddr{IP: r.A})
+		case *dns.AAAA:
+			if r.Hdr.Ttl == 0 {
+				b.removeHostAddr(name, r.AAAA)
+				changedHosts[name] = true
+				continue
+			}
+			a := net.IPAddr{IP: r.AAAA}
+			if r.AAAA.IsLinkLocalUnicast() {
+				a.Zone = zone
+			}
+			fresh[name] = append(fresh[name], a)
+		}
+	}
+	for name, addrs := range fresh {
+		h, ok := b.hosts[name]
+		if !ok {
+			h = &mdnsHostAddrs{}
+			b.hosts[name] = h
+		}
+		// an announcement of one address family replaces only that family
+		var hasV4, hasV6 bool
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				hasV4 = true
+			} else {
+				hasV6 = true
+			}
+		}
+		for _, a := range h.addrs {
+			if isV4 := a.IP.To4() != nil; (isV4 && !hasV4) || (!isV4 && !hasV6) {
+				addrs = append(addrs, a)
+			}
+		}
+		h.addrs = addrs
+		h.expires = now.Add(MDNS_MAX_TTL)
+		changedHosts[name] = true
+	}
+
+	touched := make(map[string]bool)
+	for key, inst := range b.instances {
+		if changedHosts[inst.host] {
+			touched[key] = true
+		}
+	}
+	for _, rr := range records {
+		hdr := rr.Header()
+		switch r := rr.(type) {
+		case *dns.PTR:
+			st, ok := b.types[strings.ToLower(hdr.Name)]
+			if !ok {
+				continue
+			}
+			key := strings.ToLower(r.Ptr)
+			if hdr.Ttl == 0 {
+				b.removeInstance(key, "goodbye")
+				continue
+			}
+			b.touchInstance(key, r.Ptr, st, now, hdr.Ttl, zone)
+			touched[key] = true
+		case *dns.SRV:
+			key := strings.ToLower(hdr.Name)
+			inst, ok := b.instances[key]
+			if !ok {
+				continue
+			}
+			if hdr.Ttl == 0 {
+				b.removeInstance(key, "goodbye")
+				continue
+			}
+			inst.host = strings.ToLower(r.Target)
+			inst.port = int(r.Port)
+			inst.lastSeen = now
+			if zone != "" {
+				inst.iface = zone
+			}
+			touched[key] = true
+		case *dns.TXT:
+			key := strings.ToLower(hdr.Name)
+			if inst, ok := b.instances[key]; ok && hdr.Ttl > 0 {
+				inst.txt = parseTxtRecords(r.Txt)
+				inst.lastSeen = now
+				touched[key] = true
+			}
+		}
+	}
+
+	// ask for what the responder left out
+	var questions []dns.Question
+	for key := range touched {
+		inst, ok := b.instances[key]
+		if !ok {
+			// removed by a goodbye later in the packet
+			continue
+		}
+		if inst.host == "" {
+			questions = b.ask(questions, key, dns.TypeSRV, dns.TypeTXT)
+		} else if _, ok := b.hosts[inst.host]; !ok {
+			questions = b.ask(questions, inst.host, dns.TypeA, dns.TypeAAAA)
+		} else if info, ok := b.serviceInfo(inst); ok {
+			rememberDiscoveredTarget(info.Host, info.Port)
+			rememberDiscoveredTarget(strings.TrimSuffix(inst.host, "."), info.Port)
+			cacheMdnsHost(inst.host, b.hosts[inst.host].addrs, inst.ttl)
+			b.report(inst, info)
+		}
+	}
+	b.mu.Unlock()
+	b.send(questions)
+}
+
+// ask adds questions for name unless it was asked for very recently.
+func (b *mdnsBrowser) ask(questions []dns.Question, name string, qtypes ...uint16) []dns.Question {
+	if time.Since(b.asked[name]) < MDNS_REQUERY_HOLD {
+		return questions
+	}
+	b.asked[name] = time.Now()
+	for _, qt := range qtypes {
+		questions = append(questions, dns.Question{Name: name, Qtype: qt, Qclass: dns.ClassINET})
+	}
+	return questions
+}
+
+func (b *mdnsBrowser) touchInstance(key, fqdn string, st ServiceType, now time.Time, ttl uint32, zone string) {
+	inst, ok := b.instances[key]
+	if !ok {
+		name := strings.TrimSuffix(fqdn, "."+mdnsServiceName(st))
+		inst = &mdnsInstance{st: st, name: unescapeDnsLabel(name), fqdn: strings.TrimSuffix(fqdn, "."), firstSeen: now}
+		b.instances[key] = inst
+	}
+	if zone != "" {
+		inst.iface = zone
+	}
+	inst.lastSeen = now
+	inst.ttl = time.Duration(ttl) * time.Second
+}
+
+func (b *mdnsBrowser) removeInstance(key, why string) {
+	inst, ok := b.instances[key]
+	if !ok {
+		return
+	}
+	delete(b.instances, key)
+	if debugMode {
+		log.Printf("[mdns] removed %s (%s)\n", inst.name, why)
+	}
+	if inst.reported != nil {
+		b.publish(mdnsEvent{Kind: MDNS_EVENT_REMOVE, Service: *inst.reported, Reason: why})
+	}
+}
+
+// report tells subscribers about a new or changed resolved instance; b.mu
+// must be held.
+func (b *mdnsBrowser) report(inst *mdnsInstance, info ServiceInfo) {
+	switch {
+	case inst.reported == nil:
+		b.publish(mdnsEvent{Kind: MDNS_EVENT_FOUND, Service: info})
+	case serviceSignature(*inst.reported) != serviceSignature(info):
+		b.publish(mdnsEvent{Kind: MDNS_EVENT_UPDATE, Service: info})
+	default:
+		return
+	}
+	inst.reported = &info
+}
+
+// serviceSignature covers the fields whose change is an update (not lastSeen).
+func serviceSignature(info ServiceInfo) string {
+	return fmt.Sprintf("%s|%d|%v|%v", info.Host, info.Port, info.Addresses, info.TXT)
+}
+
+// publish delivers an event to all subscribers without blocking; b.mu must be held.
+func (b *mdnsBrowser) publish(ev mdnsEvent) {
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			if debugMode {
+				log.Printf("[mdns] subscriber too slow, dropped %s event\n", ev.Kind)
+			}
+		}
+	}
+}
+
+// subscribe returns a channel receiving service events until cancel is called.
+func (b *mdnsBrowser) subscribe() (<-chan mdnsEvent, func()) {
+	ch := make(chan mdnsEvent, 64)
+	b.mu.Lock()
+	b.subscribers[ch] = true
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+func (b *mdnsBrowser) removeHostAddr(host string, ip net.IP) {
+	h, ok := b.hosts[host]
+	if !ok {
+		return
+	}
+	kept := h.addrs[:0]
+	for _, a := range h.addrs {
+		if !a.IP.Equal(ip) {
+			kept = append(kept, a)
+		}
+	}
+	h.addrs = kept
+}
+
+// expire drops services and addresses that outlived their TTL.
+func (b *mdnsBrowser) expire() {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, inst := range b.instances {
+		if now.After(inst.lastSeen.Add(clampMdnsTTL(inst.ttl))) {
+			b.removeInstance(key, "expired")
+		}
+	}
+	for name, h := range b.hosts {
+		if now.After(h.expires) {
+			delete(b.hosts, name)
+		}
+	}
+	for name, t := range b.asked {
+		if now.Sub(t) > MDNS_REQUERY_HOLD {
+			delete(b.asked, name)
+		}
+	}
+	for name, t := range b.requested {
+		if now.Sub(t) > MDNS_REQUESTED_TYPE_TTL {
+			b.dropType(name, "type expired")
+		}
+	}
+}
+
+func clampMdnsTTL(ttl time.Duration) time.Duration {
+	if ttl < MDNS_MIN_TTL {
+		return MDNS_MIN_TTL
+	}
+	if ttl > MDNS_MAX_TTL {
+		return MDNS_MAX_TTL
+	}
+	return ttl
+}
+
+// serviceInfo converts a resolved instance; b.mu must be held.
+func (b *mdnsBrowser) serviceInfo(inst *mdnsInstance) (ServiceInfo, bool) {
+	if inst.host == "" {
+		return ServiceInfo{}, false
+	}
+	firstSeen, lastSeen := inst.firstSeen, inst.lastSeen
+	info := ServiceInfo{
+		Name:      inst.name,
+		Host:      strings.TrimSuffix(inst.host, "."),
+		Port:      inst.port,
+		Type:      inst.st.Type,
+		Protocol:  inst.st.Protocol,
+		FQDN:      inst.fqdn,
+		TXT:       inst.txt,
+		Hostname:  strings.TrimSuffix(inst.host, "."),
+		Interface: inst.iface,
+		FirstSeen: &firstSeen,
+		LastSeen:  &lastSeen,
+		TTL:       int(inst.ttl.Seconds()),
+	}
+	if h, ok := b.hosts[inst.host]; ok && len(h.addrs) > 0 {
+		addrs := sortAddrs(h.addrs)
+		info.Host = addrs[0].String()
+		info.Addresses = addrStrings(addrs)
+		if info.Interface == "" {
+			info.Interface = interfaceForIP(addrs[0].IP)
+		}
+	}
+	return info, true
+}
+
+// services returns the cached services of types, sorted like scanMdns.
+func (b *mdnsBrowser) services(types []ServiceType) []ServiceInfo {
+	wanted := make(map[string]bool)
+	for _, st := range types {
+		wanted[st.Type+"."+st.Protocol] = true
+	}
+	var results []ServiceInfo
+	b.mu.Lock()
+	for _, inst := range b.instances {
+		if !wanted[inst.st.Type+"."+inst.st.Protocol] {
+			continue
+		}
+		if info, ok := b.serviceInfo(inst); ok {
+			results = append(results, info)
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		if results[i].Host != results[j].Host {
+			return results[i].Host < results[j].Host
+		}
+		return results[i].Port < results[j].Port
+	})
+	return results
+}
+
+func parseTxtRecords(txt []string) map[string]string {
+	txtMap := make(map[string]string)
+	for _, t := range txt {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) == 2 {
+			txtMap[parts[0]] = parts[1]
+		}
+	}
+	return txtMap
+}
+
+// unescapeDnsLabel turns "My\ Device" back into "My Device".
+func unescapeDnsLabel(label string) string {
+	var sb strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] == '\\' && i+1 < len(label) {
+			i++
+			if i+2 < len(label) && isDigit(label[i]) && isDigit(label[i+1]) && isDigit(label[i+2]) {
+				sb.WriteByte(byte((label[i]-'0')*100 + (label[i+1]-'0')*10 + (label[i+2] - '0')))
+				i += 2
+				continue
+			}
+		}
+		sb.WriteByte(label[i])
+	}
+	return sb.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
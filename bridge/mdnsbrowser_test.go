@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestMdnsBrowser(types ...ServiceType) *mdnsBrowser {
+	b := &mdnsBrowser{
+		types:       make(map[string]ServiceType),
+		requested:   make(map[string]time.Time),
+		instances:   make(map[string]*mdnsInstance),
+		hosts:       make(map[string]*mdnsHostAddrs),
+		asked:       make(map[string]time.Time),
+		subscribers: make(map[chan mdnsEvent]bool),
+	}
+	for _, st := range types {
+		b.types[mdnsServiceName(st)] = st
+	}
+	return b
+}
+
+func TestRequestTypesIsBounded(t *testing.T) {
+	configured := ServiceType{Type: "xzg", Protocol: "tcp"}
+	b := newTestMdnsBrowser(configured)
+
+	if b.requestTypes([]ServiceType{configured}) {
+		t.Error("configured type reported as added")
+	}
+	for i := 0; i < MDNS_MAX_REQUESTED_TYPES+4; i++ {
+		st := ServiceType{Type: fmt.Sprintf("t%d", i), Protocol: "tcp"}
+		if !b.requestTypes([]ServiceType{st}) {
+			t.Fatalf("%s not added", st.Type)
+		}
+		b.requested[mdnsServiceName(st)] = time.Now().Add(time.Duration(i) * time.Millisecond)
+	}
+	if len(b.requested) != MDNS_MAX_REQUESTED_TYPES {
+		t.Errorf("%d requested types, want %d", len(b.requested), MDNS_MAX_REQUESTED_TYPES)
+	}
+	if len(b.types) != MDNS_MAX_REQUESTED_TYPES+1 {
+		t.Errorf("%d browsed types, want %d", len(b.types), MDNS_MAX_REQUESTED_TYPES+1)
+	}
+	if _, ok := b.types["_t0._tcp.local."]; ok {
+		t.Error("least recently requested type still browsed")
+	}
+	if _, ok := b.types[mdnsServiceName(configured)]; !ok {
+		t.Error("configured type dropped")
+	}
+}
+
+func TestExpireDropsUnusedRequestedTypes(t *testing.T) {
+	b := newTestMdnsBrowser()
+	old := ServiceType{Type: "old", Protocol: "tcp"}
+	fresh := ServiceType{Type: "fresh", Protocol: "tcp"}
+	b.requestTypes([]ServiceType{old, fresh})
+	b.requested[mdnsServiceName(old)] = time.Now().Add(-MDNS_REQUESTED_TYPE_TTL - time.Second)
+	b.instances["a"] = &mdnsInstance{st: old, name: "a", lastSeen: time.Now(), ttl: MDNS_MAX_TTL}
+	b.instances["b"] = &mdnsInstance{st: fresh, name: "b", lastSeen: time.Now(), ttl: MDNS_MAX_TTL}
+
+	b.expire()
+
+	if _, ok := b.types[mdnsServiceName(old)]; ok {
+		t.Error("expired type still browsed")
+	}
+	if _, ok := b.instances["a"]; ok {
+		t.Error("service of the expired type kept")
+	}
+	if _, ok := b.types[mdnsServiceName(fresh)]; !ok {
+		t.Error("recently requested type dropped")
+	}
+	if _, ok := b.instances["b"]; !ok {
+		t.Error("service of a browsed type dropped")
+	}
+}
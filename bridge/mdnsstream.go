@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// mdnsRemoval is the data of a "remove" event.
+type mdnsRemoval struct {
+	ServiceInfo
+	Reason string `json:"reason"`
+}
+
+// mdnsStreamSummary is the data of the final "done" event.
+type mdnsStreamSummary struct {
+	Found      int   `json:"found"`
+	Updated    int   `json:"updated"`
+	Removed    int   `json:"removed"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// handleMdnsStream streams discovery as server-sent events: cached and local
+// serial services first, then every service as soon as it resolves, updates
+// and removals, and a "done" summary after timeout ms.
+func handleMdnsStream(c echo.Context) error {
+	types, wantsLocalSerial, timeout := parseMdnsRequest(c)
+	started := time.Now()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	var summary mdnsStreamSummary
+	sent := make(map[string]string) // service key -> signature
+	send := func(event string, data interface{}) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+	// found or update, depending on what this client has already seen
+	sendService := func(info ServiceInfo) error {
+		classifyService(&info)
+		key := mdnsServiceKey(info)
+		sig := serviceSignature(info)
+		prev, seen := sent[key]
+		if seen && prev == sig {
+			return nil
+		}
+		sent[key] = sig
+		if seen {
+			summary.Updated++
+			return send(MDNS_EVENT_UPDATE, info)
+		}
+		summary.Found++
+		return send(MDNS_EVENT_FOUND, info)
+	}
+
+	if wantsLocalSerial {
+		scanAndSyncSerialPorts()
+		locals := append(listLocalSerialAsServices(), listReplaysAsServices()...)
+		if f := federationInstance; f != nil && c.QueryParam("peers") != "0" {
+			locals = append(locals, f.services()...)
+		}
+		for _, info := range locals {
+			if err := sendService(info); err != nil {
+				return nil
+			}
+		}
+	}
+
+	b := mdnsBrowserInstance
+	if b == nil {
+		// no background browser: stream the result of a one-shot scan
+		if len(types) > 0 {
+			for _, info := range scanMdns(types, timeout) {
+				if err := sendService(info); err != nil {
+					return nil
+				}
+			}
+		}
+		summary.DurationMs = time.Since(started).Milliseconds()
+		_ = send("done", summary)
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, st := range types {
+		wanted[st.Type+"."+st.Protocol] = true
+	}
+	events, cancel := b.subscribe()
+	defer cancel()
+	if len(types) > 0 {
+		for _, info := range b.services(types) {
+			if err := sendService(info); err != nil {
+				return nil
+			}
+		}
+		if !b.requestTypes(types) {
+			b.queryTypes(types)
+		}
+	}
+
+	deadline := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer deadline.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if !wanted[ev.Service.Type+"."+ev.Service.Protocol] {
+				continue
+			}
+			var err error
+			if ev.Kind == MDNS_EVENT_REMOVE {
+				key := mdnsServiceKey(ev.Service)
+				if _, seen := sent[key]; !seen {
+					continue
+				}
+				delete(sent, key)
+				summary.Removed++
+				classifyService(&ev.Service)
+				err = send(MDNS_EVENT_REMOVE, mdnsRemoval{ServiceInfo: ev.Service, Reason: ev.Reason})
+			} else {
+				err = sendService(ev.Service)
+			}
+			if err != nil {
+				return nil
+			}
+		case <-deadline.C:
+			summary.DurationMs = time.Since(started).Milliseconds()
+			_ = send("done", summary)
+			return nil
+		case <-c.Request().Context().Done():
+			return nil
+		case <-bridgeCtx.Done():
+			return nil
+		}
+	}
+}
+
+// mdnsServiceKey identifies a service across events; serial ports of peer
+// bridges may share a name with local ones.
+func mdnsServiceKey(info ServiceInfo) string {
+	key := info.Type + "." + info.Protocol + "|" + info.Name
+	if info.Bridge != nil {
+		key += "|" + info.Bridge.URL
+	}
+	return key
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.bug.st/serial"
+)
+
+// Frame types of the multiplexed /ws protocol (mux=1). Every binary message
+// starts with one type byte followed by the payload.
+const (
+	MUX_DATA    = 0x00 // raw bytes to/from the target
+	MUX_CONTROL = 0x01 // client -> bridge: JSON control request
+	MUX_STATUS  = 0x02 // bridge -> client: JSON status (ack, modem lines, errors)
+	MUX_LOG     = 0x03 // bridge -> client: UTF-8 log line
+)
+
+// Limits for control requests. A request's delays and breaks add up to at
+// most MUX_MAX_SEQUENCE.
+const (
+	MUX_MAX_STEPS    = 64
+	MUX_MAX_DELAY    = 10 * time.Second
+	MUX_MAX_SEQUENCE = 30 * time.Second
+)
+
+// MUX_QUEUE_SIZE is how many client frames wait while a control sequence runs;
+// the WebSocket keeps being read (and pongs handled) until the queue is full.
+const MUX_QUEUE_SIZE = 16
+
+// MODEM_POLL_INTERVAL is how often modem input lines are checked for changes.
+const MODEM_POLL_INTERVAL = 100 * time.Millisecond
+
+// muxControl is a control request. The fields of a step are applied in the
+// order dtr/rts, baud, break, delay; Sequence runs its steps in order. Busy
+// marks the session as busy (e.g. flashing) so shutdown waits for it.
+type muxControl struct {
+	ID       int          `json:"id,omitempty"`
+	Busy     *bool        `json:"busy,omitempty"`
+	DTR      *bool        `json:"dtr,omitempty"`
+	RTS      *bool        `json:"rts,omitempty"`
+	Baud     int          `json:"baud,omitempty"`
+	Break    int          `json:"break,omitempty"` // break duration in ms
+	Delay    int          `json:"delay,omitempty"` // pause after the step in ms
+	Sequence []muxControl `json:"sequence,omitempty"`
+}
+
+// muxStatus is sent in MUX_STATUS frames.
+type muxStatus struct {
+	Type  string       `json:"type"` // ack, error, modem
+	ID    int          `json:"id,omitempty"`
+	Error string       `json:"error,omitempty"`
+	State *SerialState `json:"state,omitempty"`
+	CTS   *bool        `json:"cts,omitempty"`
+	DSR   *bool        `json:"dsr,omitempty"`
+	RI    *bool        `json:"ri,omitempty"`
+	DCD   *bool        `json:"dcd,omitempty"`
+}
+
+// muxConn writes typed frames to the WebSocket.
+type muxConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (m *muxConn) send(frameType byte, payload []byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	msg := make([]byte, 0, len(payload)+1)
+	msg = append(msg, frameType)
+	msg = append(msg, payload...)
+	_ = m.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	err := m.ws.WriteMessage(websocket.BinaryMessage, msg)
+	_ = m.ws.SetWriteDeadline(time.Time{})
+	return err
+}
+
+func (m *muxConn) status(st muxStatus) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return m.send(MUX_STATUS, data)
+}
+
+func (m *muxConn) logf(format string, args ...interface{}) {
+	_ = m.send(MUX_LOG, []byte(fmt.Sprintf(format, args...)))
+}
+
+// muxBackend is the target side of a multiplexed session.
+type muxBackend interface {
+	// Write sends client data to the target
+	Write(data []byte) error
+	// Control applies a control step and returns the resulting line state
+	Control(step muxControl) (SerialState, error)
+	// Run forwards target data to the client until the target fails or Close is called
+	Run(m *muxConn, session *Session, framer Framer) error
+	Close()
+}
+
+// handleWebSocketMux runs a /ws session with the multiplexed protocol. For the
+// bridge's own serial ports the port is used directly, so data and control
+// requests are applied in exactly the order they were sent.
+func handleWebSocketMux(ws *websocket.Conn, target string, dialTarget string, targetPort int, opts wsOptions) {
+	defer ws.Close()
+	m := &muxConn{ws: ws}
+
+	var backend muxBackend
+	var serialPath string
+	if path := getSerialPathFromTcpPort(targetPort); opts.LocalSerial && path != "" {
+		b, err := newSerialMuxBackend(path, opts.Pacing)
+		if err != nil {
+			log.Printf("[websocket] mux: failed to open %s: %v\n", path, err)
+			_ = m.status(muxStatus{Type: "error", Error: err.Error()})
+			closeWebSocket(ws, target, CLOSE_SERIAL_BUSY, fmt.Sprintf("serial port %s unavailable: %v", path, err))
+			return
+		}
+		backend = b
+		serialPath = path
+		m.logf("connected to %s at %d baud", path, getSerialPortState(path).BaudRate)
+	} else {
+		conn, err := dialTcpTarget(dialTarget, opts.LocalSerial, opts.DialTimeout)
+		if err != nil {
+			_ = m.status(muxStatus{Type: "error", Error: err.Error()})
+			code, reason := classifyDialError(err)
+			closeWebSocket(ws, target, code, reason)
+			return
+		}
+		backend = &tcpMuxBackend{conn: conn, pacing: opts.Pacing, readBuffer: opts.Tuning.ReadBuffer}
+		m.logf("connected to %s", target)
+	}
+	defer backend.Close()
+	if opts.Tuning.Explicit {
+		if data, err := json.Marshal(opts.Tuning.report()); err == nil {
+			_ = m.send(MUX_STATUS, data)
+		}
+	}
+
+	session := registerSession(SESSION_WS, opts.ClientAddr, target, serialPath, func(code int, reason string) {
+		closeWebSocket(ws, target, code, reason)
+	})
+	defer unregisterSession(session)
+	if opts.Record {
+		session.startRecording()
+	}
+	log.Printf("[websocket] mux session to %s\n", target)
+
+	ws.SetReadLimit(4 * 1024 * 1024)
+	ws.SetReadDeadline(time.Now().Add(60 * time.Second))
+	ws.SetPongHandler(func(string) error {
+		_ = ws.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+	stopPing := startWebSocketPing(ws)
+	defer stopPing()
+
+	errCh := make(chan error, 3)
+	done := make(chan struct{})
+	defer close(done)
+
+	// target -> ws
+	framer, _ := newFramer(opts.Framer)
+	go func() {
+		errCh <- backend.Run(m, session, framer)
+	}()
+
+	// ws reader; frames are queued so control sequences don't block it
+	queue := make(chan []byte, MUX_QUEUE_SIZE)
+	go func() {
+		for {
+			mt, msg, err := ws.ReadMessage()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if mt != websocket.BinaryMessage || len(msg) == 0 {
+				continue
+			}
+			select {
+			case queue <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// ws -> target, strictly in message order
+	go func() {
+		for {
+			var msg []byte
+			select {
+			case msg = <-queue:
+			case <-done:
+				return
+			}
+			switch msg[0] {
+			case MUX_DATA:
+				data := msg[1:]
+				if err := backend.Write(data); err != nil {
+					errCh <- err
+					return
+				}
+				session.fromClient(data)
+			case MUX_CONTROL:
+				var req muxControl
+				if err := json.Unmarshal(msg[1:], &req); err != nil {
+					_ = m.status(muxStatus{Type: "error", Error: "invalid control request: " + err.Error()})
+					continue
+				}
+				if req.Busy != nil {
+					session.setBusy(*req.Busy)
+				}
+				state, err := applyMuxControl(backend, req, serialPath, done)
+				if err != nil {
+					_ = m.status(muxStatus{Type: "error", ID: req.ID, Error: err.Error()})
+					continue
+				}
+				_ = m.status(muxStatus{Type: "ack", ID: req.ID, State: &state})
+			default:
+				_ = m.status(muxStatus{Type: "error", Error: fmt.Sprintf("unknown frame type 0x%02x", msg[0])})
+			}
+		}
+	}()
+
+	err := <-errCh
+	if ce, ok := err.(*websocket.CloseError); ok {
+		log.Printf("[websocket] remote close code=%d text=%s\n", ce.Code, ce.Text)
+	} else if err != nil {
+		_ = m.status(muxStatus{Type: "error", Error: err.Error()})
+	}
+	log.Printf("[websocket] mux session closing for %s\n", target)
+}
+
+// validateMuxControl checks the steps of a control request before any of
+// them is applied.
+func validateMuxControl(steps []muxControl) error {
+	if len(steps) > MUX_MAX_STEPS {
+		return fmt.Errorf("too many sequence steps (max %d)", MUX_MAX_STEPS)
+	}
+	var total time.Duration
+	for _, step := range steps {
+		if step.Baud > 0 && !isValidBaudRate(step.Baud) {
+			return fmt.Errorf("invalid baud rate %d", step.Baud)
+		}
+		delay := time.Duration(step.Delay) * time.Millisecond
+		brk := time.Duration(step.Break) * time.Millisecond
+		if step.Delay < 0 || step.Break < 0 || delay > MUX_MAX_DELAY || brk > MUX_MAX_DELAY {
+			return fmt.Errorf("delay and break must be between 0 and %v", MUX_MAX_DELAY)
+		}
+		total += delay + brk
+	}
+	if total > MUX_MAX_SEQUENCE {
+		return fmt.Errorf("delays and breaks must not add up to more than %v", MUX_MAX_SEQUENCE)
+	}
+	return nil
+}
+
+// applyMuxControl runs a control request and its sequence steps; it stops
+// early when done is closed.
+func applyMuxControl(backend muxBackend, req muxControl, serialPath string, done <-chan struct{}) (SerialState, error) {
+	steps := append([]muxControl{req}, req.Sequence...)
+	if err := validateMuxControl(steps); err != nil {
+		return SerialState{}, err
+	}
+	var state SerialState
+	for _, step := range steps {
+		var err error
+		if state, err = backend.Control(step); err != nil {
+			return state, err
+		}
+		if serialPath != "" && (step.DTR != nil || step.RTS != nil || step.Baud > 0) {
+			recordSerialControl(serialPath, step.DTR, step.RTS, step.Baud)
+		}
+		if step.Delay > 0 {
+			select {
+			case <-time.After(time.Duration(step.Delay) * time.Millisecond):
+			case <-done:
+				return state, fmt.Errorf("session closed")
+			}
+		}
+	}
+	return state, nil
+}
+
+// serialMuxBackend talks to one of the bridge's serial ports directly.
+type serialMuxBackend struct {
+	path   string
+	port   serial.Port
+	pacing WritePacing
+	echo   *echoCanceler
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSerialMuxBackend(path string, pacing WritePacing) (*serialMuxBackend, error) {
+	// ports are opened with SERIAL_READ_TIMEOUT, so the reader notices Close
+	// without waiting for data
+	port, _, err := acquireSerialPort(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &serialMuxBackend{path: path, port: port, pacing: pacing, done: make(chan struct{})}
+	if getSerialPortOptions(path).EchoCancel {
+		b.echo = newEchoCanceler(getSerialEchoStats(path))
+	}
+	return b, nil
+}
+
+func (b *serialMuxBackend) Write(data []byte) error {
+	if b.echo != nil {
+		b.echo.Transmitted(data)
+	}
+	_, err := writeSerialPaced(b.port, data, b.pacing)
+	return err
+}
+
+func (b *serialMuxBackend) Control(step muxControl) (SerialState, error) {
+	state := getSerialPortState(b.path)
+	if step.DTR != nil {
+		if err := b.port.SetDTR(*step.DTR); err != nil {
+			return state, err
+		}
+		state.DTR = *step.DTR
+	}
+	if step.RTS != nil {
+		if err := b.port.SetRTS(*step.RTS); err != nil {
+			return state, err
+		}
+		state.RTS = *step.RTS
+	}
+	if step.Baud > 0 && step.Baud != state.BaudRate {
+		// change the rate in place, so other clients of the port stay connected
+		mode := &serial.Mode{
+			BaudRate: step.Baud,
+			DataBits: 8,
+			Parity:   serial.NoParity,
+			StopBits: serial.OneStopBit,
+		}
+		if err := b.port.SetMode(mode); err != nil {
+			return state, err
+		}
+		state.BaudRate = step.Baud
+	}
+	setSerialPortState(b.path, state)
+	if step.Break > 0 {
+		if err := b.port.Break(time.Duration(step.Break) * time.Millisecond); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+func (b *serialMuxBackend) Run(m *muxConn, session *Session, framer Framer) error {
+	// modem input lines, reported on change
+	go func() {
+		var last *serial.ModemStatusBits
+		ticker := time.NewTicker(MODEM_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+			}
+			bits, err := b.port.GetModemStatusBits()
+			if err != nil {
+				if debugMode {
+					log.Printf("[websocket] mux: modem status of %s unavailable: %v\n", b.path, err)
+				}
+				return
+			}
+			if last == nil || *bits != *last {
+				last = bits
+				_ = m.status(muxStatus{Type: "modem", CTS: &bits.CTS, DSR: &bits.DSR, RI: &bits.RI, DCD: &bits.DCD})
+			}
+		}
+	}()
+
+	lastData := time.Now()
+	for {
+		select {
+		case <-b.done:
+			return nil
+		default:
+		}
+		data, err := readSerial(b.port, 1024)
+		if err != nil {
+			return err
+		}
+		var chunks [][]byte
+		if len(data) == 0 {
+			rest := flushStale(framer, lastData)
+			if len(rest) == 0 {
+				continue
+			}
+			chunks = [][]byte{rest}
+		} else {
+			lastData = time.Now()
+			if b.echo != nil {
+				if data = b.echo.Filter(data); len(data) == 0 {
+					continue
+				}
+			}
+			chunks = [][]byte{data}
+			if framer != nil {
+				chunks = framer.Push(data)
+			}
+		}
+		for _, chunk := range chunks {
+			if err := m.send(MUX_DATA, chunk); err != nil {
+				return err
+			}
+			session.toClient(chunk)
+		}
+	}
+}
+
+func (b *serialMuxBackend) Close() {
+	b.once.Do(func() {
+		close(b.done)
+		releaseSerialPort(b.path)
+	})
+}
+
+// tcpMuxBackend forwards data to a remote TCP target; it has no control lines.
+type tcpMuxBackend struct {
+	conn       net.Conn
+	pacing     WritePacing
+	readBuffer int
+}
+
+func (b *tcpMuxBackend) Write(data []byte) error {
+	var err error
+	if b.pacing.enabled() {
+		_, err = (&pacedWriter{w: b.conn, pacing: b.pacing}).Write(data)
+	} else {
+		_, err = b.conn.Write(data)
+	}
+	return err
+}
+
+func (b *tcpMuxBackend) Control(step muxControl) (SerialState, error) {
+	if step.DTR != nil || step.RTS != nil || step.Baud > 0 || step.Break > 0 {
+		return SerialState{}, fmt.Errorf("control lines require a local serial target")
+	}
+	return SerialState{}, nil
+}
+
+func (b *tcpMuxBackend) Run(m *muxConn, session *Session, framer Framer) error {
+	buf := make([]byte, b.readBuffer)
+	for {
+		var chunks [][]byte
+		var err error
+		if framer != nil {
+			chunks, err = readFramed(b.conn, buf, framer)
+		} else {
+			var n int
+			n, err = b.conn.Read(buf)
+			if n > 0 {
+				chunks = [][]byte{buf[:n]}
+			}
+		}
+		for _, chunk := range chunks {
+			if werr := m.send(MUX_DATA, chunk); werr != nil {
+				return werr
+			}
+			session.toClient(chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *tcpMuxBackend) Close() {
+	_ = b.conn.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// WritePacing slows writes down for targets that drop bytes at full speed
+// (e.g. Telink uart2swire, CC2530 via CCLoader).
+type WritePacing struct {
+	ChunkSize  int           // max bytes per write, 0 = unlimited
+	ChunkDelay time.Duration // pause after each chunk
+	WaitDrain  bool          // wait until the output buffer is empty after each chunk
+}
+
+// MAX_CHUNK_DELAY_MS bounds the pause after each chunk: a port's pacing
+// applies to all its clients, so one request must not stall the port.
+const MAX_CHUNK_DELAY_MS = 100
+
+func (p WritePacing) enabled() bool {
+	return p.ChunkSize > 0 || p.ChunkDelay > 0 || p.WaitDrain
+}
+
+// writePaced writes data in chunks according to pacing. drain is called after
+// each chunk when WaitDrain is set and may be nil if the target can't drain.
+func writePaced(write func([]byte) (int, error), drain func() error, data []byte, pacing WritePacing) (int, error) {
+	if !pacing.enabled() {
+		return write(data)
+	}
+
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if pacing.ChunkSize > 0 && n > pacing.ChunkSize {
+			n = pacing.ChunkSize
+		}
+		m, err := write(data[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if pacing.WaitDrain && drain != nil {
+			if err := drain(); err != nil && debugMode {
+				log.Printf("[pacing] drain error: %v\n", err)
+			}
+		}
+		if pacing.ChunkDelay > 0 {
+			time.Sleep(pacing.ChunkDelay)
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// pacedWriter applies WritePacing to an io.Writer (used for TCP targets).
+type pacedWriter struct {
+	w      io.Writer
+	pacing WritePacing
+}
+
+func (pw *pacedWriter) Write(b []byte) (int, error) {
+	return writePaced(pw.w.Write, nil, b, pw.pacing)
+}
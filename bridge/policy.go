@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target policy rules for /ws and /connect. A target is allowed when any of
+// the configured rules allows it; "any" disables the checks.
+const (
+	POLICY_ANY     = "any"     // no restrictions (explicit opt-in)
+	POLICY_CIDR    = "cidr"    // target IP within allowed CIDRs and port within allowed ports
+	POLICY_MDNS    = "mdns"    // only host:port pairs discovered via /mdns
+	POLICY_DEVICES = "devices" // only explicitly configured host:port pairs
+)
+
+// DEFAULT_TARGET_POLICY only allows targets the bridge found itself or that
+// were configured.
+const DEFAULT_TARGET_POLICY = POLICY_MDNS + "," + POLICY_DEVICES
+
+// DEFAULT_ALLOWED_ORIGINS is the hosted web UI; same-origin requests are
+// always allowed.
+const DEFAULT_ALLOWED_ORIGINS = "https://mt.xyzroe.cc"
+
+// DISCOVERED_TARGET_TTL is how long an mDNS-discovered target stays allowed.
+const DISCOVERED_TARGET_TTL = 30 * time.Minute
+
+type portRange struct {
+	From int
+	To   int
+}
+
+var (
+	policyRules    map[string]bool
+	allowedNets    []*net.IPNet
+	allowedPorts   []portRange
+	allowedDevices map[string]bool
+	originList     []string
+
+	discoveredTargets   = make(map[string]time.Time)
+	discoveredTargetsMu sync.Mutex
+)
+
+// initTargetPolicy parses the policy flags. It must be called once at startup.
+func initTargetPolicy() error {
+	policyRules = make(map[string]bool)
+	for _, rule := range splitList(targetPolicy) {
+		rule = strings.ToLower(rule)
+		switch rule {
+		case POLICY_ANY, POLICY_CIDR, POLICY_MDNS, POLICY_DEVICES:
+			policyRules[rule] = true
+		default:
+			return fmt.Errorf("unknown target policy %q (supported: any, cidr, mdns, devices)", rule)
+		}
+	}
+	if len(policyRules) == 0 {
+		return fmt.Errorf("empty target policy (use %q to allow every target)", POLICY_ANY)
+	}
+
+	allowedNets = nil
+	for _, cidr := range splitList(allowCIDRs) {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		allowedNets = append(allowedNets, ipNet)
+	}
+
+	allowedPorts = nil
+	for _, p := range splitList(allowPorts) {
+		from, to, found := strings.Cut(p, "-")
+		lo, err := strconv.Atoi(from)
+		hi := lo
+		if err == nil && found {
+			hi, err = strconv.Atoi(to)
+		}
+		if err != nil || lo < 1 || hi > 65535 || lo > hi {
+			return fmt.Errorf("invalid port or port range %q", p)
+		}
+		allowedPorts = append(allowedPorts, portRange{From: lo, To: hi})
+	}
+
+	allowedDevices = make(map[string]bool)
+	for _, d := range splitList(allowTargets) {
+		host, port, err := net.SplitHostPort(d)
+		if err != nil {
+			return fmt.Errorf("invalid target %q, expected host:port", d)
+		}
+		allowedDevices[net.JoinHostPort(strings.ToLower(host), port)] = true
+	}
+
+	originList = splitList(allowedOrigins)
+	return nil
+}
+
+// splitList splits a comma-separated option, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// rememberDiscoveredTarget marks host:port as found via mDNS for the "mdns" rule.
+func rememberDiscoveredTarget(host string, port int) {
+	discoveredTargetsMu.Lock()
+	defer discoveredTargetsMu.Unlock()
+	discoveredTargets[net.JoinHostPort(strings.ToLower(host), strconv.Itoa(port))] = time.Now()
+}
+
+func isDiscoveredTarget(host string, port int) bool {
+	discoveredTargetsMu.Lock()
+	defer discoveredTargetsMu.Unlock()
+	key := net.JoinHostPort(strings.ToLower(host), strconv.Itoa(port))
+	seen, ok := discoveredTargets[key]
+	if ok && time.Since(seen) > DISCOVERED_TARGET_TTL {
+		delete(discoveredTargets, key)
+		return false
+	}
+	return ok
+}
+
+func isAllowedPort(port int) bool {
+	if len(allowedPorts) == 0 {
+		return true
+	}
+	for _, r := range allowedPorts {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllowedIP(ip net.IP) bool {
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalSerialTarget reports whether host:port is one of the bridge's own serial TCP
+// servers (or a replay of a recording, or a relay to a peer bridge).
+func isLocalSerialTarget(host string, port int) bool {
+	if getSerialPathFromTcpPort(port) == "" && getReplay("", port) == nil && findPeerProxy(port) == nil {
+		return false
+	}
+	if host == "localhost" || host == getAdvertiseHost() {
+		return true
+	}
+	ipAddr, ok := parseTargetIP(host)
+	if !ok {
+		return false
+	}
+	ip := ipAddr.IP
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTarget validates a /ws target against the policy and returns the
+// address to dial. When the decision was made on a resolved IP, that IP is
+// dialled so the name can't be re-resolved to a different address.
+func checkTarget(host string, port int) (string, error) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid target port %d", port)
+	}
+	if isLocalSerialTarget(host, port) {
+		return target, nil
+	}
+	if policyRules[POLICY_ANY] ||
+		(policyRules[POLICY_DEVICES] && allowedDevices[strings.ToLower(target)]) ||
+		(policyRules[POLICY_MDNS] && isDiscoveredTarget(host, port)) {
+		// .local names are resolved by the bridge itself
+		return resolveDialTarget(host, port)
+	}
+
+	addrs, err := lookupTargetIPs(host)
+	if err != nil {
+		return "", fmt.Errorf("target %s is not allowed by the bridge target policy (cannot resolve host: %w)", target, err)
+	}
+
+	for _, a := range addrs {
+		addr := net.JoinHostPort(a.String(), strconv.Itoa(port))
+		if policyRules[POLICY_DEVICES] && allowedDevices[addr] {
+			return addr, nil
+		}
+		if policyRules[POLICY_MDNS] && isDiscoveredTarget(a.IP.String(), port) {
+			return addr, nil
+		}
+		if policyRules[POLICY_CIDR] && isAllowedIP(a.IP) && isAllowedPort(port) {
+			return addr, nil
+		}
+	}
+
+	return "", fmt.Errorf("target %s is not allowed by the bridge target policy (%s)", target, targetPolicy)
+}
+
+// checkWebSocketOrigin allows non-browser clients, same-origin requests,
+// Home Assistant ingress and origins from the configured allowlist ("*"
+// allows every origin).
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || isIngressRequest(r) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range originList {
+		if allowed == "*" || strings.EqualFold(allowed, origin) || strings.EqualFold(allowed, u.Host) || strings.EqualFold(allowed, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
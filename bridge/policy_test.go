@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// withPolicy configures the target policy flags for one test.
+func withPolicy(t *testing.T, policy, cidrs, ports, targets, origins string) {
+	t.Helper()
+	saved := []string{targetPolicy, allowCIDRs, allowPorts, allowTargets, allowedOrigins}
+	targetPolicy, allowCIDRs, allowPorts, allowTargets, allowedOrigins = policy, cidrs, ports, targets, origins
+	t.Cleanup(func() {
+		targetPolicy, allowCIDRs, allowPorts, allowTargets, allowedOrigins = saved[0], saved[1], saved[2], saved[3], saved[4]
+		_ = initTargetPolicy()
+	})
+	if err := initTargetPolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitTargetPolicyRejectsInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name                          string
+		policy, cidrs, ports, targets string
+	}{
+		{"unknown rule", "everything", "", "", ""},
+		{"empty policy", " , ", "", "", ""},
+		{"bad cidr", "cidr", "192.168.1.0/33", "", ""},
+		{"bad port range", "cidr", "", "9000-8000", ""},
+		{"port out of range", "cidr", "", "70000", ""},
+		{"target without port", "devices", "", "", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := []string{targetPolicy, allowCIDRs, allowPorts, allowTargets}
+			defer func() {
+				targetPolicy, allowCIDRs, allowPorts, allowTargets = saved[0], saved[1], saved[2], saved[3]
+			}()
+			targetPolicy, allowCIDRs, allowPorts, allowTargets = tt.policy, tt.cidrs, tt.ports, tt.targets
+			if err := initTargetPolicy(); err == nil {
+				t.Errorf("initTargetPolicy accepted %+v", tt)
+			}
+		})
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		host     string
+		port     int
+		wantDial string // "" = blocked
+	}{
+		{"default blocks unknown hosts", DEFAULT_TARGET_POLICY, "10.1.2.3", 6638, ""},
+		{"any allows everything", POLICY_ANY, "10.1.2.3", 6638, "10.1.2.3:6638"},
+		{"cidr inside", "cidr", "192.168.1.20", 6638, "192.168.1.20:6638"},
+		{"cidr wrong port", "cidr", "192.168.1.20", 22, ""},
+		{"cidr outside", "cidr", "192.168.2.20", 6638, ""},
+		{"devices listed", "devices", "10.0.0.5", 6638, "10.0.0.5:6638"},
+		{"devices other port", "devices", "10.0.0.5", 6639, ""},
+		{"mdns discovered", "mdns", "10.9.9.9", 6638, "10.9.9.9:6638"},
+		{"mdns not discovered", "mdns", "10.9.9.8", 6638, ""},
+		{"invalid port", POLICY_ANY, "10.1.2.3", 70000, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPolicy(t, tt.policy, "192.168.1.0/24", "6638,8880-8890", "10.0.0.5:6638", "")
+			rememberDiscoveredTarget("10.9.9.9", 6638)
+			dial, err := checkTarget(tt.host, tt.port)
+			if tt.wantDial == "" {
+				if err == nil {
+					t.Errorf("checkTarget(%s, %d) = %s, want blocked", tt.host, tt.port, dial)
+				}
+				return
+			}
+			if err != nil || dial != tt.wantDial {
+				t.Errorf("checkTarget(%s, %d) = %q, %v, want %q", tt.host, tt.port, dial, err, tt.wantDial)
+			}
+		})
+	}
+}
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	withPolicy(t, DEFAULT_TARGET_POLICY, "", "", "", DEFAULT_ALLOWED_ORIGINS+",lab.example")
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"non-browser client", "", true},
+		{"same origin", "http://bridge.lan:8765", true},
+		{"hosted UI", "https://mt.xyzroe.cc", true},
+		{"listed host", "http://lab.example:8080", true},
+		{"other page", "https://evil.example", false},
+		{"lookalike host", "http://mt.xyzroe.cc.evil.example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "http://bridge.lan:8765/ws", nil)
+			r.RemoteAddr = "192.168.1.50:40000"
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkWebSocketOrigin(r); got != tt.want {
+				t.Errorf("checkWebSocketOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
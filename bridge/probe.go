@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// protocolProbe is a harmless request that makes a known NCP/bootloader
+// answer with a recognisable response.
+type protocolProbe struct {
+	Name    string
+	Request []byte
+	Match   func(resp []byte) bool
+}
+
+// ProbeAttempt is one baud/protocol combination tried by probeSerialPort.
+type ProbeAttempt struct {
+	BaudRate int    `json:"baud"`
+	Protocol string `json:"protocol"`
+	Response string `json:"response,omitempty"`
+}
+
+// ProbeResult is returned by the /probe endpoint.
+type ProbeResult struct {
+	Path     string         `json:"path"`
+	Detected bool           `json:"detected"`
+	BaudRate int            `json:"baud,omitempty"`
+	Protocol string         `json:"protocol,omitempty"`
+	Response string         `json:"response,omitempty"`
+	Tried    []ProbeAttempt `json:"tried"`
+}
+
+// defaultProbeRates lists candidate rates, most common NCP rates first.
+var defaultProbeRates = []int{115200, 460800, 230400, 57600, 38400, 19200, 9600, 500000}
+
+var protocolProbes = []protocolProbe{
+	{
+		// ASH RST frame; the NCP answers with RSTACK (0xC1 0x02 ...)
+		Name:    "ezsp",
+		Request: []byte{0x1A, 0xC0, 0x38, 0xBC, 0x7E},
+		Match: func(resp []byte) bool {
+			return bytes.Contains(resp, []byte{0xC1, 0x02})
+		},
+	},
+	{
+		// PROP_VALUE_GET(PROP_PROTOCOL_VERSION); the NCP answers with PROP_VALUE_IS
+		Name:    "spinel",
+		Request: hdlcEncode([]byte{0x81, 0x02, 0x01}),
+		Match: func(resp []byte) bool {
+			return bytes.Contains(hdlcUnstuff(resp), []byte{0x81, 0x06, 0x01})
+		},
+	},
+	{
+		// MT SYS_PING; the SRSP is FE 02 61 01 <capabilities> <fcs>
+		Name:    "zstack",
+		Request: []byte{0xFE, 0x00, 0x21, 0x01, 0x20},
+		Match: func(resp []byte) bool {
+			return bytes.Contains(resp, []byte{0xFE, 0x02, 0x61, 0x01})
+		},
+	},
+	{
+		// TI BSL auto-baud sync; the bootloader answers with ACK
+		Name:    "ti-bsl",
+		Request: []byte{0x55, 0x55},
+		Match: func(resp []byte) bool {
+			return bytes.Contains(resp, []byte{0x00, 0xCC}) || bytes.Equal(resp, []byte{0xCC})
+		},
+	},
+}
+
+// probeNames lists the protocol names accepted by probeSerialPort.
+func probeNames() []string {
+	names := make([]string, 0, len(protocolProbes))
+	for _, p := range protocolProbes {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// fcs16 is the HDLC FCS-16 (CRC-16/X.25) used by Spinel.
+func fcs16(data []byte) uint16 {
+	fcs := uint16(0xFFFF)
+	for _, b := range data {
+		fcs ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if fcs&1 != 0 {
+				fcs = (fcs >> 1) ^ 0x8408
+			} else {
+				fcs >>= 1
+			}
+		}
+	}
+	return fcs ^ 0xFFFF
+}
+
+// hdlcEncode wraps payload in an HDLC-lite frame with FCS and byte stuffing.
+func hdlcEncode(payload []byte) []byte {
+	fcs := fcs16(payload)
+	raw := append(append([]byte{}, payload...), byte(fcs), byte(fcs>>8))
+	out := []byte{0x7E}
+	for _, b := range raw {
+		if b == 0x7E || b == 0x7D || b == 0x11 || b == 0x13 || b == 0xF8 {
+			out = append(out, 0x7D, b^0x20)
+		} else {
+			out = append(out, b)
+		}
+	}
+	return append(out, 0x7E)
+}
+
+// hdlcUnstuff removes HDLC-lite escaping from data.
+func hdlcUnstuff(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0x7D && i+1 < len(data) {
+			i++
+			out = append(out, data[i]^0x20)
+			continue
+		}
+		out = append(out, data[i])
+	}
+	return out
+}
+
+// probeSerialPort cycles the port through rates and sends each protocol probe,
+// stopping at the first recognised answer. The port must not be in use by TCP
+// clients. The original SerialState is restored afterwards.
+func probeSerialPort(path string, rates []int, protocols []string, timeout time.Duration) (*ProbeResult, error) {
+	val, _ := portLocks.LoadOrStore(path, &sync.Mutex{})
+	mu := val.(*sync.Mutex)
+	mu.Lock()
+
+	serialMutex.Lock()
+	if serialPortRefCount[path] > 0 {
+		serialMutex.Unlock()
+		mu.Unlock()
+		return nil, fmt.Errorf("port %s is in use", path)
+	}
+	_, wasOpen := openSerialPorts[path]
+	if port, exists := openSerialPorts[path]; exists {
+		closeSerial(port)
+		delete(openSerialPorts, path)
+	}
+	serialMutex.Unlock()
+
+	original := getSerialPortState(path)
+
+	probes := protocolProbes
+	if len(protocols) > 0 {
+		probes = nil
+		for _, p := range protocolProbes {
+			for _, name := range protocols {
+				if p.Name == name {
+					probes = append(probes, p)
+				}
+			}
+		}
+	}
+
+	result := &ProbeResult{Path: path, Tried: []ProbeAttempt{}}
+
+rates:
+	for _, rate := range rates {
+		port := rawOpenSerialPort(path, rate)
+		if port == nil {
+			continue
+		}
+		// keep control lines as they were so probing doesn't reset the device
+		port.SetDTR(original.DTR)
+		port.SetRTS(original.RTS)
+		_ = port.SetReadTimeout(20 * time.Millisecond)
+
+		for _, p := range probes {
+			_ = port.ResetInputBuffer()
+			if _, err := port.Write(p.Request); err != nil {
+				log.Printf("[probe] %s write error at %d: %v\n", path, rate, err)
+				break
+			}
+
+			var resp []byte
+			matched := false
+			buf := make([]byte, 256)
+			deadline := time.Now().Add(timeout)
+			for time.Now().Before(deadline) {
+				n, err := port.Read(buf)
+				if err != nil {
+					break
+				}
+				if n > 0 {
+					resp = append(resp, buf[:n]...)
+					if p.Match(resp) {
+						matched = true
+						break
+					}
+				}
+			}
+
+			attempt := ProbeAttempt{BaudRate: rate, Protocol: p.Name, Response: hex.EncodeToString(resp)}
+			result.Tried = append(result.Tried, attempt)
+			if debugMode {
+				log.Printf("[probe] %s at %d %s: %x\n", path, rate, p.Name, resp)
+			}
+			if matched {
+				result.Detected = true
+				result.BaudRate = rate
+				result.Protocol = p.Name
+				result.Response = attempt.Response
+				closeSerial(port)
+				break rates
+			}
+		}
+		closeSerial(port)
+	}
+
+	setSerialPortState(path, original)
+	mu.Unlock()
+
+	// reopen the port the way it was before probing
+	if wasOpen {
+		if _, err := ensureSerialPort(path, original.BaudRate); err != nil {
+			log.Printf("[probe] failed to restore %s at %d: %v\n", path, original.BaudRate, err)
+		}
+	}
+
+	if result.Detected {
+		log.Printf("[probe] %s: detected %s at %d baud\n", path, result.Protocol, result.BaudRate)
+	} else {
+		log.Printf("[probe] %s: nothing detected\n", path)
+	}
+	return result, nil
+}
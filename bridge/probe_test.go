@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProtocolProbes(t *testing.T) {
+	probes := make(map[string]protocolProbe)
+	for _, p := range protocolProbes {
+		probes[p.Name] = p
+	}
+	tests := []struct {
+		name  string
+		probe string
+		resp  []byte
+		want  bool
+	}{
+		{"ezsp rstack", "ezsp", []byte{0x1A, 0xC1, 0x02, 0x0B, 0x0A, 0x52, 0x7E}, true},
+		{"ezsp noise", "ezsp", []byte{0xC1, 0x03, 0x7E}, false},
+		{"spinel prop value is", "spinel", []byte{0x7E, 0x81, 0x06, 0x01, 0x04, 0x03, 0x12, 0x34, 0x7E}, true},
+		{"spinel stuffed header", "spinel", []byte{0x7E, 0x81, 0x7D, 0x26, 0x01, 0x04, 0x7E}, true},
+		{"spinel other property", "spinel", []byte{0x7E, 0x81, 0x06, 0x02, 0x7E}, false},
+		{"zstack ping srsp", "zstack", []byte{0xFE, 0x02, 0x61, 0x01, 0x59, 0x06, 0x3D}, true},
+		{"zstack other srsp", "zstack", []byte{0xFE, 0x01, 0x61, 0x02, 0x00}, false},
+		{"ti-bsl ack", "ti-bsl", []byte{0x00, 0xCC}, true},
+		{"ti-bsl lone ack byte", "ti-bsl", []byte{0xCC}, true},
+		{"ti-bsl nack", "ti-bsl", []byte{0x00, 0x33}, false},
+		{"empty", "ezsp", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probes[tt.probe].Match(tt.resp); got != tt.want {
+				t.Errorf("%s.Match(%x) = %v, want %v", tt.probe, tt.resp, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHdlcEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"spinel probe", []byte{0x81, 0x02, 0x01}},
+		{"bytes needing escapes", []byte{0x7E, 0x7D, 0x11, 0x13, 0xF8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := hdlcEncode(tt.payload)
+			if frame[0] != 0x7E || frame[len(frame)-1] != 0x7E {
+				t.Fatalf("frame %x not delimited by flags", frame)
+			}
+			if bytes.IndexByte(frame[1:len(frame)-1], 0x7E) >= 0 {
+				t.Fatalf("frame %x has an unescaped flag", frame)
+			}
+			raw := hdlcUnstuff(frame[1 : len(frame)-1])
+			fcs := fcs16(tt.payload)
+			want := append(append([]byte{}, tt.payload...), byte(fcs), byte(fcs>>8))
+			if !bytes.Equal(raw, want) {
+				t.Errorf("unstuffed %x, want %x", raw, want)
+			}
+		})
+	}
+}
+
+func TestFcs16(t *testing.T) {
+	// CRC-16/X.25 check value
+	if got := fcs16([]byte("123456789")); got != 0x906E {
+		t.Errorf("fcs16 = %#04x, want 0x906e", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ProfileControl is a BSL/RST control preset for the web UI; the fields are
+// those of its ControlConfig.
+type ProfileControl struct {
+	PinMode     *bool  `json:"pinMode,omitempty"`
+	BslValue    string `json:"bslValue,omitempty"`
+	RstValue    string `json:"rstValue,omitempty"`
+	BaudValue   string `json:"baudValue,omitempty"`
+	InvertLevel *bool  `json:"invertLevel,omitempty"`
+}
+
+// ProfileMatch selects the services a profile applies to; every field that
+// is set must match. type, protocol and txt values are case-insensitive
+// regular expressions, vid and pid are comma-separated hex USB IDs.
+type ProfileMatch struct {
+	Type     string            `json:"type,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+	TXT      map[string]string `json:"txt,omitempty"`
+	VID      string            `json:"vid,omitempty"`
+	PID      string            `json:"pid,omitempty"`
+}
+
+// DeviceProfile maps discovered services to a device model, chip family,
+// default baud rate and control preset.
+type DeviceProfile struct {
+	Name        string          `json:"name"`
+	Match       ProfileMatch    `json:"match"`
+	Model       string          `json:"model,omitempty"`
+	Chip        string          `json:"chip,omitempty"`
+	ChipFromTXT string          `json:"chipFromTxt,omitempty"` // TXT key holding the chip, e.g. radio_type
+	Baud        int             `json:"baud,omitempty"`
+	Control     *ProfileControl `json:"control,omitempty"`
+	Source      string          `json:"source"` // "builtin" or the profiles file
+
+	typeRe     *regexp.Regexp
+	protocolRe *regexp.Regexp
+	txtRe      map[string]*regexp.Regexp
+}
+
+// ServiceProfile is the matching profile attached to a ServiceInfo.
+type ServiceProfile struct {
+	Name    string          `json:"name"`
+	Model   string          `json:"model,omitempty"`
+	Chip    string          `json:"chip,omitempty"`
+	Baud    int             `json:"baud,omitempty"`
+	Control *ProfileControl `json:"control,omitempty"`
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+var (
+	// control presets of the web UI
+	controlZigHTTP   = &ProfileControl{PinMode: boolPtr(true), BslValue: "url:cmdZigBSL", RstValue: "url:cmdZigRST"}
+	controlTubesHTTP = &ProfileControl{PinMode: boolPtr(false), BslValue: "url:switch/zBSL", RstValue: "url:switch/zRST_gpio"}
+	controlLocalUSB  = &ProfileControl{PinMode: boolPtr(false), BslValue: "sp:dtr", RstValue: "sp:rts", BaudValue: "bridge"}
+	controlLocalPort = &ProfileControl{PinMode: boolPtr(false), BaudValue: "bridge"}
+)
+
+// builtinProfiles are checked after the profiles file, first match wins.
+var builtinProfiles = []DeviceProfile{
+	{
+		Name:        "zigstar-http",
+		Match:       ProfileMatch{Type: "^(zigstar_gw|zig_star_gw|uzg-01|xzg)$"},
+		Model:       "ZigStar/XZG network coordinator",
+		ChipFromTXT: "radio_type",
+		Control:     controlZigHTTP,
+	},
+	{
+		Name:        "tubeszb-http",
+		Match:       ProfileMatch{Type: "^(tubeszb|tubes_zb)$"},
+		Model:       "TubesZB coordinator (ESPHome)",
+		ChipFromTXT: "radio_type",
+		Control:     controlTubesHTTP,
+	},
+	{
+		Name:    "sonoff-zbdongle-p",
+		Match:   ProfileMatch{VID: "10c4", PID: "ea60", TXT: map[string]string{"board": "^itead"}},
+		Model:   "SONOFF ZBDongle-P",
+		Chip:    "cc2652",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "sonoff-zbdongle-e",
+		Match:   ProfileMatch{VID: "1a86", PID: "55d4", TXT: map[string]string{"board": "^itead"}},
+		Model:   "SONOFF ZBDongle-E",
+		Chip:    "efr32",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "ti-xds110",
+		Match:   ProfileMatch{VID: "0451", PID: "bef3"},
+		Model:   "TI LaunchPad (XDS110)",
+		Chip:    "cc26xx",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "cp210x",
+		Match:   ProfileMatch{VID: "10c4", PID: "ea60"},
+		Model:   "Silicon Labs CP210x USB-UART",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "ch340",
+		Match:   ProfileMatch{VID: "1a86", PID: "7523"},
+		Model:   "WCH CH340 USB-UART",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "ch9102",
+		Match:   ProfileMatch{VID: "1a86", PID: "55d4"},
+		Model:   "WCH CH9102 USB-UART",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "ftdi",
+		Match:   ProfileMatch{VID: "0403", PID: "6001,6010,6014,6015"},
+		Model:   "FTDI USB-UART",
+		Baud:    115200,
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "local-usb",
+		Match:   ProfileMatch{Type: "^local$", Protocol: "^usb$"},
+		Model:   "USB serial port",
+		Control: controlLocalUSB,
+	},
+	{
+		Name:    "local-serial",
+		Match:   ProfileMatch{Type: "^local$", Protocol: "^serial$"},
+		Model:   "Serial port",
+		Control: controlLocalPort,
+	},
+}
+
+// deviceProfiles are the active profiles: the profiles file, then the built-ins.
+var deviceProfiles []DeviceProfile
+
+// initProfiles compiles the built-in profiles and loads path, if set.
+func initProfiles(path string) error {
+	var profiles []DeviceProfile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read profiles: %v", err)
+		}
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return fmt.Errorf("invalid profiles file %s: %v", path, err)
+		}
+		for i := range profiles {
+			profiles[i].Source = path
+		}
+	}
+	for _, p := range builtinProfiles {
+		p.Source = "builtin"
+		profiles = append(profiles, p)
+	}
+	for i := range profiles {
+		if err := profiles[i].compile(); err != nil {
+			return err
+		}
+	}
+	deviceProfiles = profiles
+	return nil
+}
+
+func (p *DeviceProfile) compile() error {
+	if p.Name == "" {
+		return fmt.Errorf("device profile without a name (%s)", p.Source)
+	}
+	m := p.Match
+	if m.Type == "" && m.Protocol == "" && len(m.TXT) == 0 && m.VID == "" && m.PID == "" {
+		return fmt.Errorf("device profile %q matches every service", p.Name)
+	}
+	var err error
+	compile := func(pattern string) *regexp.Regexp {
+		if pattern == "" || err != nil {
+			return nil
+		}
+		var re *regexp.Regexp
+		if re, err = regexp.Compile("(?i)" + pattern); err != nil {
+			err = fmt.Errorf("device profile %q: invalid pattern %q: %v", p.Name, pattern, err)
+		}
+		return re
+	}
+	p.typeRe = compile(m.Type)
+	p.protocolRe = compile(m.Protocol)
+	p.txtRe = make(map[string]*regexp.Regexp)
+	for key, pattern := range m.TXT {
+		p.txtRe[key] = compile(pattern)
+	}
+	return err
+}
+
+func (p *DeviceProfile) matches(info *ServiceInfo) bool {
+	if p.typeRe != nil && !p.typeRe.MatchString(info.Type) {
+		return false
+	}
+	if p.protocolRe != nil && !p.protocolRe.MatchString(info.Protocol) {
+		return false
+	}
+	for key, re := range p.txtRe {
+		value, ok := info.TXT[key]
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return matchUsbID(p.Match.VID, info.TXT["vendor_id"]) && matchUsbID(p.Match.PID, info.TXT["product_id"])
+}
+
+// matchUsbID compares a hex USB ID with a comma-separated list.
+func matchUsbID(want, got string) bool {
+	if want == "" {
+		return true
+	}
+	got = strings.TrimPrefix(strings.ToLower(got), "0x")
+	if got == "" {
+		return false
+	}
+	for _, id := range splitList(want) {
+		if strings.TrimPrefix(strings.ToLower(id), "0x") == got {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyService attaches the first matching profile; a profile set by a
+// peer bridge is kept.
+func classifyService(info *ServiceInfo) {
+	if info.Profile != nil {
+		return
+	}
+	for i := range deviceProfiles {
+		p := &deviceProfiles[i]
+		if !p.matches(info) {
+			continue
+		}
+		sp := &ServiceProfile{Name: p.Name, Model: p.Model, Chip: p.Chip, Baud: p.Baud, Control: p.Control}
+		if chip := info.TXT[p.ChipFromTXT]; p.ChipFromTXT != "" && chip != "" {
+			sp.Chip = chip
+		}
+		info.Profile = sp
+		return
+	}
+}
+
+func classifyServices(services []ServiceInfo) {
+	for i := range services {
+		classifyService(&services[i])
+	}
+}
+
+func handleProfileList(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"profiles": deviceProfiles,
+	})
+}
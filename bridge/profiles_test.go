@@ -0,0 +1,144 @@
+package main
+
+import "testing"
+
+func TestClassifyService(t *testing.T) {
+	if err := initProfiles(""); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		info        ServiceInfo
+		wantProfile string
+		wantChip    string
+	}{
+		{
+			name:        "network coordinator with radio_type",
+			info:        ServiceInfo{Type: "XZG", Protocol: "tcp", TXT: map[string]string{"radio_type": "cc2652p7"}},
+			wantProfile: "zigstar-http",
+			wantChip:    "cc2652p7",
+		},
+		{
+			name:        "network coordinator without radio_type",
+			info:        ServiceInfo{Type: "uzg-01", Protocol: "tcp"},
+			wantProfile: "zigstar-http",
+		},
+		{
+			name:        "dongle-p before the generic cp210x",
+			info:        ServiceInfo{Type: "local", Protocol: "usb", TXT: map[string]string{"vendor_id": "10C4", "product_id": "0xEA60", "board": "ITead"}},
+			wantProfile: "sonoff-zbdongle-p",
+			wantChip:    "cc2652",
+		},
+		{
+			name:        "cp210x without board",
+			info:        ServiceInfo{Type: "local", Protocol: "usb", TXT: map[string]string{"vendor_id": "10c4", "product_id": "ea60"}},
+			wantProfile: "cp210x",
+		},
+		{
+			name:        "ftdi pid list",
+			info:        ServiceInfo{Type: "local", Protocol: "usb", TXT: map[string]string{"vendor_id": "0403", "product_id": "6015"}},
+			wantProfile: "ftdi",
+		},
+		{
+			name:        "unknown usb adapter",
+			info:        ServiceInfo{Type: "local", Protocol: "usb", TXT: map[string]string{"vendor_id": "1234", "product_id": "5678"}},
+			wantProfile: "local-usb",
+		},
+		{
+			name: "unknown service",
+			info: ServiceInfo{Type: "http", Protocol: "tcp"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := tt.info
+			classifyService(&info)
+			if tt.wantProfile == "" {
+				if info.Profile != nil {
+					t.Errorf("matched %s", info.Profile.Name)
+				}
+				return
+			}
+			if info.Profile == nil {
+				t.Fatalf("no profile, want %s", tt.wantProfile)
+			}
+			if info.Profile.Name != tt.wantProfile || info.Profile.Chip != tt.wantChip {
+				t.Errorf("profile %s chip %q, want %s chip %q", info.Profile.Name, info.Profile.Chip, tt.wantProfile, tt.wantChip)
+			}
+		})
+	}
+}
+
+func TestClassifyServiceKeepsPeerProfile(t *testing.T) {
+	if err := initProfiles(""); err != nil {
+		t.Fatal(err)
+	}
+	info := ServiceInfo{Type: "local", Protocol: "usb", Profile: &ServiceProfile{Name: "peer"}}
+	classifyService(&info)
+	if info.Profile.Name != "peer" {
+		t.Errorf("profile %s replaced the peer's", info.Profile.Name)
+	}
+}
+
+func TestCompileRejectsInvalidProfiles(t *testing.T) {
+	tests := []DeviceProfile{
+		{Match: ProfileMatch{Type: "^xzg$"}},
+		{Name: "catch-all"},
+		{Name: "bad-regexp", Match: ProfileMatch{Type: "(xzg"}},
+	}
+	for _, p := range tests {
+		p.Source = "test"
+		if err := p.compile(); err == nil {
+			t.Errorf("profile %+v accepted", p.Match)
+		}
+	}
+}
+
+func TestClassifyEnumeratedSerialPorts(t *testing.T) {
+	if err := initProfiles(""); err != nil {
+		t.Fatal(err)
+	}
+	saved := usbPortDetails
+	t.Cleanup(func() { usbPortDetails = saved })
+	usbPortDetails = func() map[string]SerialPortInfo {
+		return map[string]SerialPortInfo{
+			"/dev/ttyTEST0": {Path: "/dev/ttyTEST0", Manufacturer: "ITead", Product: "Sonoff Zigbee 3.0 USB Dongle Plus", VendorID: "10C4", ProductID: "EA60"},
+			"/dev/ttyTEST1": {Path: "/dev/ttyTEST1", VendorID: "0451", ProductID: "BEF3"},
+		}
+	}
+	want := map[string]string{"/dev/ttyTEST0": "sonoff-zbdongle-p", "/dev/ttyTEST1": "ti-xds110"}
+
+	// list the ports like scanAndSyncSerialPorts, without opening servers
+	serialMutex.Lock()
+	for i, info := range listSerialPorts() {
+		if _, ok := want[info.Path]; ok {
+			serialPortDetails[info.Path] = info
+			serialServers[info.Path] = ServerInfo{Port: 16638 + i}
+		}
+	}
+	serialMutex.Unlock()
+	t.Cleanup(func() {
+		serialMutex.Lock()
+		for path := range want {
+			delete(serialPortDetails, path)
+			delete(serialServers, path)
+		}
+		serialMutex.Unlock()
+	})
+
+	found := 0
+	for _, info := range listLocalSerialAsServices() {
+		profile, ok := want[info.Name]
+		if !ok {
+			continue
+		}
+		found++
+		classifyService(&info)
+		if info.Profile == nil || info.Profile.Name != profile {
+			t.Errorf("%s (txt %v) classified as %+v, want %s", info.Name, info.TXT, info.Profile, profile)
+		}
+	}
+	if found != len(want) {
+		t.Errorf("%d enumerated ports listed, want %d", found, len(want))
+	}
+}
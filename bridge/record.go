@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Recording event kinds. "tx" is data from the client towards the target or
+// serial port, "rx" the opposite direction.
+const (
+	REC_START = "start"
+	REC_TX    = "tx"
+	REC_RX    = "rx"
+	REC_CTL   = "ctl"
+	REC_END   = "end"
+)
+
+// MAX_RECORDING_SIZE stops recording data once a file reaches this size.
+const MAX_RECORDING_SIZE = 64 * 1024 * 1024
+
+// REPLAY_SYNC_TIMEOUT is how long a replay waits for the client to send the
+// recorded request bytes before it plays the next response anyway.
+const REPLAY_SYNC_TIMEOUT = 5 * time.Second
+
+const recordingExt = ".jsonl"
+
+// RecordEvent is one line of a recording. T is the time in microseconds since
+// the session started.
+type RecordEvent struct {
+	T    int64  `json:"t"`
+	Ev   string `json:"ev"`
+	Data string `json:"data,omitempty"` // hex payload of tx/rx
+
+	// start
+	Type   string `json:"type,omitempty"`
+	Target string `json:"target,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Time   string `json:"time,omitempty"`
+
+	// ctl
+	DTR  *bool `json:"dtr,omitempty"`
+	RTS  *bool `json:"rts,omitempty"`
+	Baud int   `json:"baud,omitempty"`
+}
+
+// sessionRecorder writes the timed byte stream of a session as JSON lines.
+type sessionRecorder struct {
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	name      string
+	start     time.Time
+	size      int64
+	truncated bool
+}
+
+// getRecordDir returns where recordings are stored.
+func getRecordDir() string {
+	if recordDir != "" {
+		return recordDir
+	}
+	return filepath.Join(getTLSDir(), "recordings")
+}
+
+func newSessionRecorder(s *Session) (*sessionRecorder, error) {
+	dir := getRecordDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s-%s%s", s.Started.Format("20060102-150405"), s.Type, s.ID, recordingExt)
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &sessionRecorder{
+		file:  f,
+		w:     bufio.NewWriter(f),
+		name:  name,
+		start: s.Started,
+	}
+	r.write(RecordEvent{
+		Ev:     REC_START,
+		Type:   s.Type,
+		Target: s.Target,
+		Path:   s.Path,
+		Time:   s.Started.Format(time.RFC3339Nano),
+	})
+	return r, nil
+}
+
+func (r *sessionRecorder) write(ev RecordEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil || r.truncated {
+		return
+	}
+	ev.T = time.Since(r.start).Microseconds()
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	if r.size+int64(len(line)) > MAX_RECORDING_SIZE {
+		r.truncated = true
+		log.Printf("[record] %s reached %d bytes, recording stopped\n", r.name, MAX_RECORDING_SIZE)
+		return
+	}
+	r.size += int64(len(line)) + 1
+	_, _ = r.w.Write(line)
+	_ = r.w.WriteByte('\n')
+}
+
+// Tx records data sent by the client.
+func (r *sessionRecorder) Tx(data []byte) {
+	r.write(RecordEvent{Ev: REC_TX, Data: hex.EncodeToString(data)})
+}
+
+// Rx records data sent to the client.
+func (r *sessionRecorder) Rx(data []byte) {
+	r.write(RecordEvent{Ev: REC_RX, Data: hex.EncodeToString(data)})
+}
+
+// Control records a control-line or baud rate change.
+func (r *sessionRecorder) Control(dtr, rts *bool, baud int) {
+	r.write(RecordEvent{Ev: REC_CTL, DTR: dtr, RTS: rts, Baud: baud})
+}
+
+func (r *sessionRecorder) Close() {
+	r.write(RecordEvent{Ev: REC_END})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	_ = r.w.Flush()
+	_ = r.file.Close()
+	r.file = nil
+	log.Printf("[record] saved %s\n", r.name)
+}
+
+// recordSerialControl adds a control event to every recorded session using path.
+func recordSerialControl(path string, dtr, rts *bool, baud int) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range sessions {
+		if s.recorder != nil && s.Path == path {
+			s.recorder.Control(dtr, rts, baud)
+		}
+	}
+}
+
+// recordingPath maps a recording name from the API to a file in the
+// recordings directory, rejecting anything that could escape it.
+func recordingPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, recordingExt) {
+		return "", fmt.Errorf("invalid recording name %q", name)
+	}
+	return filepath.Join(getRecordDir(), name), nil
+}
+
+func loadRecording(name string) ([]RecordEvent, error) {
+	path, err := recordingPath(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []RecordEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var ev RecordEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", name, line, err)
+		}
+		if ev.Data != "" {
+			if _, err := hex.DecodeString(ev.Data); err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid data", name, line)
+			}
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 || events[0].Ev != REC_START {
+		return nil, fmt.Errorf("%s is not a bridge recording", name)
+	}
+	return events, nil
+}
+
+// Replay serves a recording on a TCP port. It is also listed as a local
+// serial service, so the UI can open it like a real port over TCP; there is
+// no virtual serial device and control events are not replayed.
+type Replay struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Port    int       `json:"port"`
+	Speed   float64   `json:"speed"`
+	Started time.Time `json:"started"`
+
+	events   []RecordEvent
+	listener net.Listener
+}
+
+var (
+	replays      = make(map[string]*Replay)
+	replaysMu    sync.Mutex
+	lastReplayId uint64
+)
+
+// startReplay opens the virtual TCP listener for a recording (port 0 picks a free port).
+func startReplay(name string, port int, speed float64) (*Replay, error) {
+	events, err := loadRecording(name)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&lastReplayId, 1), 10)
+	rp := &Replay{
+		ID:       id,
+		Name:     name,
+		Path:     "replay:" + strings.TrimSuffix(name, recordingExt),
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Speed:    speed,
+		Started:  time.Now(),
+		events:   events,
+		listener: wrapSerialListener(listener),
+	}
+	replaysMu.Lock()
+	replays[id] = rp
+	replaysMu.Unlock()
+
+	go func() {
+		for {
+			conn, err := rp.listener.Accept()
+			if err != nil {
+				return
+			}
+			go rp.serve(conn)
+		}
+	}()
+	log.Printf("[replay] %s on %d (speed %gx)\n", name, rp.Port, speed)
+	return rp, nil
+}
+
+func stopReplay(id string) bool {
+	replaysMu.Lock()
+	rp, ok := replays[id]
+	delete(replays, id)
+	replaysMu.Unlock()
+	if ok {
+		_ = rp.listener.Close()
+		log.Printf("[replay] stopped %s\n", rp.Name)
+	}
+	return ok
+}
+
+func listReplays() []Replay {
+	replaysMu.Lock()
+	defer replaysMu.Unlock()
+	list := make([]Replay, 0, len(replays))
+	for _, rp := range replays {
+		list = append(list, Replay{ID: rp.ID, Name: rp.Name, Path: rp.Path, Port: rp.Port, Speed: rp.Speed, Started: rp.Started})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// getReplay finds an active replay by its virtual path or TCP port.
+func getReplay(path string, port int) *Replay {
+	replaysMu.Lock()
+	defer replaysMu.Unlock()
+	for _, rp := range replays {
+		if (path != "" && rp.Path == path) || (port > 0 && rp.Port == port) {
+			return rp
+		}
+	}
+	return nil
+}
+
+// serve plays the recorded responses to one client. Before each response the
+// client must have sent as many bytes as were sent before it in the
+// recording; the original delay is then kept relative to that point.
+func (rp *Replay) serve(conn net.Conn) {
+	defer conn.Close()
+	if err := authenticateSerialClient(conn); err != nil {
+		log.Printf("[replay] rejected %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("[replay] client %s connected to %s\n", conn.RemoteAddr(), rp.Name)
+
+	var received int64
+	notify := make(chan struct{}, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				atomic.AddInt64(&received, int64(n))
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var expected int64
+	lastT := int64(0)
+	lastWall := time.Now()
+	for _, ev := range rp.events {
+		switch ev.Ev {
+		case REC_TX:
+			data, _ := hex.DecodeString(ev.Data)
+			expected += int64(len(data))
+			deadline := time.NewTimer(REPLAY_SYNC_TIMEOUT)
+			for atomic.LoadInt64(&received) < expected {
+				select {
+				case <-notify:
+					continue
+				case <-deadline.C:
+					if debugMode {
+						log.Printf("[replay] %s: client did not send the recorded request, continuing\n", rp.Name)
+					}
+				case <-closed:
+					deadline.Stop()
+					return
+				}
+				break
+			}
+			deadline.Stop()
+			lastT, lastWall = ev.T, time.Now()
+		case REC_RX:
+			wait := time.Duration(float64(ev.T-lastT)/rp.Speed) * time.Microsecond
+			if d := time.Until(lastWall.Add(wait)); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-closed:
+					return
+				}
+			}
+			data, _ := hex.DecodeString(ev.Data)
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+			lastT, lastWall = ev.T, time.Now()
+		case REC_CTL:
+			// a TCP client has no control lines to apply them to
+			if debugMode {
+				log.Printf("[replay] %s: control event at %dus\n", rp.Name, ev.T)
+			}
+		}
+	}
+	log.Printf("[replay] %s finished for %s\n", rp.Name, conn.RemoteAddr())
+}
+
+// listReplaysAsServices presents active replays like local serial ports.
+func listReplaysAsServices() []ServiceInfo {
+	var services []ServiceInfo
+	for _, rp := range listReplays() {
+		services = append(services, ServiceInfo{
+			Name:     rp.Path,
+			Host:     getAdvertiseHost(),
+			Port:     rp.Port,
+			Type:     "local",
+			Protocol: "replay",
+			FQDN:     rp.Path,
+			TXT: map[string]string{
+				"recording": rp.Name,
+			},
+		})
+	}
+	return services
+}
+
+func handleRecordingList(c echo.Context) error {
+	type recordingInfo struct {
+		Name     string    `json:"name"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"modified"`
+	}
+	list := []recordingInfo{}
+	entries, _ := os.ReadDir(getRecordDir())
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), recordingExt) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			list = append(list, recordingInfo{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"dir":        getRecordDir(),
+		"recordings": list,
+	})
+}
+
+func handleRecordingDownload(c echo.Context) error {
+	name := c.QueryParam("name")
+	path, err := recordingPath(name)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if _, err := os.Stat(path); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Recording not found",
+		})
+	}
+	return c.Attachment(path, name)
+}
+
+// handleReplay starts a replay (?name=), stops one (?stop=<id>) or lists the active ones.
+func handleReplay(c echo.Context) error {
+	if id := c.QueryParam("stop"); id != "" {
+		if !stopReplay(id) {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Replay not found",
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"id":      id,
+			"stopped": true,
+		})
+	}
+
+	name := c.QueryParam("name")
+	if name == "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"replays": listReplays(),
+		})
+	}
+
+	port, err := parseNonNegativeInt(c.QueryParam("port"))
+	if err != nil || port > 65535 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid port",
+		})
+	}
+	speed := 1.0
+	if s := c.QueryParam("speed"); s != "" {
+		speed, err = strconv.ParseFloat(s, 64)
+		if err != nil || speed < 0.01 || speed > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid speed (0.01-100)",
+			})
+		}
+	}
+
+	rp, err := startReplay(name, port, speed)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, rp)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplayAnswersRecordedRequests(t *testing.T) {
+	saved := recordDir
+	t.Cleanup(func() { recordDir = saved })
+	recordDir = t.TempDir()
+	recording := `{"t":0,"ev":"start","type":"serial","path":"/dev/ttyUSB0"}
+{"t":100,"ev":"tx","data":"55aa"}
+{"t":200,"ev":"rx","data":"00cc"}
+{"t":250,"ev":"ctl","dtr":false}
+{"t":300,"ev":"tx","data":"01"}
+{"t":400,"ev":"rx","data":"0102"}
+{"t":500,"ev":"end"}
+`
+	if err := os.WriteFile(filepath.Join(recordDir, "flash.jsonl"), []byte(recording), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := startReplay("flash.jsonl", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopReplay(rp.ID) })
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(rp.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(REPLAY_SYNC_TIMEOUT / 2))
+
+	exchanges := []struct{ tx, rx []byte }{
+		{[]byte{0x55, 0xAA}, []byte{0x00, 0xCC}},
+		{[]byte{0x01}, []byte{0x01, 0x02}},
+	}
+	for _, ex := range exchanges {
+		if _, err := conn.Write(ex.tx); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(ex.rx))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("no answer to %x: %v", ex.tx, err)
+		}
+		if !bytes.Equal(got, ex.rx) {
+			t.Errorf("answer to %x = %x, want %x", ex.tx, got, ex.rx)
+		}
+	}
+}
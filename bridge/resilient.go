@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reconnect backoff for resilient /ws sessions.
+const (
+	RECONNECT_MIN_DELAY = 250 * time.Millisecond
+	RECONNECT_MAX_DELAY = 5 * time.Second
+)
+
+// DEFAULT_GIVE_UP is how long a resilient session reconnects by default.
+const DEFAULT_GIVE_UP = 30 * time.Second
+
+// Target states sent to resilient clients as text messages.
+const (
+	TARGET_DOWN   = "down"
+	TARGET_UP     = "up"
+	TARGET_GIVEUP = "giveup"
+)
+
+// targetStatus is the control message telling a resilient client about the TCP leg.
+type targetStatus struct {
+	Type    string `json:"type"` // always "target"
+	State   string `json:"state"`
+	Target  string `json:"target"`
+	Error   string `json:"error,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	DownMs  int64  `json:"downMs,omitempty"`
+	Dropped int64  `json:"dropped,omitempty"`
+}
+
+// proxyResilient runs a /ws session that survives drops of the TCP target.
+// When the target goes away the WebSocket is kept open, the client is told
+// the target is down, and the bridge reconnects with exponential backoff
+// until the target is back or opts.GiveUp expires. Client data sent while the
+// target is down is dropped and reported in the "up" message.
+func proxyResilient(wsConn *wsNetConn, tcpConn net.Conn, target string, reconnect func() (net.Conn, error), opts wsOptions) error {
+	var mu sync.Mutex
+	current := tcpConn
+	var dropped int64
+
+	// ws -> tcp, always towards the current connection
+	wsErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := wsConn.Read(buf)
+			if err != nil {
+				wsErr <- err
+				return
+			}
+			mu.Lock()
+			conn := current
+			if conn == nil {
+				dropped += int64(n)
+			}
+			mu.Unlock()
+			if conn == nil {
+				continue
+			}
+			var dst io.Writer = conn
+			if opts.Pacing.enabled() {
+				dst = &pacedWriter{w: conn, pacing: opts.Pacing}
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				// the tcp -> ws side notices the broken connection
+				_ = conn.Close()
+			}
+		}
+	}()
+
+	for {
+		// tcp -> ws until the target connection fails
+		tcpErr := make(chan error, 1)
+		go func(conn net.Conn) {
+			tcpErr <- copyTcpToWs(wsConn, conn, opts.Framer, opts.Tuning)
+		}(current)
+
+		var downErr error
+		select {
+		case err := <-wsErr:
+			mu.Lock()
+			_ = current.Close()
+			mu.Unlock()
+			return err
+		case downErr = <-tcpErr:
+		}
+		if downErr == nil {
+			downErr = io.EOF
+		}
+
+		mu.Lock()
+		_ = current.Close()
+		current = nil
+		dropped = 0
+		mu.Unlock()
+
+		downSince := time.Now()
+		log.Printf("[websocket] target %s down: %v, reconnecting\n", target, downErr)
+		if err := wsConn.WriteJSON(targetStatus{Type: "target", State: TARGET_DOWN, Target: target, Error: downErr.Error()}); err != nil {
+			return err
+		}
+
+		delay := RECONNECT_MIN_DELAY
+		var conn net.Conn
+		for attempt := 1; conn == nil; attempt++ {
+			select {
+			case err := <-wsErr:
+				return err
+			case <-time.After(delay):
+			}
+			var err error
+			conn, err = reconnect()
+			if err == nil {
+				break
+			}
+			if opts.GiveUp > 0 && time.Since(downSince) >= opts.GiveUp {
+				log.Printf("[websocket] giving up on %s after %d attempts: %v\n", target, attempt, err)
+				_ = wsConn.WriteJSON(targetStatus{Type: "target", State: TARGET_GIVEUP, Target: target, Error: err.Error(), Attempt: attempt})
+				code, reason := classifyDialError(err)
+				closeWebSocket(wsConn.ws, target, code, reason)
+				return err
+			}
+			if debugMode {
+				log.Printf("[websocket] reconnect %d to %s failed: %v\n", attempt, target, err)
+			}
+			delay *= 2
+			if delay > RECONNECT_MAX_DELAY {
+				delay = RECONNECT_MAX_DELAY
+			}
+		}
+
+		mu.Lock()
+		current = conn
+		lost := dropped
+		mu.Unlock()
+
+		downMs := time.Since(downSince).Milliseconds()
+		log.Printf("[websocket] target %s back after %d ms\n", target, downMs)
+		if err := wsConn.WriteJSON(targetStatus{Type: "target", State: TARGET_UP, Target: target, DownMs: downMs, Dropped: lost}); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Settings for resolving .local /ws targets through the bridge's own mDNS
+// queries instead of the system resolver, which often can't inside Docker or
+// the Home Assistant add-on.
+const (
+	MDNS_RESOLVE_TIMEOUT = 1500 * time.Millisecond
+	MDNS_CACHE_MIN_TTL   = 10 * time.Second
+	MDNS_CACHE_MAX_TTL   = 2 * time.Minute
+	MDNS_NEGATIVE_TTL    = 5 * time.Second
+	MDNS_CACHE_MAX_SIZE  = 256
+)
+
+var (
+	mdnsIPv4Group = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+	mdnsIPv6Group = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+type mdnsHostEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+var (
+	mdnsHostCache   = make(map[string]mdnsHostEntry)
+	mdnsHostCacheMu sync.Mutex
+)
+
+// normalizeTargetHost strips the brackets of an IPv6 literal and checks that
+// the zone of a link-local address names an existing interface.
+func normalizeTargetHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if !strings.Contains(host, ":") {
+		return host, nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	if zone := addr.Zone(); zone != "" {
+		if _, err := zoneInterface(zone); err != nil {
+			return "", err
+		}
+	}
+	return addr.String(), nil
+}
+
+// zoneInterface returns the interface named (or numbered) by an IPv6 zone.
+func zoneInterface(zone string) (*net.Interface, error) {
+	if index, err := strconv.Atoi(zone); err == nil {
+		if iface, err := net.InterfaceByIndex(index); err == nil {
+			return iface, nil
+		}
+	} else if iface, err := net.InterfaceByName(zone); err == nil {
+		return iface, nil
+	}
+	return nil, fmt.Errorf("unknown interface %q in IPv6 zone", zone)
+}
+
+// parseTargetIP parses an IP literal, including IPv6 addresses with a zone.
+func parseTargetIP(host string) (net.IPAddr, bool) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return net.IPAddr{}, false
+	}
+	return net.IPAddr{IP: net.IP(addr.AsSlice()), Zone: addr.Zone()}, true
+}
+
+// isMdnsHost reports whether host is a multicast DNS name.
+func isMdnsHost(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".local")
+}
+
+// lookupTargetIPs resolves a /ws target host. IP literals are returned as-is,
+// .local names go through mDNS first and everything else through the system
+// resolver.
+func lookupTargetIPs(host string) ([]net.IPAddr, error) {
+	if ip, ok := parseTargetIP(host); ok {
+		return []net.IPAddr{ip}, nil
+	}
+	if isMdnsHost(host) {
+		addrs, err := resolveMdnsHost(host)
+		if err == nil {
+			return addrs, nil
+		}
+		// nss-mdns or a DNS server may still know the name
+		if sys, sysErr := net.LookupIP(host); sysErr == nil && len(sys) > 0 {
+			return ipAddrs(sys), nil
+		}
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return ipAddrs(ips), nil
+}
+
+// resolveDialTarget returns host:port with a .local host replaced by its
+// mDNS address, so the dial doesn't depend on the system resolver.
+func resolveDialTarget(host string, port int) (string, error) {
+	if !isMdnsHost(host) {
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	addrs, err := lookupTargetIPs(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0].String(), strconv.Itoa(port)), nil
+}
+
+// resolveMdnsHost answers from the cache or queries the network for the A and
+// AAAA records of a .local name. Addresses are ordered by sortAddrs.
+func resolveMdnsHost(host string) ([]net.IPAddr, error) {
+	name := strings.ToLower(dns.Fqdn(host))
+
+	mdnsHostCacheMu.Lock()
+	entry, ok := mdnsHostCache[name]
+	mdnsHostCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		if len(entry.addrs) == 0 {
+			return nil, &net.DNSError{Err: "no mDNS response", Name: host, IsNotFound: true}
+		}
+		return entry.addrs, nil
+	}
+
+	addrs, ttl, err := queryMdnsHost(name, MDNS_RESOLVE_TIMEOUT)
+	if err != nil {
+		if debugMode {
+			log.Printf("[mdns] resolving %s failed: %v\n", host, err)
+		}
+		storeMdnsHost(name, mdnsHostEntry{expires: time.Now().Add(MDNS_NEGATIVE_TTL)})
+		return nil, &net.DNSError{Err: "no mDNS response", Name: host, IsNotFound: true}
+	}
+	addrs = sortAddrs(addrs)
+	cacheMdnsHost(name, addrs, ttl)
+	log.Printf("[mdns] resolved %s to %v\n", host, addrs)
+	return addrs, nil
+}
+
+// cacheMdnsHost stores the addresses of a .local name, e.g. from a discovery scan.
+func cacheMdnsHost(name string, addrs []net.IPAddr, ttl time.Duration) {
+	if len(addrs) == 0 {
+		return
+	}
+	if ttl < MDNS_CACHE_MIN_TTL {
+		ttl = MDNS_CACHE_MIN_TTL
+	}
+	if ttl > MDNS_CACHE_MAX_TTL {
+		ttl = MDNS_CACHE_MAX_TTL
+	}
+	storeMdnsHost(strings.ToLower(dns.Fqdn(name)), mdnsHostEntry{addrs: sortAddrs(addrs), expires: time.Now().Add(ttl)})
+}
+
+// storeMdnsHost adds a cache entry. Expired entries are dropped first; a
+// full cache evicts the entry that expires soonest, so names sent by /ws
+// clients can't grow it without bound.
+func storeMdnsHost(name string, entry mdnsHostEntry) {
+	mdnsHostCacheMu.Lock()
+	defer mdnsHostCacheMu.Unlock()
+	now := time.Now()
+	for key, e := range mdnsHostCache {
+		if now.After(e.expires) {
+			delete(mdnsHostCache, key)
+		}
+	}
+	if _, exists := mdnsHostCache[name]; !exists && len(mdnsHostCache) >= MDNS_CACHE_MAX_SIZE {
+		oldest := ""
+		for key, e := range mdnsHostCache {
+			if oldest == "" || e.expires.Before(mdnsHostCache[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(mdnsHostCache, oldest)
+	}
+	mdnsHostCache[name] = entry
+}
+
+// queryMdnsHost sends a one-shot mDNS query (RFC 6762 section 5.1) on every
+// multicast interface and returns the addresses of the first answer.
+// Link-local IPv6 answers get the zone of the interface they arrived on.
+func queryMdnsHost(name string, timeout time.Duration) ([]net.IPAddr, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Question = append(msg.Question, dns.Question{Name: name, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	msg.RecursionDesired = false
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ifaces := multicastInterfaces()
+	type answer struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+	}
+	answers := make(chan answer, 2)
+	deadline := time.Now().Add(timeout)
+	var sent int
+
+	if conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero}); err == nil {
+		defer conn.Close()
+		pc := ipv4.NewPacketConn(conn)
+		for i := range ifaces {
+			if pc.SetMulticastInterface(&ifaces[i]) == nil {
+				if _, err := conn.WriteTo(query, mdnsIPv4Group); err == nil {
+					sent++
+				}
+			}
+		}
+		go func() {
+			addrs, ttl := readMdnsAnswers(conn, msg.Id, name, deadline)
+			answers <- answer{addrs, ttl}
+		}()
+	} else {
+		answers <- answer{}
+	}
+
+	if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified}); err == nil {
+		defer conn.Close()
+		pc := ipv6.NewPacketConn(conn)
+		for i := range ifaces {
+			if pc.SetMulticastInterface(&ifaces[i]) == nil {
+				dst := &net.UDPAddr{IP: mdnsIPv6Group.IP, Port: mdnsIPv6Group.Port, Zone: ifaces[i].Name}
+				if _, err := conn.WriteTo(query, dst); err == nil {
+					sent++
+				}
+			}
+		}
+		go func() {
+			addrs, ttl := readMdnsAnswers(conn, msg.Id, name, deadline)
+			answers <- answer{addrs, ttl}
+		}()
+	} else {
+		answers <- answer{}
+	}
+
+	if sent == 0 {
+		return nil, 0, fmt.Errorf("no multicast interface to send the query on")
+	}
+	for i := 0; i < 2; i++ {
+		if a := <-answers; len(a.addrs) > 0 {
+			return a.addrs, a.ttl, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no answer within %v", timeout)
+}
+
+// readMdnsAnswers waits for the response to query id and collects its addresses.
+func readMdnsAnswers(conn *net.UDPConn, id uint16, name string, deadline time.Time) ([]net.IPAddr, time.Duration) {
+	_ = conn.SetReadDeadline(deadline)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, 0
+		}
+		var resp dns.Msg
+		if resp.Unpack(buf[:n]) != nil || !resp.Response || resp.Id != id {
+			continue
+		}
+		var addrs []net.IPAddr
+		var ttl uint32
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			switch r := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: r.A})
+			case *dns.AAAA:
+				a := net.IPAddr{IP: r.AAAA}
+				if r.AAAA.IsLinkLocalUnicast() {
+					if src.Zone == "" {
+						continue
+					}
+					a.Zone = src.Zone
+				}
+				addrs = append(addrs, a)
+			default:
+				continue
+			}
+			if ttl == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, time.Duration(ttl) * time.Second
+		}
+	}
+}
+
+// multicastInterfaces lists the interfaces mDNS queries are sent on.
+func multicastInterfaces() []net.Interface {
+	_, _, ifaces := selectMdnsInterfaces()
+	return ifaces
+}
+
+func ipAddrs(ips []net.IP) []net.IPAddr {
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTargetHost(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skip("no network interfaces")
+	}
+	zone := ifaces[0].Name
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "192.168.1.5", want: "192.168.1.5"},
+		{host: "zigstar.local", want: "zigstar.local"},
+		{host: "[fd00::1]", want: "fd00::1"},
+		{host: "FD00:0:0::1", want: "fd00::1"},
+		{host: "fe80::1%" + zone, want: "fe80::1%" + zone},
+		{host: "fe80::1%no-such-iface0", wantErr: true},
+		{host: "fd00::zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTargetHost(tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeTargetHost(%q) = %q, want error", tt.host, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeTargetHost(%q) = %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+}
+
+func TestMdnsHostCacheIsBounded(t *testing.T) {
+	mdnsHostCacheMu.Lock()
+	saved := mdnsHostCache
+	mdnsHostCache = make(map[string]mdnsHostEntry)
+	mdnsHostCacheMu.Unlock()
+	defer func() {
+		mdnsHostCacheMu.Lock()
+		mdnsHostCache = saved
+		mdnsHostCacheMu.Unlock()
+	}()
+
+	storeMdnsHost("expired.local.", mdnsHostEntry{expires: time.Now().Add(-time.Second)})
+	for i := 0; i < MDNS_CACHE_MAX_SIZE*2; i++ {
+		storeMdnsHost(fmt.Sprintf("host-%d.local.", i), mdnsHostEntry{expires: time.Now().Add(time.Minute + time.Duration(i)*time.Millisecond)})
+	}
+	cacheMdnsHost("zigstar.local", []net.IPAddr{{IP: net.ParseIP("192.168.1.5")}}, time.Minute)
+
+	mdnsHostCacheMu.Lock()
+	defer mdnsHostCacheMu.Unlock()
+	if len(mdnsHostCache) > MDNS_CACHE_MAX_SIZE {
+		t.Errorf("cache holds %d entries", len(mdnsHostCache))
+	}
+	if _, ok := mdnsHostCache["expired.local."]; ok {
+		t.Error("expired entry kept")
+	}
+	if _, ok := mdnsHostCache["zigstar.local."]; !ok {
+		t.Error("newest entry evicted")
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -19,7 +23,7 @@ func setupRoutes(e *echo.Echo) {
 			c.Response().Header().Set("Access-Control-Allow-Origin", "*")
 			c.Response().Header().Set("Access-Control-Allow-Credentials", "true")
 			c.Response().Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-			c.Response().Header().Set("Access-Control-Allow-Headers", "Content-Type,Accept,Origin,X-Requested-With,Authorization")
+			c.Response().Header().Set("Access-Control-Allow-Headers", "Content-Type,Accept,Origin,X-Requested-With,Authorization,X-API-Key")
 			c.Response().Header().Set("Access-Control-Allow-Private-Network", "true")
 			c.Response().Header().Set("Access-Control-Max-Age", "86400")
 
@@ -32,20 +36,43 @@ func setupRoutes(e *echo.Echo) {
 	})
 
 	// WebSocket upgrade handlers
-	e.GET("/ws", handleWebSocketUpgrade)
-	e.GET("/connect", handleWebSocketUpgrade)
+	e.GET("/ws", handleWebSocketUpgrade, requireAuth)
+	e.GET("/connect", handleWebSocketUpgrade, requireAuth)
 
-	// mDNS discovery endpoint
-	e.GET("/mdns", handleMdnsScan)
+	// mDNS discovery endpoints
+	mdnsLimit := rateLimit(mdnsRate)
+	e.GET("/mdns", handleMdnsScan, mdnsLimit, requireAuth)
+	e.GET("/mdns/stream", handleMdnsStream, mdnsLimit, requireAuth)
 
 	// Serial control endpoint
-	e.GET("/sc", handleSerialControl)
+	e.GET("/sc", handleSerialControl, rateLimit(scRate), requireAuth)
+
+	// Baud rate and protocol auto-detection endpoint
+	e.GET("/probe", handleSerialProbe, requireAuth)
 
 	// GPIO control endpoint
-	e.GET("/gpio", handleGpioControl)
+	e.GET("/gpio", handleGpioControl, requireAuth)
 
 	// GPIO list endpoint
-	e.GET("/gl", handleGpioList)
+	e.GET("/gl", handleGpioList, requireAuth)
+
+	// Session recording and replay endpoints
+	e.GET("/recordings", handleRecordingList, requireAuth)
+	e.GET("/recordings/download", handleRecordingDownload, requireAuth)
+	e.GET("/replay", handleReplay, requireAuth)
+
+	// Active session list and termination endpoints
+	e.GET("/sessions", handleSessionList, requireAuth)
+	e.GET("/sessions/kill", handleSessionKill, requireAuth)
+
+	// TLS certificate fingerprint endpoint
+	e.GET("/cert", handleCertInfo)
+
+	// Device profiles used to classify /mdns results
+	e.GET("/profiles", handleProfileList, requireAuth)
+
+	// Version, features and the interfaces in use
+	e.GET("/version", handleVersion, requireAuth)
 
 	// Static file serving
 	e.GET("/*", handleStaticFiles)
@@ -64,12 +91,27 @@ func handleWebSocketUpgrade(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusBadRequest, "Invalid port parameter")
 	}
+	host, err = normalizeTargetHost(host)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	opts, err := parseWsOptions(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	// Check the target against the configured policy; a blocked target is
+	// reported with a close code after the upgrade, so the UI can show why
+	dialTarget, policyErr := checkTarget(host, port)
+	opts.DialTarget = dialTarget
+	opts.LocalSerial = opts.Proto == PROTO_TCP && isLocalSerialTarget(host, port)
+	opts.ClientAddr = c.RealIP()
+	opts.Record = c.QueryParam("record") == "1" || c.QueryParam("record") == "true"
 
 	// Upgrade to WebSocket
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins
-		},
+		CheckOrigin: checkWebSocketOrigin,
 	}
 
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
@@ -78,17 +120,178 @@ func handleWebSocketUpgrade(c echo.Context) error {
 	}
 	defer ws.Close()
 
+	if policyErr != nil {
+		log.Printf("[websocket] blocked %s: %v\n", c.RealIP(), policyErr)
+		code := CLOSE_POLICY
+		var dnsErr *net.DNSError
+		if errors.As(policyErr, &dnsErr) {
+			code = CLOSE_DNS
+		}
+		closeWebSocket(ws, net.JoinHostPort(host, portStr), code, policyErr.Error())
+		return nil
+	}
+
+	var serialPath string
+	if opts.LocalSerial {
+		serialPath = getSerialPathFromTcpPort(port)
+		// the serial server leaves recording of /ws sessions to this side
+		if serialPath != "" && getSerialPortOptions(serialPath).Record {
+			opts.Record = true
+		}
+	}
+	release, err := reserveSession(opts.ClientAddr, net.JoinHostPort(host, strconv.Itoa(port)), serialPath)
+	if err != nil {
+		closeWebSocket(ws, net.JoinHostPort(host, portStr), CLOSE_LIMIT, err.Error())
+		return nil
+	}
+	defer release()
+
 	// Handle WebSocket connection
-	handleWebSocketConnection(ws, host, port)
+	handleWebSocketConnection(ws, host, port, opts)
 
 	return nil
 }
 
+// parseWsOptions reads the optional per-session settings of /ws and /connect.
+func parseWsOptions(c echo.Context) (wsOptions, error) {
+	var opts wsOptions
+
+	if framer := c.QueryParam("framer"); framer != "" {
+		if _, err := newFramer(framer); err != nil {
+			return opts, err
+		}
+		opts.Framer = framer
+	}
+
+	opts.Reassemble = "ti-bsl"
+	if reassemble := c.QueryParam("reassemble"); reassemble != "" {
+		if _, err := newReassembler(reassemble); err != nil {
+			return opts, err
+		}
+		opts.Reassemble = reassemble
+	}
+
+	chunk, err := parseNonNegativeInt(c.QueryParam("chunk"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid chunk parameter")
+	}
+	delay, err := parseNonNegativeInt(c.QueryParam("delay"))
+	if err != nil || delay > MAX_CHUNK_DELAY_MS {
+		return opts, fmt.Errorf("invalid delay parameter (0-%d ms)", MAX_CHUNK_DELAY_MS)
+	}
+	opts.Pacing = WritePacing{
+		ChunkSize:  chunk,
+		ChunkDelay: time.Duration(delay) * time.Millisecond,
+	}
+
+	opts.Resilient = c.QueryParam("resilient") == "1" || c.QueryParam("resilient") == "true"
+	opts.GiveUp = DEFAULT_GIVE_UP
+	if giveUpStr := c.QueryParam("giveup"); giveUpStr != "" {
+		giveUp, err := parseNonNegativeInt(giveUpStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid giveup parameter")
+		}
+		opts.GiveUp = time.Duration(giveUp) * time.Millisecond
+	}
+
+	opts.DialTimeout = time.Duration(dialTimeoutMs) * time.Millisecond
+	if timeoutStr := c.QueryParam("dialtimeout"); timeoutStr != "" {
+		timeout, err := parseNonNegativeInt(timeoutStr)
+		if err != nil || timeout == 0 {
+			return opts, fmt.Errorf("invalid dialtimeout parameter")
+		}
+		opts.DialTimeout = time.Duration(timeout) * time.Millisecond
+	}
+
+	opts.Tuning, err = parseTuning(c.QueryParam("mode"), c.QueryParam("coalesce"), c.QueryParam("rbuf"), c.QueryParam("maxframe"))
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Mux = c.QueryParam("mux") == "1" || c.QueryParam("mux") == "true"
+	if opts.Mux && opts.Resilient {
+		return opts, fmt.Errorf("mux and resilient cannot be combined")
+	}
+
+	if err := parseUdpOptions(c.QueryParam("proto"), c.QueryParam("bind"), c.QueryParam("mcast"), &opts); err != nil {
+		return opts, err
+	}
+	if opts.Proto == PROTO_UDP && (opts.Framer != "" || opts.Pacing.enabled() || c.QueryParam("reassemble") != "" || opts.Resilient || opts.Mux) {
+		return opts, fmt.Errorf("framer, reassemble, chunk, delay, resilient and mux are not supported with proto=udp")
+	}
+
+	return opts, nil
+}
+
+// parseNonNegativeInt parses an optional numeric query value; empty means 0.
+func parseNonNegativeInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
 func handleMdnsScan(c echo.Context) error {
+	normalizedTypes, wantsLocalSerial, timeout := parseMdnsRequest(c)
+
+	var results []ServiceInfo
+
+	// Answer mDNS services from the background browser; new types and
+	// refresh=1 wait up to timeout for an active query
+	if len(normalizedTypes) > 0 {
+		if b := mdnsBrowserInstance; b != nil {
+			refresh := c.QueryParam("refresh") == "1" || c.QueryParam("refresh") == "true"
+			added := b.requestTypes(normalizedTypes)
+			if refresh && !added {
+				b.queryTypes(normalizedTypes)
+			}
+			if added || refresh {
+				select {
+				case <-time.After(time.Duration(timeout) * time.Millisecond):
+				case <-c.Request().Context().Done():
+				}
+			}
+			results = b.services(normalizedTypes)
+		} else {
+			results = scanMdns(normalizedTypes, timeout)
+		}
+	}
+
+	// Add local serial services
+	var peers []PeerStatus
+	if wantsLocalSerial {
+		scanAndSyncSerialPorts()
+		locals := listLocalSerialAsServices()
+		results = append(results, locals...)
+		results = append(results, listReplaysAsServices()...)
+		if f := federationInstance; f != nil && c.QueryParam("peers") != "0" {
+			results = append(results, f.services()...)
+			peers = f.status()
+		}
+	}
+
+	classifyServices(results)
+	response := map[string]interface{}{
+		"bridge":  bridgeIdentity{ID: bridgeID, Name: getBridgeInstanceName()},
+		"devices": results,
+	}
+	if peers != nil {
+		response["peers"] = peers
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// parseMdnsRequest reads the types and timeout parameters of /mdns and /mdns/stream.
+func parseMdnsRequest(c echo.Context) (normalizedTypes []ServiceType, wantsLocalSerial bool, timeout int) {
 	typesParam := c.QueryParam("types")
 	timeoutStr := c.QueryParam("timeout")
 
-	timeout := 2000 // default timeout
+	timeout = 2000 // default timeout
 	if timeoutStr != "" {
 		if t, err := strconv.Atoi(timeoutStr); err == nil {
 			timeout = t
@@ -103,9 +306,6 @@ func handleMdnsScan(c echo.Context) error {
 	}
 
 	types := strings.Split(typesParam, ",")
-	var normalizedTypes []ServiceType
-	var wantsLocalSerial bool
-
 	for _, t := range types {
 		t = strings.TrimSpace(t)
 		if t == "" {
@@ -120,26 +320,7 @@ func handleMdnsScan(c echo.Context) error {
 			}
 		}
 	}
-
-	var results []ServiceInfo
-
-	// Scan mDNS services
-	if len(normalizedTypes) > 0 {
-		results = scanMdns(normalizedTypes, timeout)
-	}
-
-	// Add local serial services
-	if wantsLocalSerial {
-		scanAndSyncSerialPorts()
-		locals := listLocalSerialAsServices()
-		results = append(results, locals...)
-	}
-
-	response := map[string]interface{}{
-		"devices": results,
-	}
-
-	return c.JSON(http.StatusOK, response)
+	return normalizedTypes, wantsLocalSerial, timeout
 }
 
 func handleGpioControl(c echo.Context) error {
@@ -237,6 +418,22 @@ func handleSerialControl(c echo.Context) error {
 	dtrStr := c.QueryParam("dtr")
 	rtsStr := c.QueryParam("rts")
 	baudStr := c.QueryParam("baud")
+	framerStr := c.QueryParam("framer")
+	chunkStr := c.QueryParam("chunk")
+	delayStr := c.QueryParam("delay")
+	drainStr := c.QueryParam("drain")
+	echoStr := c.QueryParam("echo")
+	recordStr := c.QueryParam("record")
+	busyStr := c.QueryParam("busy")
+
+	// A relayed port of a peer bridge is controlled by the peer
+	if path == "" && tcpPortStr != "" {
+		if tcpPort, err := strconv.Atoi(tcpPortStr); err == nil {
+			if p := findPeerProxy(tcpPort); p != nil {
+				return forwardPeerControl(c, p)
+			}
+		}
+	}
 
 	// Get path from TCP port if not provided directly
 	if path == "" && tcpPortStr != "" {
@@ -245,9 +442,41 @@ func handleSerialControl(c echo.Context) error {
 		}
 	}
 
-	if path == "" || (dtrStr == "" && rtsStr == "" && baudStr == "") {
+	// Control of a replayed recording is accepted but has no effect
+	tcpPort, _ := strconv.Atoi(tcpPortStr)
+	if rp := getReplay(path, tcpPort); rp != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"ok":      true,
+			"path":    rp.Path,
+			"tcpPort": rp.Port,
+			"replay":  true,
+		})
+	}
+
+	hasOptions := framerStr != "" || chunkStr != "" || delayStr != "" || drainStr != "" || echoStr != "" || recordStr != ""
+	if path == "" || (dtrStr == "" && rtsStr == "" && baudStr == "" && busyStr == "" && !hasOptions) {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Missing path/tcpPort or dtr/rts/baud param",
+			"error": "Missing path/tcpPort or dtr/rts/baud/busy/framer/chunk/delay/drain/echo/record param",
+		})
+	}
+
+	if framerStr != "" && !isValidFramer(framerStr) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "Invalid framer",
+			"framers": append([]string{"none"}, framerNames...),
+		})
+	}
+
+	chunk, err := parseNonNegativeInt(chunkStr)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid chunk size",
+		})
+	}
+	delay, err := parseNonNegativeInt(delayStr)
+	if err != nil || delay > MAX_CHUNK_DELAY_MS {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid delay (0-%d ms)", MAX_CHUNK_DELAY_MS),
 		})
 	}
 
@@ -302,6 +531,33 @@ func handleSerialControl(c echo.Context) error {
 
 	setSerialPortState(path, setObj)
 
+	// Update forwarding options
+	options := getSerialPortOptions(path)
+	if framerStr != "" {
+		options.Framer = strings.ToLower(framerStr)
+		if options.Framer == "none" {
+			options.Framer = ""
+		}
+	}
+	if chunkStr != "" {
+		options.ChunkSize = chunk
+	}
+	if delayStr != "" {
+		options.ChunkDelayMs = delay
+	}
+	if drainStr != "" {
+		options.WaitDrain = drainStr == "1" || drainStr == "true"
+	}
+	if echoStr != "" {
+		options.EchoCancel = echoStr == "1" || echoStr == "true"
+	}
+	if recordStr != "" {
+		options.Record = recordStr == "1" || recordStr == "true"
+	}
+	if hasOptions {
+		setSerialPortOptions(path, options)
+	}
+
 	// Apply DTR/RTS if they were changed
 	if dtrStr != "" || rtsStr != "" {
 		// Use ensureSerialPort to safely get or open the port
@@ -326,16 +582,118 @@ func handleSerialControl(c echo.Context) error {
 		}
 	}
 
+	// Add the change to recorded sessions on this port
+	if dtrStr != "" || rtsStr != "" || baud > 0 {
+		var dtr, rts *bool
+		if dtrStr != "" {
+			dtr = &setObj.DTR
+		}
+		if rtsStr != "" {
+			rts = &setObj.RTS
+		}
+		recordSerialControl(path, dtr, rts, baud)
+	}
+
+	// A flash in progress keeps the port's sessions open during shutdown
+	if busyStr != "" {
+		setPortBusy(path, busyStr == "1" || busyStr == "true")
+	}
+
 	response := map[string]interface{}{
 		"ok":      true,
 		"path":    path,
 		"tcpPort": getTcpPortFromPath(path),
 		"set":     setObj,
+		"options": options,
+	}
+	if busyStr != "" {
+		response["busy"] = busyStr == "1" || busyStr == "true"
+	}
+	if options.EchoCancel {
+		response["echo"] = getSerialEchoStats(path).snapshot()
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
+func handleSerialProbe(c echo.Context) error {
+	path := c.QueryParam("path")
+	tcpPortStr := c.QueryParam("port")
+	ratesStr := c.QueryParam("rates")
+	protocolsStr := c.QueryParam("protocols")
+	timeoutStr := c.QueryParam("timeout")
+
+	// Get path from TCP port if not provided directly
+	if path == "" && tcpPortStr != "" {
+		if tcpPort, err := strconv.Atoi(tcpPortStr); err == nil {
+			path = getSerialPathFromTcpPort(tcpPort)
+		}
+	}
+
+	if path == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing path/tcpPort param",
+		})
+	}
+
+	rates := defaultProbeRates
+	if ratesStr != "" {
+		rates = nil
+		for _, r := range strings.Split(ratesStr, ",") {
+			rate, err := strconv.Atoi(strings.TrimSpace(r))
+			if err != nil || !isValidBaudRate(rate) {
+				return c.JSON(http.StatusBadRequest, map[string]interface{}{
+					"error":      "Invalid baud rate",
+					"validRates": validRates,
+				})
+			}
+			rates = append(rates, rate)
+		}
+	}
+
+	var protocols []string
+	if protocolsStr != "" {
+		known := probeNames()
+		for _, p := range strings.Split(protocolsStr, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			valid := false
+			for _, k := range known {
+				if p == k {
+					valid = true
+				}
+			}
+			if !valid {
+				return c.JSON(http.StatusBadRequest, map[string]interface{}{
+					"error":     "Invalid protocol",
+					"protocols": known,
+				})
+			}
+			protocols = append(protocols, p)
+		}
+	}
+
+	timeout := 300 // per probe, ms
+	if timeoutStr != "" {
+		if t, err := strconv.Atoi(timeoutStr); err == nil {
+			timeout = t
+		}
+	}
+	if timeout < 50 {
+		timeout = 50
+	} else if timeout > 2000 {
+		timeout = 2000
+	}
+
+	result, err := probeSerialPort(path, rates, protocols, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
 func handleStaticFiles(c echo.Context) error {
 	path := c.Request().URL.Path
 
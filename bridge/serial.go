@@ -17,6 +17,7 @@ import (
 type SerialPortInfo struct {
 	Path         string
 	Manufacturer string
+	Product      string
 	SerialNumber string
 	VendorID     string
 	ProductID    string
@@ -28,6 +29,25 @@ type SerialState struct {
 	BaudRate int
 }
 
+// SerialOptions holds per-port forwarding options. They are applied to
+// TCP client connections opened after the options were changed.
+type SerialOptions struct {
+	Framer       string `json:"framer,omitempty"`
+	ChunkSize    int    `json:"chunkSize,omitempty"`
+	ChunkDelayMs int    `json:"chunkDelayMs,omitempty"`
+	WaitDrain    bool   `json:"drain,omitempty"`
+	EchoCancel   bool   `json:"echoCancel,omitempty"`
+	Record       bool   `json:"record,omitempty"`
+}
+
+func (o SerialOptions) pacing() WritePacing {
+	return WritePacing{
+		ChunkSize:  o.ChunkSize,
+		ChunkDelay: time.Duration(o.ChunkDelayMs) * time.Millisecond,
+		WaitDrain:  o.WaitDrain,
+	}
+}
+
 type ServerInfo struct {
 	Server net.Listener
 	Port   int
@@ -38,12 +58,18 @@ var (
 	serialPortRefCount  = make(map[string]int)
 	tcpPortToSerialPath = make(map[int]string)
 	serialPortStates    = make(map[string]SerialState)
+	serialPortOptions   = make(map[string]SerialOptions)
+	serialEchoStats     = make(map[string]*EchoStats)
 	serialServers       = make(map[string]ServerInfo)
 	serialPortDetails   = make(map[string]SerialPortInfo)
 	serialMutex         sync.RWMutex
 	portLocks           sync.Map
 )
 
+// SERIAL_READ_TIMEOUT bounds a single serial read so forwarding loops can
+// check for closed sessions and flush incomplete frames.
+const SERIAL_READ_TIMEOUT = 100 * time.Millisecond
+
 var validRates = []int{9600, 19200, 38400, 57600, 115200, 230400, 460800, 500000}
 
 func isValidBaudRate(baud int) bool {
@@ -55,8 +81,13 @@ func isValidBaudRate(baud int) bool {
 	return false
 }
 
+// usbPortDetails enumerates the USB details (VID/PID, serial number, product)
+// of serial ports by path.
+var usbPortDetails = enumerateUSBPorts
+
 func listSerialPorts() []SerialPortInfo {
 	var ports []SerialPortInfo
+	details := usbPortDetails()
 
 	// Try library-provided list first
 	portList, err := serial.GetPortsList()
@@ -72,6 +103,17 @@ func listSerialPorts() []SerialPortInfo {
 		}
 	}
 
+	// ports the enumerator found with USB details but the list missed
+	listed := make(map[string]bool)
+	for _, p := range portList {
+		listed[p] = true
+	}
+	for name := range details {
+		if !listed[name] {
+			portList = append(portList, name)
+		}
+	}
+
 	// If portList is not empty, use only it; otherwise, collect from /dev globs
 	if len(portList) == 0 {
 		// Always supplement library-provided list with common /dev globs so
@@ -122,9 +164,16 @@ func listSerialPorts() []SerialPortInfo {
 		}
 		seenPorts[portName] = true
 
-		info := SerialPortInfo{
-			Path:         portName,
-			Manufacturer: "Unknown",
+		info, ok := details[portName]
+		if !ok {
+			// e.g. a /dev/serial/by-id link to an enumerated port
+			if resolved, err := filepath.EvalSymlinks(portName); err == nil {
+				info = details[resolved]
+			}
+		}
+		info.Path = portName
+		if info.Manufacturer == "" {
+			info.Manufacturer = "Unknown"
 		}
 		ports = append(ports, info)
 	}
@@ -161,6 +210,8 @@ func rawOpenSerialPort(path string, baudRate int) serial.Port {
 		log.Printf("[serial] failed to open port %s: %v\n", path, err)
 		return nil
 	}
+	// readers wake up regularly to notice closed sessions and stale frames
+	_ = port.SetReadTimeout(SERIAL_READ_TIMEOUT)
 
 	if debugMode {
 		log.Printf("[serial] successfully opened serial port %s at %d baud\n", path, baudRate)
@@ -218,6 +269,45 @@ func ensureSerialPort(path string, baudRate int) (serial.Port, error) {
 
 }
 
+// acquireSerialPort opens the port with its stored state and takes a
+// reference for a streaming client. It returns the new reference count.
+func acquireSerialPort(path string) (serial.Port, int, error) {
+	// Get current baud rate and control-line state from stored state
+	currentState := getSerialPortState(path)
+	port, err := ensureSerialPort(path, currentState.BaudRate)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	serialMutex.Lock()
+	defer serialMutex.Unlock()
+	serialPortRefCount[path]++
+	return port, serialPortRefCount[path], nil
+}
+
+// releaseSerialPort drops a reference taken by acquireSerialPort and closes
+// the port if this was the last one.
+func releaseSerialPort(path string) {
+	serialMutex.Lock()
+	defer serialMutex.Unlock()
+	if cnt, ok := serialPortRefCount[path]; ok {
+		if cnt <= 1 {
+			// last reference: remove and close port to unblock readers
+			delete(serialPortRefCount, path)
+			if p, exists := openSerialPorts[path]; exists {
+				if debugMode {
+					log.Printf("[serial] closing serial port for %s (last ref)\n", path)
+				}
+				closeSerial(p)
+				delete(openSerialPorts, path)
+			}
+		} else {
+			serialPortRefCount[path] = cnt - 1
+			log.Printf("[serial] decremented refs for %s to %d\n", path, cnt-1)
+		}
+	}
+}
+
 func closeSerial(port serial.Port) {
 	if port != nil {
 		if debugMode {
@@ -252,6 +342,17 @@ func writeSerial(port serial.Port, data []byte) (int, error) {
 	return n, nil
 }
 
+// writeSerialPaced writes data in chunks, pausing and draining as configured.
+func writeSerialPaced(port serial.Port, data []byte, pacing WritePacing) (int, error) {
+	var drain func() error
+	if port != nil {
+		drain = port.Drain
+	}
+	return writePaced(func(b []byte) (int, error) {
+		return writeSerial(port, b)
+	}, drain, data, pacing)
+}
+
 func readSerial(port serial.Port, maxBytes int) ([]byte, error) {
 	if port == nil {
 		return nil, nil
@@ -346,6 +447,7 @@ func ensureSerialTcpServer(path string, baudRate int) (*ServerInfo, error) {
 	}
 
 	port := listener.Addr().(*net.TCPAddr).Port
+	listener = wrapSerialListener(listener)
 
 	// Handle incoming connections
 	go func() {
@@ -364,16 +466,6 @@ func ensureSerialTcpServer(path string, baudRate int) (*ServerInfo, error) {
 				continue
 			}
 
-			// Try to set TCP options (disable Nagle and increase buffers) to reduce latency
-			if tcpConn, ok := conn.(*net.TCPConn); ok {
-				// disable Nagle
-				_ = tcpConn.SetNoDelay(true)
-				// enlarge buffers a bit (ignore errors)
-				_ = tcpConn.SetReadBuffer(64 * 1024)
-				_ = tcpConn.SetWriteBuffer(64 * 1024)
-				// optional: enable keepalive to help persistent connections
-				_ = tcpConn.SetKeepAlive(true)
-			}
 			log.Printf("[serial] client connected for %s\n", path)
 
 			// Handle connection
@@ -383,22 +475,33 @@ func ensureSerialTcpServer(path string, baudRate int) (*ServerInfo, error) {
 					log.Printf("[serial] handling connection %d for %s\n", connId, path)
 				}
 
-				// Get current baud rate and control-line state from stored state
-				currentState := getSerialPortState(path)
-				currentBaudRate := currentState.BaudRate
+				if err := authenticateSerialClient(c); err != nil {
+					log.Printf("[serial] %d: rejected %s: %v\n", connId, c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+
+				// the bridge's own /ws sessions are limited, listed and recorded
+				// on the WebSocket side
+				own := isBridgeConn(c.RemoteAddr(), time.Duration(dialTimeoutMs)*time.Millisecond)
+				if !own {
+					ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+					release, err := reserveSession(ip, "", path)
+					if err != nil {
+						log.Printf("[serial] %d: rejected %s: %v\n", connId, c.RemoteAddr(), err)
+						c.Close()
+						return
+					}
+					defer release()
+				}
 
-				serialPort, err := ensureSerialPort(path, currentBaudRate)
+				serialPort, currentRefs, err := acquireSerialPort(path)
 				if err != nil {
 					log.Printf("[serial] %d: failed to get serial port: %v\n", connId, err)
 					c.Close()
 					return
 				}
 
-				serialMutex.Lock()
-				serialPortRefCount[path]++
-				currentRefs := serialPortRefCount[path]
-				serialMutex.Unlock()
-
 				if debugMode {
 					log.Printf("[serial] %d: ready for %s, refs: %d\n", connId, path, currentRefs)
 				}
@@ -406,7 +509,7 @@ func ensureSerialTcpServer(path string, baudRate int) (*ServerInfo, error) {
 				// Ensure control lines reflect desired state
 				// setSerialDTRRTS(serialPort, currentState.DTR, currentState.RTS)
 
-				handleSerialConnection(c, serialPort, path)
+				handleSerialConnection(c, serialPort, path, own)
 			}(conn)
 		}
 	}()
@@ -423,9 +526,33 @@ func ensureSerialTcpServer(path string, baudRate int) (*ServerInfo, error) {
 	return &info, nil
 }
 
-func handleSerialConnection(conn net.Conn, serialPort serial.Port, path string) {
+// handleSerialConnection forwards between a TCP client and the serial port.
+// own is set for the bridge's own /ws sessions, which are registered on the
+// WebSocket side.
+func handleSerialConnection(conn net.Conn, serialPort serial.Port, path string, own bool) {
 	defer conn.Close()
 
+	options := getSerialPortOptions(path)
+	session := &Session{}
+	if !own {
+		session = registerSession(SESSION_SERIAL, conn.RemoteAddr().String(), conn.LocalAddr().String(), path, func(int, string) {
+			_ = conn.Close()
+		})
+		defer unregisterSession(session)
+		if options.Record {
+			session.startRecording()
+		}
+	}
+	framer, err := newFramer(options.Framer)
+	if err != nil {
+		log.Printf("[serial] %v, forwarding %s unframed\n", err, path)
+	}
+	pacing := options.pacing()
+	var echo *echoCanceler
+	if options.EchoCancel {
+		echo = newEchoCanceler(getSerialEchoStats(path))
+	}
+
 	// Bidirectional data forwarding with explicit stop signalling
 	done := make(chan bool, 2) // both directions signal completion
 	stop := make(chan struct{})
@@ -433,25 +560,7 @@ func handleSerialConnection(conn net.Conn, serialPort serial.Port, path string)
 	// closeStop: close stop channel once and perform early refcount cleanup
 	closeStop := func() {
 		stopOnce.Do(func() {
-			// decrement refcount and close serial port if this was the last reference
-			serialMutex.Lock()
-			defer serialMutex.Unlock()
-			if cnt, ok := serialPortRefCount[path]; ok {
-				if cnt <= 1 {
-					// last reference: remove and close port to unblock readers
-					delete(serialPortRefCount, path)
-					if p, exists := openSerialPorts[path]; exists {
-						if debugMode {
-							log.Printf("[serial] closing serial port for %s (last ref)\n", path)
-						}
-						closeSerial(p)
-						delete(openSerialPorts, path)
-					}
-				} else {
-					serialPortRefCount[path] = cnt - 1
-					log.Printf("[serial] decremented refs for %s to %d\n", path, cnt-1)
-				}
-			}
+			releaseSerialPort(path)
 			close(stop)
 		})
 	}
@@ -459,6 +568,7 @@ func handleSerialConnection(conn net.Conn, serialPort serial.Port, path string)
 	// Serial -> TCP forwarding
 	go func() {
 		defer func() { done <- true }()
+		lastData := time.Now()
 		for {
 			select {
 			case <-stop:
@@ -475,18 +585,37 @@ func handleSerialConnection(conn net.Conn, serialPort serial.Port, path string)
 				closeStop()
 				return
 			}
+			var chunks [][]byte
 			if len(data) > 0 {
+				lastData = time.Now()
 				if debugMode {
 					log.Printf("[Serial] received %d bytes: %x\n", len(data), data)
 				}
-				if _, err := conn.Write(data); err != nil {
+				if echo != nil {
+					if data = echo.Filter(data); len(data) == 0 {
+						continue
+					}
+				}
+				chunks = [][]byte{data}
+				if framer != nil {
+					// one write per complete protocol frame
+					chunks = framer.Push(data)
+				}
+			} else if rest := flushStale(framer, lastData); len(rest) > 0 {
+				// the rest of the frame never arrived, forward it as-is
+				chunks = [][]byte{rest}
+			}
+			for _, chunk := range chunks {
+				if _, err := conn.Write(chunk); err != nil {
 					if debugMode {
 						log.Printf("[Serial] error sending to client: %v\n", err)
 					}
 					closeStop()
 					return
 				}
-			} else {
+				session.toClient(chunk)
+			}
+			if len(data) == 0 {
 				time.Sleep(1 * time.Millisecond)
 			}
 		}
@@ -513,10 +642,14 @@ func handleSerialConnection(conn net.Conn, serialPort serial.Port, path string)
 				return
 			}
 			if n > 0 {
+				session.fromClient(buffer[:n])
 				if debugMode {
 					log.Printf("[TCP] received %d bytes: %x\n", n, buffer[:n])
 				}
-				_, err := writeSerial(serialPort, buffer[:n])
+				if echo != nil {
+					echo.Transmitted(buffer[:n])
+				}
+				_, err := writeSerialPaced(serialPort, buffer[:n], pacing)
 				if err != nil {
 					if debugMode {
 						log.Printf("[TCP] error writing to serial: %v\n", err)
@@ -624,6 +757,30 @@ func setSerialPortState(path string, state SerialState) {
 	serialPortStates[path] = state
 }
 
+func getSerialPortOptions(path string) SerialOptions {
+	serialMutex.RLock()
+	defer serialMutex.RUnlock()
+	return serialPortOptions[path]
+}
+
+func setSerialPortOptions(path string, options SerialOptions) {
+	serialMutex.Lock()
+	defer serialMutex.Unlock()
+	serialPortOptions[path] = options
+}
+
+// getSerialEchoStats returns the echo suppression counters of a port, creating them on first use.
+func getSerialEchoStats(path string) *EchoStats {
+	serialMutex.Lock()
+	defer serialMutex.Unlock()
+	stats, ok := serialEchoStats[path]
+	if !ok {
+		stats = &EchoStats{}
+		serialEchoStats[path] = stats
+	}
+	return stats
+}
+
 func getTcpPortFromPath(path string) int {
 	serialMutex.RLock()
 	defer serialMutex.RUnlock()
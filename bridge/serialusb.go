@@ -0,0 +1,59 @@
+//go:build !darwin || cgo
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// enumerateUSBPorts returns the USB details of the serial ports by path.
+func enumerateUSBPorts() map[string]SerialPortInfo {
+	list, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		if debugMode {
+			log.Printf("[serial] error getting port details: %v\n", err)
+		}
+		return nil
+	}
+	details := make(map[string]SerialPortInfo)
+	for _, p := range list {
+		if !p.IsUSB {
+			continue
+		}
+		details[p.Name] = SerialPortInfo{
+			Path:         p.Name,
+			Manufacturer: sysfsManufacturer(p.Name),
+			Product:      p.Product,
+			SerialNumber: p.SerialNumber,
+			VendorID:     strings.ToUpper(p.VID),
+			ProductID:    strings.ToUpper(p.PID),
+		}
+	}
+	return details
+}
+
+// sysfsManufacturer reads the USB manufacturer string of a Linux tty, which
+// the enumerator doesn't report.
+func sysfsManufacturer(path string) string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(path), "device"))
+	if err != nil {
+		return ""
+	}
+	// walk up from the interface to the USB device
+	for ; strings.HasPrefix(dir, "/sys/"); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			data, _ := os.ReadFile(filepath.Join(dir, "manufacturer"))
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ""
+}
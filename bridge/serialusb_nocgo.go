@@ -0,0 +1,8 @@
+//go:build darwin && !cgo
+
+package main
+
+// enumerateUSBPorts needs cgo on macOS; without it ports have no USB details.
+func enumerateUSBPorts() map[string]SerialPortInfo {
+	return nil
+}
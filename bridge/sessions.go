@@ -0,0 +1,272 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// Session types reported by /sessions.
+const (
+	SESSION_WS     = "ws"     // /ws bridge to a TCP target
+	SESSION_UDP    = "udp"    // /ws bridge to a UDP target
+	SESSION_SERIAL = "serial" // client of a per-port serial TCP server
+)
+
+// Session is an active bridge connection. BytesIn counts data from the client
+// towards the target or serial port, BytesOut the opposite direction.
+type Session struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Remote   string    `json:"remote"`
+	Target   string    `json:"target,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Started  time.Time `json:"started"`
+	BytesIn  uint64    `json:"bytesIn"`
+	BytesOut uint64    `json:"bytesOut"`
+	// Recording is the file name when the session is being recorded
+	Recording string `json:"recording,omitempty"`
+	// Busy is set while the client flashes firmware or otherwise must not be
+	// interrupted (mux control or /sc busy=1)
+	Busy bool `json:"busy,omitempty"`
+
+	kill       func(code int, reason string)
+	recorder   *sessionRecorder
+	lastActive int64 // unix nanoseconds of the last transfer
+	killed     int32
+	busy       int32
+}
+
+var (
+	sessions      = make(map[string]*Session)
+	sessionsMu    sync.Mutex
+	lastSessionId uint64
+
+	// busyPorts are serial ports marked busy via /sc; every session on them
+	// counts as busy
+	busyPorts = make(map[string]bool)
+)
+
+// registerSession adds an active session; kill must make the session's
+// handler return, telling a WebSocket client code and reason. The caller must
+// call unregisterSession when it ends.
+func registerSession(sessionType, remote, target, path string, kill func(code int, reason string)) *Session {
+	s := &Session{
+		ID:         strconv.FormatUint(atomic.AddUint64(&lastSessionId, 1), 10),
+		Type:       sessionType,
+		Remote:     remote,
+		Target:     target,
+		Path:       path,
+		Started:    time.Now(),
+		lastActive: time.Now().UnixNano(),
+	}
+	s.kill = func(code int, reason string) {
+		atomic.StoreInt32(&s.killed, 1)
+		kill(code, reason)
+	}
+	sessionsMu.Lock()
+	sessions[s.ID] = s
+	sessionsMu.Unlock()
+	return s
+}
+
+// wasKilled reports whether the session was terminated by the bridge.
+func (s *Session) wasKilled() bool {
+	return atomic.LoadInt32(&s.killed) != 0
+}
+
+func unregisterSession(s *Session) {
+	sessionsMu.Lock()
+	delete(sessions, s.ID)
+	if busyPorts[s.Path] && !hasPathSession(s.Path) {
+		// the flash ended with its last client
+		delete(busyPorts, s.Path)
+	}
+	sessionsMu.Unlock()
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+}
+
+// startRecording records the session's traffic to a file in the recordings directory.
+func (s *Session) startRecording() {
+	recorder, err := newSessionRecorder(s)
+	if err != nil {
+		log.Printf("[record] failed to record session %s: %v\n", s.ID, err)
+		return
+	}
+	sessionsMu.Lock()
+	s.recorder = recorder
+	s.Recording = recorder.name
+	sessionsMu.Unlock()
+	log.Printf("[record] recording session %s to %s\n", s.ID, recorder.name)
+}
+
+// fromClient accounts data sent by the client towards the target.
+func (s *Session) fromClient(data []byte) {
+	atomic.AddUint64(&s.BytesIn, uint64(len(data)))
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+	if s.recorder != nil {
+		s.recorder.Tx(data)
+	}
+}
+
+// toClient accounts data sent from the target to the client.
+func (s *Session) toClient(data []byte) {
+	atomic.AddUint64(&s.BytesOut, uint64(len(data)))
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+	if s.recorder != nil {
+		s.recorder.Rx(data)
+	}
+}
+
+// listSessions returns a snapshot of all sessions, oldest first.
+func listSessions() []Session {
+	sessionsMu.Lock()
+	list := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, Session{
+			ID:       s.ID,
+			Type:     s.Type,
+			Remote:   s.Remote,
+			Target:   s.Target,
+			Path:     s.Path,
+			Started:  s.Started,
+			BytesIn:  atomic.LoadUint64(&s.BytesIn),
+			BytesOut: atomic.LoadUint64(&s.BytesOut),
+
+			Recording: s.Recording,
+			Busy:      s.isBusy(),
+		})
+	}
+	sessionsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// killSession terminates a session by id.
+func killSession(id string) bool {
+	sessionsMu.Lock()
+	s, ok := sessions[id]
+	sessionsMu.Unlock()
+	if ok {
+		s.kill(websocket.CloseNormalClosure, "session terminated")
+	}
+	return ok
+}
+
+// setBusy marks the session as busy (or not) for a graceful shutdown.
+func (s *Session) setBusy(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.busy, v)
+}
+
+// isBusy reports whether the session or its serial port was marked busy.
+// The caller must hold sessionsMu.
+func (s *Session) isBusy() bool {
+	return atomic.LoadInt32(&s.busy) != 0 || (s.Path != "" && busyPorts[s.Path])
+}
+
+// hasPathSession reports whether a session uses the serial port at path.
+// The caller must hold sessionsMu.
+func hasPathSession(path string) bool {
+	for _, s := range sessions {
+		if s.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// setPortBusy marks every session on a serial port as busy (or not).
+func setPortBusy(path string, on bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if on {
+		busyPorts[path] = true
+	} else {
+		delete(busyPorts, path)
+	}
+}
+
+// idleFor reports how long the session has not transferred any data.
+func (s *Session) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// killIdleSessions terminates the sessions idle for at least idle and not
+// marked busy, and returns how many are still busy. An idle of 0 terminates
+// every session.
+func killIdleSessions(idle time.Duration, code int, reason string) int {
+	sessionsMu.Lock()
+	var idleSessions []*Session
+	for _, s := range sessions {
+		if idle == 0 || (s.idleFor() >= idle && !s.isBusy()) {
+			idleSessions = append(idleSessions, s)
+		}
+	}
+	busy := len(sessions) - len(idleSessions)
+	sessionsMu.Unlock()
+	for _, s := range idleSessions {
+		s.kill(code, reason)
+	}
+	return busy
+}
+
+// countingConn counts (and records) the bytes read from and written to a target connection.
+type countingConn struct {
+	net.Conn
+	session *Session
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.session.toClient(b[:n])
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.session.fromClient(b[:n])
+	}
+	return n, err
+}
+
+func handleSessionList(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"sessions": listSessions(),
+	})
+}
+
+func handleSessionKill(c echo.Context) error {
+	id := c.QueryParam("id")
+	if id == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing id parameter",
+		})
+	}
+	if !killSession(id) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	}
+	log.Printf("[sessions] session %s terminated via API\n", id)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":     id,
+		"killed": true,
+	})
+}
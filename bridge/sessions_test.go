@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKillIdleSessionsKeepsBusySessions(t *testing.T) {
+	var killed []string
+	// a killed session's handler returns and unregisters it
+	register := func(path string, idle time.Duration) *Session {
+		var s *Session
+		s = registerSession("ws", "192.168.1.20", "", path, func(int, string) {
+			killed = append(killed, s.ID)
+			unregisterSession(s)
+		})
+		atomic.StoreInt64(&s.lastActive, time.Now().Add(-idle).UnixNano())
+		return s
+	}
+
+	idle := register("/dev/ttyUSB0", time.Minute)
+	active := register("/dev/ttyUSB1", 0)
+	flagged := register("/dev/ttyUSB2", time.Minute)
+	flagged.setBusy(true)
+	port := register("/dev/ttyUSB3", time.Minute)
+	setPortBusy("/dev/ttyUSB3", true)
+
+	if busy := killIdleSessions(10*time.Second, 1001, "test"); busy != 3 {
+		t.Errorf("busy = %d, want 3", busy)
+	}
+	if len(killed) != 1 || killed[0] != idle.ID {
+		t.Errorf("killed %v, want only %s", killed, idle.ID)
+	}
+
+	flagged.setBusy(false)
+	setPortBusy("/dev/ttyUSB3", false)
+	killed = nil
+	killIdleSessions(10*time.Second, 1001, "test")
+	if len(killed) != 2 {
+		t.Errorf("killed %v, want %s and %s", killed, flagged.ID, port.ID)
+	}
+
+	killed = nil
+	killIdleSessions(0, 1001, "test")
+	if len(killed) != 1 || killed[0] != active.ID {
+		t.Errorf("killed %v, want %s", killed, active.ID)
+	}
+}
+
+func TestUnregisterSessionClearsBusyPort(t *testing.T) {
+	s := registerSession("tcp", "192.168.1.20", "", "/dev/ttyACM0", func(int, string) {})
+	setPortBusy("/dev/ttyACM0", true)
+	unregisterSession(s)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if busyPorts["/dev/ttyACM0"] {
+		t.Error("port still busy without sessions")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// DEFAULT_SHUTDOWN_TIMEOUT_MS is the default for -shutdown-timeout.
+const DEFAULT_SHUTDOWN_TIMEOUT_MS = 30000
+
+// DEFAULT_SHUTDOWN_IDLE_MS is the default for -shutdown-idle. A session that
+// was marked busy or moved data within that time (e.g. a firmware flash,
+// whose erase and verify phases are silent for seconds) gets until the
+// shutdown timeout to finish.
+const DEFAULT_SHUTDOWN_IDLE_MS = 15000
+
+const (
+	SHUTDOWN_POLL      = 250 * time.Millisecond
+	SHUTDOWN_DRAIN_MAX = 2 * time.Second
+)
+
+// bridgeCtx is cancelled when the bridge starts shutting down; long-running
+// background work and streaming handlers stop when it is done.
+var bridgeCtx, cancelBridgeCtx = context.WithCancel(context.Background())
+
+// safeDTR and safeRTS are the line states applied on shutdown (nil = keep).
+var safeDTR, safeRTS *bool
+
+func initSafeLines() error {
+	var err error
+	if safeDTR, err = parseSafeLine(safeDTRState); err != nil {
+		return fmt.Errorf("-safe-dtr: %v", err)
+	}
+	if safeRTS, err = parseSafeLine(safeRTSState); err != nil {
+		return fmt.Errorf("-safe-rts: %v", err)
+	}
+	return nil
+}
+
+// parseSafeLine parses -safe-dtr/-safe-rts: "" leaves the line as it is.
+func parseSafeLine(value string) (*bool, error) {
+	switch value {
+	case "":
+		return nil, nil
+	case "0", "1":
+		on := value == "1"
+		return &on, nil
+	}
+	return nil, fmt.Errorf("invalid safe line state %q (0 or 1)", value)
+}
+
+// shutdownBridge stops the bridge in order: stop accepting connections, close
+// idle sessions, wait for busy ones until timeout, put DTR/RTS of every open
+// serial port into the configured safe state and close the serial servers.
+func shutdownBridge(e *echo.Echo, timeout, idle time.Duration) {
+	deadline := time.Now().Add(timeout)
+	cancelBridgeCtx()
+
+	// Withdraw the mDNS advertisement
+	stopBridgeAdvertiser()
+
+	// Stop accepting connections; upgraded WebSockets are not affected
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("[shutdown] HTTP server: %v\n", err)
+	}
+	cancel()
+	closeSerialListeners()
+
+	// Keep the serial ports open while sessions are closed, so the safe
+	// line state can still be applied
+	holdSerialPorts()
+
+	for {
+		busy := killIdleSessions(idle, websocket.CloseGoingAway, "bridge shutting down")
+		if busy == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("[shutdown] timeout, closing %d busy sessions\n", busy)
+			killIdleSessions(0, websocket.CloseGoingAway, "bridge shutting down")
+			break
+		}
+		log.Printf("[shutdown] waiting for %d busy sessions\n", busy)
+		time.Sleep(time.Second)
+	}
+	waitForSessions(SHUTDOWN_DRAIN_MAX)
+
+	applySafeLineState()
+
+	// Close all serial servers
+	closeAllSerialServers()
+}
+
+// closeSerialListeners stops the serial TCP servers, replays and peer relays
+// from accepting clients; connected clients are not affected.
+func closeSerialListeners() {
+	serialMutex.RLock()
+	for _, info := range serialServers {
+		_ = info.Server.Close()
+	}
+	serialMutex.RUnlock()
+
+	replaysMu.Lock()
+	for _, rp := range replays {
+		_ = rp.listener.Close()
+	}
+	replaysMu.Unlock()
+
+	if f := federationInstance; f != nil {
+		f.mu.Lock()
+		for _, p := range f.proxies {
+			_ = p.listener.Close()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// waitForSessions gives session handlers up to max to return.
+func waitForSessions(max time.Duration) {
+	for end := time.Now().Add(max); time.Now().Before(end); time.Sleep(SHUTDOWN_POLL) {
+		sessionsMu.Lock()
+		n := len(sessions)
+		sessionsMu.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// holdSerialPorts takes an extra reference on every open serial port.
+func holdSerialPorts() {
+	serialMutex.Lock()
+	defer serialMutex.Unlock()
+	for path := range openSerialPorts {
+		serialPortRefCount[path]++
+	}
+}
+
+// applySafeLineState sets DTR/RTS of all open serial ports as configured.
+func applySafeLineState() {
+	if safeDTR == nil && safeRTS == nil {
+		return
+	}
+	serialMutex.RLock()
+	defer serialMutex.RUnlock()
+	for path, port := range openSerialPorts {
+		if safeDTR != nil {
+			setSerialDTR(port, *safeDTR)
+		}
+		if safeRTS != nil {
+			setSerialRTS(port, *safeRTS)
+		}
+		log.Printf("[shutdown] safe line state applied to %s\n", path)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SELF_SIGNED_VALIDITY is the lifetime of generated certificates.
+const SELF_SIGNED_VALIDITY = 5 * 365 * 24 * time.Hour
+
+const (
+	selfSignedCertFile = "bridge-cert.pem"
+	selfSignedKeyFile  = "bridge-key.pem"
+)
+
+var bridgeCertificate *tls.Certificate
+
+// initTLS loads the configured certificate or creates (and persists) a
+// self-signed one. It must be called once at startup when TLS is enabled.
+func initTLS() error {
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		if tlsCertFile == "" || tlsKeyFile == "" {
+			return fmt.Errorf("both -tls-cert and -tls-key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		bridgeCertificate = &cert
+		log.Printf("[tls] using certificate %s\n", tlsCertFile)
+		return nil
+	}
+
+	dir := getTLSDir()
+	certPath := filepath.Join(dir, selfSignedCertFile)
+	keyPath := filepath.Join(dir, selfSignedKeyFile)
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && isUsableSelfSigned(&cert) {
+		bridgeCertificate = &cert
+		log.Printf("[tls] using self-signed certificate %s\n", certPath)
+		return nil
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		return fmt.Errorf("failed to generate self-signed certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	bridgeCertificate = &cert
+
+	if err := os.MkdirAll(dir, 0o700); err == nil {
+		if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+			log.Printf("[tls] failed to save certificate: %v\n", err)
+		}
+		if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+			log.Printf("[tls] failed to save key: %v\n", err)
+		}
+	} else {
+		log.Printf("[tls] failed to create %s, certificate will not persist: %v\n", dir, err)
+	}
+	log.Printf("[tls] generated self-signed certificate %s\n", certPath)
+	return nil
+}
+
+// getTLSDir returns where the self-signed certificate is stored.
+func getTLSDir() string {
+	if tlsDir != "" {
+		return tlsDir
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "xzg-mt")
+	}
+	return filepath.Join(os.TempDir(), "xzg-mt")
+}
+
+// isUsableSelfSigned reports whether a stored certificate is still valid and
+// covers the currently advertised host. CA certificates written by older
+// versions are replaced.
+func isUsableSelfSigned(cert *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.IsCA {
+		return false
+	}
+	if time.Now().After(leaf.NotAfter.Add(-24 * time.Hour)) {
+		return false
+	}
+	return leaf.VerifyHostname(getAdvertiseHost()) == nil
+}
+
+func generateSelfSignedCert() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only the names the bridge is reached by: trusting the certificate must
+	// not vouch for anything else
+	hostname, _ := os.Hostname()
+	dnsNames := []string{"localhost"}
+	if hostname != "" {
+		dnsNames = append(dnsNames, hostname, hostname+".local")
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if ip := net.ParseIP(getAdvertiseHost()); ip != nil {
+		if !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	} else if advertiseHost != "" {
+		dnsNames = append(dnsNames, advertiseHost)
+	}
+
+	// a leaf certificate: it can't sign other certificates
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "XZG-MT Bridge", Organization: []string{"XZG-MT"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SELF_SIGNED_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func getBridgeTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*bridgeCertificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// formatFingerprint renders a digest as colon-separated upper-case hex.
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// handleCertInfo returns the served certificate and its fingerprints so users
+// can verify and trust it. ?format=pem downloads the certificate itself.
+func handleCertInfo(c echo.Context) error {
+	if bridgeCertificate == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "TLS is not enabled",
+		})
+	}
+
+	der := bridgeCertificate.Certificate[0]
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if c.QueryParam("format") == "pem" {
+		c.Response().Header().Set("Content-Disposition", `attachment; filename="xzg-mt-bridge.pem"`)
+		return c.Blob(http.StatusOK, "application/x-pem-file", certPEM)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	ips := make([]string, 0, len(leaf.IPAddresses))
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	sha256Sum := sha256.Sum256(der)
+	sha1Sum := sha1.Sum(der)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"subject":    leaf.Subject.String(),
+		"issuer":     leaf.Issuer.String(),
+		"selfSigned": leaf.Subject.String() == leaf.Issuer.String(),
+		"notBefore":  leaf.NotBefore,
+		"notAfter":   leaf.NotAfter,
+		"dnsNames":   leaf.DNSNames,
+		"ips":        ips,
+		"sha256":     formatFingerprint(sha256Sum[:]),
+		"sha1":       formatFingerprint(sha1Sum[:]),
+		"pem":        string(certPEM),
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presets for the TCP -> WebSocket direction of /ws sessions.
+const (
+	TUNING_DEFAULT    = "default"
+	TUNING_LATENCY    = "latency"
+	TUNING_THROUGHPUT = "throughput"
+)
+
+// Bounds for the per-session tuning parameters.
+const (
+	MIN_READ_BUFFER = 256
+	MAX_READ_BUFFER = 1024 * 1024
+	MAX_FRAME_SIZE  = 4 * 1024 * 1024
+	MAX_COALESCE    = time.Second
+)
+
+// wsTuning controls how TCP data is read and grouped into WebSocket messages.
+type wsTuning struct {
+	Mode       string
+	Coalesce   time.Duration // how long to wait for more data after the first read (0 = send at once)
+	ReadBuffer int           // size of a single TCP read
+	MaxFrame   int           // largest coalesced WebSocket message
+	Explicit   bool          // the client asked for specific settings
+}
+
+var tuningPresets = map[string]wsTuning{
+	// the values the bridge always used
+	TUNING_DEFAULT: {Mode: TUNING_DEFAULT, Coalesce: 5 * time.Millisecond, ReadBuffer: 4096, MaxFrame: 64 * 1024},
+	// interactive bootloader handshakes: every read goes out immediately
+	TUNING_LATENCY: {Mode: TUNING_LATENCY, Coalesce: 0, ReadBuffer: 4096, MaxFrame: 4096},
+	// bulk transfers such as flash dumps: fewer, larger messages
+	TUNING_THROUGHPUT: {Mode: TUNING_THROUGHPUT, Coalesce: 20 * time.Millisecond, ReadBuffer: 64 * 1024, MaxFrame: 1024 * 1024},
+}
+
+// parseTuning builds the session tuning from a preset (mode) and optional
+// coalesce (ms), rbuf and maxframe (bytes) overrides.
+func parseTuning(mode, coalesce, rbuf, maxFrame string) (wsTuning, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		mode = TUNING_DEFAULT
+	}
+	tuning, ok := tuningPresets[mode]
+	if !ok {
+		return tuning, fmt.Errorf("unknown mode %q (supported: default, latency, throughput)", mode)
+	}
+	tuning.Explicit = mode != TUNING_DEFAULT || coalesce != "" || rbuf != "" || maxFrame != ""
+
+	if coalesce != "" {
+		ms, err := strconv.Atoi(coalesce)
+		if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > MAX_COALESCE {
+			return tuning, fmt.Errorf("invalid coalesce parameter (0-%d ms)", MAX_COALESCE.Milliseconds())
+		}
+		tuning.Coalesce = time.Duration(ms) * time.Millisecond
+	}
+	if rbuf != "" {
+		n, err := strconv.Atoi(rbuf)
+		if err != nil || n < MIN_READ_BUFFER || n > MAX_READ_BUFFER {
+			return tuning, fmt.Errorf("invalid rbuf parameter (%d-%d bytes)", MIN_READ_BUFFER, MAX_READ_BUFFER)
+		}
+		tuning.ReadBuffer = n
+	}
+	if maxFrame != "" {
+		n, err := strconv.Atoi(maxFrame)
+		if err != nil || n < MIN_READ_BUFFER || n > MAX_FRAME_SIZE {
+			return tuning, fmt.Errorf("invalid maxframe parameter (%d-%d bytes)", MIN_READ_BUFFER, MAX_FRAME_SIZE)
+		}
+		tuning.MaxFrame = n
+	}
+	// a single read must fit into one message
+	if tuning.ReadBuffer > tuning.MaxFrame {
+		tuning.ReadBuffer = tuning.MaxFrame
+	}
+	return tuning, nil
+}
+
+// report is the text message telling the client the settings in effect.
+func (t wsTuning) report() map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "tuning",
+		"mode":       t.Mode,
+		"coalesceMs": t.Coalesce.Milliseconds(),
+		"rbuf":       t.ReadBuffer,
+		"maxframe":   t.MaxFrame,
+	}
+}
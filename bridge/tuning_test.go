@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTuning(t *testing.T) {
+	tests := []struct {
+		name                           string
+		mode, coalesce, rbuf, maxFrame string
+		want                           wsTuning
+		wantErr                        bool
+	}{
+		{name: "empty is the default preset", want: wsTuning{Mode: TUNING_DEFAULT, Coalesce: 5 * time.Millisecond, ReadBuffer: 4096, MaxFrame: 64 * 1024}},
+		{name: "default in any case is not explicit", mode: " Default ", want: wsTuning{Mode: TUNING_DEFAULT, Coalesce: 5 * time.Millisecond, ReadBuffer: 4096, MaxFrame: 64 * 1024}},
+		{name: "latency preset", mode: "LATENCY", want: wsTuning{Mode: TUNING_LATENCY, ReadBuffer: 4096, MaxFrame: 4096, Explicit: true}},
+		{name: "override", coalesce: "0", rbuf: "1024", want: wsTuning{Mode: TUNING_DEFAULT, ReadBuffer: 1024, MaxFrame: 64 * 1024, Explicit: true}},
+		{name: "read buffer limited by max frame", rbuf: "8192", maxFrame: "2048", want: wsTuning{Mode: TUNING_DEFAULT, Coalesce: 5 * time.Millisecond, ReadBuffer: 2048, MaxFrame: 2048, Explicit: true}},
+		{name: "unknown mode", mode: "turbo", wantErr: true},
+		{name: "coalesce too long", coalesce: "1001", wantErr: true},
+		{name: "negative coalesce", coalesce: "-1", wantErr: true},
+		{name: "rbuf too small", rbuf: "16", wantErr: true},
+		{name: "maxframe too large", maxFrame: "999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTuning(tt.mode, tt.coalesce, tt.rbuf, tt.maxFrame)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseTuning accepted %+v", tt)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseTuning = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
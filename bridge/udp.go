@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Target transport protocols for /ws.
+const (
+	PROTO_TCP = "tcp"
+	PROTO_UDP = "udp"
+)
+
+// maxDatagramSize is the largest UDP payload forwarded to the WebSocket.
+const maxDatagramSize = 65535
+
+// openUdpSocket creates the socket for a proto=udp session. Without a bind
+// port or multicast group the socket is connected to the target, so only its
+// replies are forwarded; otherwise every datagram received is forwarded
+// (e.g. ZEP sniffers sending from ephemeral ports).
+func openUdpSocket(raddr *net.UDPAddr, opts wsOptions) (*net.UDPConn, bool, error) {
+	if opts.Multicast != "" {
+		group := net.ParseIP(opts.Multicast)
+		port := opts.BindPort
+		if port == 0 {
+			port = raddr.Port
+		}
+		conn, err := net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: group, Port: port})
+		return conn, false, err
+	}
+
+	if opts.BindPort > 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: opts.BindPort})
+		return conn, false, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	return conn, true, err
+}
+
+// handleWebSocketUDP forwards each WebSocket message as one datagram to the
+// target and each received datagram back as one binary WebSocket message.
+func handleWebSocketUDP(ws *websocket.Conn, target string, dialTarget string, opts wsOptions) {
+	raddr, err := net.ResolveUDPAddr("udp", dialTarget)
+	if err != nil {
+		code, reason := classifyDialError(err)
+		closeWebSocket(ws, target, code, reason)
+		return
+	}
+	conn, connected, err := openUdpSocket(raddr, opts)
+	if err != nil {
+		closeWebSocket(ws, target, CLOSE_ERROR, "failed to open UDP socket: "+err.Error())
+		return
+	}
+	defer conn.Close()
+	defer ws.Close()
+
+	session := registerSession(SESSION_UDP, opts.ClientAddr, target, "", func(code int, reason string) {
+		closeWebSocket(ws, target, code, reason)
+		_ = conn.Close()
+	})
+	defer unregisterSession(session)
+	if opts.Record {
+		session.startRecording()
+	}
+
+	log.Printf("[websocket] UDP session to %s on %s\n", target, conn.LocalAddr())
+	if opts.Multicast != "" {
+		log.Printf("[websocket] joined multicast group %s\n", opts.Multicast)
+	}
+
+	ws.SetReadLimit(maxDatagramSize)
+	ws.SetReadDeadline(time.Now().Add(60 * time.Second))
+	ws.SetPongHandler(func(string) error {
+		_ = ws.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	stopPing := startWebSocketPing(ws)
+	defer stopPing()
+
+	errCh := make(chan error, 2)
+
+	// ws -> udp: one message, one datagram
+	go func() {
+		for {
+			mt, data, err := ws.ReadMessage()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
+				continue
+			}
+			if connected {
+				_, err = conn.Write(data)
+			} else {
+				_, err = conn.WriteToUDP(data, raddr)
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+			session.fromClient(data)
+		}
+	}()
+
+	// udp -> ws: one datagram, one message
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if debugMode {
+				log.Printf("[websocket] UDP %d bytes from %s\n", n, from)
+			}
+			_ = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				errCh <- err
+				return
+			}
+			session.toClient(buf[:n])
+		}
+	}()
+
+	err = <-errCh
+	if err != nil && debugMode {
+		log.Printf("[websocket] UDP proxy error: %v\n", err)
+	}
+	_ = conn.Close()
+	_ = ws.Close()
+	if ce, ok := err.(*websocket.CloseError); ok {
+		log.Printf("[websocket] remote close code=%d text=%s\n", ce.Code, ce.Text)
+	}
+	log.Printf("[websocket] UDP session closing for %s\n", target)
+}
+
+// parseUdpOptions validates the proto, bind and mcast query values.
+func parseUdpOptions(proto, bind, mcast string, opts *wsOptions) error {
+	switch proto {
+	case "", PROTO_TCP:
+		if bind != "" || mcast != "" {
+			return fmt.Errorf("bind and mcast require proto=udp")
+		}
+		opts.Proto = PROTO_TCP
+		return nil
+	case PROTO_UDP:
+		opts.Proto = PROTO_UDP
+	default:
+		return fmt.Errorf("unknown proto %q (supported: tcp, udp)", proto)
+	}
+
+	if bind != "" {
+		port, err := strconv.Atoi(bind)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid bind parameter")
+		}
+		opts.BindPort = port
+	}
+	if mcast != "" {
+		ip := net.ParseIP(mcast)
+		if ip == nil || !ip.IsMulticast() {
+			return fmt.Errorf("invalid mcast parameter, expected a multicast group address")
+		}
+		opts.Multicast = ip.String()
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -36,7 +38,7 @@ type wsNetConn struct {
 	writeDLM sync.Mutex
 }
 
-func newWsNetConn(ws *websocket.Conn, localAddr, remoteAddr string) *wsNetConn {
+func newWsNetConn(ws *websocket.Conn, localAddr, remoteAddr string, framer Framer) *wsNetConn {
 	pr, pw := io.Pipe()
 	conn := &wsNetConn{
 		ws:     ws,
@@ -48,10 +50,34 @@ func newWsNetConn(ws *websocket.Conn, localAddr, remoteAddr string) *wsNetConn {
 	// pump WS -> pipe writer
 	go func() {
 		defer pw.Close()
-		// buffer incoming frame data and emit complete logical packets.
-		// Special-case for protocol starting with 0x00 0xCC: third byte is length (L),
-		// total packet size = 3 + L. Adjust/extend rules for other protocols as needed.
-		buf := make([]byte, 0, 8192)
+		// with a framer, incoming message data is regrouped into complete
+		// logical packets; an incomplete packet is forwarded as-is once
+		// REASSEMBLY_TIMEOUT passes without new data. Every message starts a
+		// new generation, so a flush that fired while the message was being
+		// pushed leaves the freshly buffered data alone.
+		var mu sync.Mutex
+		var timer *time.Timer
+		generation := 0
+		flushAfter := func(gen int) func() {
+			return func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if gen != generation {
+					return
+				}
+				if rest := framer.Flush(); len(rest) > 0 {
+					_, _ = pw.Write(rest)
+				}
+			}
+		}
+		defer func() {
+			mu.Lock()
+			generation++
+			if timer != nil {
+				timer.Stop()
+			}
+			mu.Unlock()
+		}()
 		for {
 			mt, r, err := ws.NextReader()
 			if err != nil {
@@ -71,38 +97,30 @@ func newWsNetConn(ws *websocket.Conn, localAddr, remoteAddr string) *wsNetConn {
 				// nothing to append, continue
 				continue
 			}
-			buf = append(buf, data...)
-
-			// try to flush complete logical packets from buffer
-			for {
-				if len(buf) == 0 {
-					break
-				}
-				// protocol: 0x00 0xCC <len> <payload>
-				if len(buf) >= 3 && buf[0] == 0x00 && buf[1] == 0xCC {
-					plen := int(buf[2])
-					total := 3 + plen
-					if len(buf) >= total {
-						if _, err := pw.Write(buf[:total]); err != nil {
-							_ = pw.CloseWithError(err)
-							return
-						}
-						// drop emitted bytes
-						buf = buf[total:]
-						continue
-					}
-					// not enough bytes yet — wait for next frame
-					break
+			if framer == nil {
+				if _, err := pw.Write(data); err != nil {
+					_ = pw.CloseWithError(err)
+					return
 				}
-				// no known header — flush everything (or could implement other rules)
-				if len(buf) > 0 {
-					if _, err := pw.Write(buf); err != nil {
-						_ = pw.CloseWithError(err)
-						return
-					}
-					buf = buf[:0]
+				continue
+			}
+
+			mu.Lock()
+			generation++
+			if timer != nil {
+				timer.Stop()
+			}
+			for _, packet := range framer.Push(data) {
+				if _, err := pw.Write(packet); err != nil {
+					mu.Unlock()
+					_ = pw.CloseWithError(err)
+					return
 				}
 			}
+			if framer.Buffered() > 0 {
+				timer = time.AfterFunc(REASSEMBLY_TIMEOUT, flushAfter(generation))
+			}
+			mu.Unlock()
 		}
 	}()
 	return conn
@@ -139,6 +157,21 @@ func (c *wsNetConn) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// WriteJSON sends v as a text message. Text messages from the bridge carry
+// control information; the data stream always uses binary messages.
+func (c *wsNetConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	err = c.ws.WriteMessage(websocket.TextMessage, data)
+	_ = c.ws.SetWriteDeadline(time.Time{})
+	return err
+}
+
 func (c *wsNetConn) Close() error {
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
@@ -176,34 +209,103 @@ func (c *wsNetConn) SetWriteDeadline(t time.Time) error {
 	return c.ws.SetWriteDeadline(t)
 }
 
-func handleWebSocketConnection(ws *websocket.Conn, targetHost string, targetPort int) {
+// wsOptions holds per-session settings parsed from the /ws query string.
+type wsOptions struct {
+	// DialTarget is the address approved by the target policy
+	DialTarget string
+	// LocalSerial is set when the target is one of the bridge's own serial TCP servers
+	LocalSerial bool
+	// Framer, if set, splits TCP data so each WebSocket message is one protocol frame
+	Framer string
+	// Reassemble selects how WebSocket data is grouped into packets towards TCP
+	Reassemble string
+	// Pacing limits how fast WebSocket data is written to the TCP target
+	Pacing WritePacing
+	// Proto is the target transport, PROTO_TCP or PROTO_UDP
+	Proto string
+	// BindPort is the local UDP port to listen on (0 = ephemeral)
+	BindPort int
+	// Multicast is the UDP multicast group to join
+	Multicast string
+	// ClientAddr is the address of the browser/client, for the session registry
+	ClientAddr string
+	// Record saves the session's traffic to a recording file
+	Record bool
+	// Resilient keeps the WebSocket open and reconnects when the TCP target drops
+	Resilient bool
+	// GiveUp is how long a resilient session tries to reconnect (0 = forever)
+	GiveUp time.Duration
+	// Mux enables the multiplexed protocol with typed data/control/status/log frames
+	Mux bool
+	// Tuning sets the TCP -> WebSocket read buffer and coalescing
+	Tuning wsTuning
+	// DialTimeout limits how long connecting to the target may take
+	DialTimeout time.Duration
+}
+
+func handleWebSocketConnection(ws *websocket.Conn, targetHost string, targetPort int, opts wsOptions) {
 	target := net.JoinHostPort(targetHost, strconv.Itoa(targetPort))
+	dialTarget := target
+	if opts.DialTarget != "" {
+		dialTarget = opts.DialTarget
+	}
+	if opts.Proto == PROTO_UDP {
+		handleWebSocketUDP(ws, target, dialTarget, opts)
+		return
+	}
+	if opts.Mux {
+		handleWebSocketMux(ws, target, dialTarget, targetPort, opts)
+		return
+	}
 	if debugMode {
-		log.Printf("[websocket] establishing TCP connection to %s\n", target)
+		log.Printf("[websocket] establishing TCP connection to %s\n", dialTarget)
+	}
+
+	// Open the bridge's own serial port up front, so a busy port is reported
+	// as such instead of as a dropped TCP connection
+	var serialPath string
+	if opts.LocalSerial {
+		serialPath = getSerialPathFromTcpPort(targetPort)
+	}
+	if serialPath != "" {
+		if _, _, err := acquireSerialPort(serialPath); err != nil {
+			closeWebSocket(ws, target, CLOSE_SERIAL_BUSY, fmt.Sprintf("serial port %s unavailable: %v", serialPath, err))
+			return
+		}
+		defer releaseSerialPort(serialPath)
 	}
 
 	// Create TCP connection to target
-	tcpConn, err := net.Dial("tcp", target)
+	tcpConn, err := dialTcpTarget(dialTarget, opts.LocalSerial, opts.DialTimeout)
 	if err != nil {
-		log.Printf("[websocket] failed to connect to %s: %v\n", target, err)
-		_ = ws.Close()
+		code, reason := classifyDialError(err)
+		closeWebSocket(ws, target, code, reason)
 		return
 	}
 	// ensure cleanup
 	defer tcpConn.Close()
 	defer ws.Close()
 
-	// try optimize TCP
-	if tcp, ok := tcpConn.(*net.TCPConn); ok {
-		_ = tcp.SetNoDelay(true)
-		_ = tcp.SetKeepAlive(true)
-		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
+	session := registerSession(SESSION_WS, opts.ClientAddr, target, serialPath, func(code int, reason string) {
+		closeWebSocket(ws, target, code, reason)
+		_ = tcpConn.Close()
+	})
+	defer unregisterSession(session)
+	if opts.Record {
+		session.startRecording()
 	}
+	tcpConn = &countingConn{Conn: tcpConn, session: session}
 
 	log.Printf("[websocket] TCP connection established to %s\n", target)
 
 	// wrap websocket as net.Conn
-	wsConn := newWsNetConn(ws, ws.LocalAddr().String(), ws.RemoteAddr().String())
+	reassembler, _ := newReassembler(opts.Reassemble)
+	wsConn := newWsNetConn(ws, ws.LocalAddr().String(), ws.RemoteAddr().String(), reassembler)
+
+	// report the chosen settings when the client asked for specific ones
+	if opts.Tuning.Explicit {
+		_ = wsConn.WriteJSON(opts.Tuning.report())
+	}
 
 	// Try to set TCP_NODELAY on websocket underlying TCP conn (reduce buffering)
 	if u := ws.UnderlyingConn(); u != nil {
@@ -221,68 +323,59 @@ func handleWebSocketConnection(ws *websocket.Conn, targetHost string, targetPort
 	})
 
 	// Start ping routine
-	pingTicker := time.NewTicker(20 * time.Second)
-	defer pingTicker.Stop()
-	go func() {
-		for range pingTicker.C {
-			_ = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			_ = ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second))
+	stopPing := startWebSocketPing(ws)
+	defer stopPing()
+
+	if opts.Resilient {
+		reconnect := func() (net.Conn, error) {
+			conn, err := dialTcpTarget(dialTarget, opts.LocalSerial, opts.DialTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, session: session}, nil
 		}
-	}()
+		err = proxyResilient(wsConn, tcpConn, target, reconnect, opts)
+		_ = wsConn.Close()
+		if ce, ok := err.(*websocket.CloseError); ok {
+			log.Printf("[websocket] remote close code=%d text=%s\n", ce.Code, ce.Text)
+		}
+		log.Printf("[websocket] connection closing for %s\n", target)
+		return
+	}
 
 	// Bidirectional copy (stream-like) with coalescing for tcp->ws
-	errCh := make(chan error, 2)
+	wsErr := make(chan error, 1)
+	tcpErr := make(chan error, 1)
 
 	// ws -> tcp (keep simple: ensure full write loop)
 	go func() {
-		_, err := io.Copy(tcpConn, wsConn)
-		errCh <- err
+		var dst io.Writer = tcpConn
+		if opts.Pacing.enabled() {
+			dst = &pacedWriter{w: tcpConn, pacing: opts.Pacing}
+		}
+		_, err := io.Copy(dst, wsConn)
+		wsErr <- err
 	}()
 
-	// tcp -> ws with small coalescing window
+	// tcp -> ws: one message per protocol frame, or a small coalescing window
 	go func() {
-		readBuf := make([]byte, 4096)
-		for {
-			// block until first chunk
-			n, rerr := tcpConn.Read(readBuf)
-			if n > 0 {
-				out := make([]byte, 0, n)
-				out = append(out, readBuf[:n]...)
-				// coalesce additional immediately-available bytes with short deadline
-				_ = tcpConn.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
-				for {
-					m, err2 := tcpConn.Read(readBuf)
-					if m > 0 {
-						out = append(out, readBuf[:m]...)
-						// prevent unbounded growth
-						if len(out) >= 64*1024 {
-							break
-						}
-						continue
-					}
-					if err2 != nil {
-						// timeout or real error: break to send what's collected
-						break
-					}
-				}
-				_ = tcpConn.SetReadDeadline(time.Time{}) // clear deadline
-
-				// write as a single websocket frame
-				_, werr := wsConn.Write(out)
-				if werr != nil {
-					errCh <- werr
-					return
-				}
-			}
-			if rerr != nil {
-				errCh <- rerr
-				return
-			}
-		}
+		tcpErr <- copyTcpToWs(wsConn, tcpConn, opts.Framer, opts.Tuning)
 	}()
 
 	// wait for first error/close
-	err = <-errCh
+	select {
+	case err = <-wsErr:
+	case err = <-tcpErr:
+		if session.wasKilled() {
+			break
+		}
+		// the target ended the session: tell the client why
+		reason := "target closed the connection"
+		if err != nil && err != io.EOF {
+			reason = err.Error()
+		}
+		closeWebSocket(ws, target, CLOSE_TARGET_CLOSED, reason)
+	}
 	if err != nil && err != io.EOF {
 		if debugMode {
 			log.Printf("[websocket] proxy error: %v\n", err)
@@ -303,3 +396,118 @@ func handleWebSocketConnection(ws *websocket.Conn, targetHost string, targetPort
 	}
 	log.Printf("[websocket] connection closing for %s\n", target)
 }
+
+// copyTcpToWsCoalesced forwards TCP data, merging bytes that arrive within a
+// short window into a single WebSocket message.
+func copyTcpToWsCoalesced(wsConn *wsNetConn, tcpConn net.Conn, tuning wsTuning) error {
+	readBuf := make([]byte, tuning.ReadBuffer)
+	for {
+		// block until first chunk
+		n, rerr := tcpConn.Read(readBuf)
+		if n > 0 {
+			out := make([]byte, 0, n)
+			out = append(out, readBuf[:n]...)
+			// coalesce additional immediately-available bytes with short deadline
+			if tuning.Coalesce > 0 {
+				_ = tcpConn.SetReadDeadline(time.Now().Add(tuning.Coalesce))
+				// prevent unbounded growth
+				for len(out) < tuning.MaxFrame {
+					room := tuning.MaxFrame - len(out)
+					if room > len(readBuf) {
+						room = len(readBuf)
+					}
+					m, err2 := tcpConn.Read(readBuf[:room])
+					if m > 0 {
+						out = append(out, readBuf[:m]...)
+						continue
+					}
+					if err2 != nil {
+						// timeout or real error: break to send what's collected
+						break
+					}
+				}
+				_ = tcpConn.SetReadDeadline(time.Time{}) // clear deadline
+			}
+
+			// write as a single websocket frame
+			if _, werr := wsConn.Write(out); werr != nil {
+				return werr
+			}
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// startWebSocketPing pings the client every 20 s until the returned stop function is called.
+func startWebSocketPing(ws *websocket.Conn) (stop func()) {
+	ticker := time.NewTicker(20 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// dialTcpTarget connects to a /ws target and tunes the TCP connection.
+func dialTcpTarget(dialTarget string, localSerial bool, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if localSerial {
+		// over loopback and marked as the bridge's, so the serial server doesn't
+		// count, list or record the session again
+		if _, port, splitErr := net.SplitHostPort(dialTarget); splitErr == nil {
+			dialTarget = net.JoinHostPort("127.0.0.1", port)
+		}
+		conn, err = dialBridgeConn(func() (net.Conn, error) {
+			return dialSerialServer(dialTarget, timeout)
+		})
+	} else {
+		conn, err = net.DialTimeout("tcp", dialTarget, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// try optimize TCP
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetNoDelay(true)
+		_ = tcp.SetKeepAlive(true)
+		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
+	}
+	return conn, nil
+}
+
+// copyTcpToWs forwards TCP data to the WebSocket, framed when framerName is
+// set and coalesced otherwise.
+func copyTcpToWs(wsConn *wsNetConn, tcpConn net.Conn, framerName string, tuning wsTuning) error {
+	if framer, _ := newFramer(framerName); framer != nil {
+		return copyTcpToWsFramed(wsConn, tcpConn, framer, tuning.ReadBuffer)
+	}
+	return copyTcpToWsCoalesced(wsConn, tcpConn, tuning)
+}
+
+// copyTcpToWsFramed forwards TCP data as one WebSocket message per complete
+// protocol frame.
+func copyTcpToWsFramed(wsConn *wsNetConn, tcpConn net.Conn, framer Framer, readBuffer int) error {
+	readBuf := make([]byte, readBuffer)
+	for {
+		frames, rerr := readFramed(tcpConn, readBuf, framer)
+		for _, frame := range frames {
+			if _, werr := wsConn.Write(frame); werr != nil {
+				return werr
+			}
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
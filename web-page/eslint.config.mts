@@ -5,7 +5,7 @@ import { defineConfig } from "eslint/config";
 
 export default defineConfig([
   {
-    ignores: ["dist/**", "build/**", "scripts/**", "coverage/**", "**/*.min.js"],
+    ignores: ["dist/**", "dist-test/**", "build/**", "scripts/**", "coverage/**", "**/*.min.js"],
   },
   {
     files: ["src/**/*.{js,mjs,cjs,ts,mts,cts}"],
@@ -17,6 +17,7 @@ import { sleep, toHex, bufToHex } from "./utils";
 import { deriveControlConfig, ControlConfig, enterBootloader, makeReset } from "./utils/control";
 import { httpGetWithFallback, saveToFile } from "./utils/http";
 import { crc32 as computeCrc32 } from "./utils/crc";
+import { chipFamily } from "./utils/chip";
 
 import {
   pinModeSelect,
@@ -26,6 +27,7 @@ import {
   invertLevel,
   bridgeHostInput,
   bridgePortInput,
+  bridgeTokenInput,
   tcpLinksPanel,
   chooseSerialBtn,
   bitrateInput,
@@ -115,7 +117,9 @@ import { EraseMethod, TelinkMethod, TelinkFamily } from "./types";
 // Global state variables and UI elements
 // --- Control strategy mapping ---
 type CtrlMode = "zig-http" | "bridge-sc" | "serial-direct";
-let currentConnMeta: { type?: string; protocol?: string } = {};
+// bridgeUrl is set for serial ports of a peer bridge reached directly,
+// control when the bridge matched a device profile
+let currentConnMeta: { type?: string; protocol?: string; bridgeUrl?: string; control?: ControlConfig } = {};
 
 // CCDebugger instance for TI old family
 let ccDebugger: CCDebugger | null = null;
@@ -314,6 +318,7 @@ connectTcpBtn.addEventListener("click", async () => {
     }
     tcp.onData((d) => log(`RX: ${bufToHex(d)}`, "rx"));
     tcp.onTx?.((d: Uint8Array) => log(`TX: ${bufToHex(d)}`, "tx"));
+    tcp.onClose((message) => log(`TCP closed by the bridge: ${message}`));
     log(`TCP connected to ${host}:${port}`);
 
     activeConnection = "tcp";
@@ -668,293 +673,297 @@ btnIeeeWrite?.addEventListener("click", async () => {
 
 // Flash start button with status feedback
 startFlashBtn.addEventListener("click", async () => {
-  await withButtonStatus(startFlashBtn, async () => {
-    const family = getSelectedFamily();
-    // TI old family (CC253x) - use CC Debugger
-    if (family === "ti_old") {
-      flashWarning?.classList.remove("d-none");
+  await withButtonStatus(startFlashBtn, () =>
+    withBridgePortBusy(async () => {
+      const family = getSelectedFamily();
+      // TI old family (CC253x) - use CC Debugger
+      if (family === "ti_old") {
+        flashWarning?.classList.remove("d-none");
 
-      if (ccLoader) {
-        // CC Loader (Arduino-based flasher for CC2530)
-        await ccLoader?.flashAction();
-      } else if (ccDebugger) {
-        // CC Debugger (TI's official debugger)
-        await ccDebugger?.flashAction();
-      }
+        if (ccLoader) {
+          // CC Loader (Arduino-based flasher for CC2530)
+          await ccLoader?.flashAction();
+        } else if (ccDebugger) {
+          // CC Debugger (TI's official debugger)
+          await ccDebugger?.flashAction();
+        }
 
-      setTimeout(() => flashWarning?.classList.add("d-none"), 500);
+        setTimeout(() => flashWarning?.classList.add("d-none"), 500);
 
-      return;
-    } else if (family === "arduino") {
-      // Arduino flashing
-      if (!arduinoTools) throw new Error("ArduinoTools not initialized");
+        return;
+      } else if (family === "arduino") {
+        // Arduino flashing
+        if (!arduinoTools) throw new Error("ArduinoTools not initialized");
 
-      // Check if firmware is loaded
-      if (!hexImage) {
-        throw new Error("No firmware loaded. Please select a firmware file first.");
-      }
+        // Check if firmware is loaded
+        if (!hexImage) {
+          throw new Error("No firmware loaded. Please select a firmware file first.");
+        }
 
-      flashWarning?.classList.remove("d-none");
+        flashWarning?.classList.remove("d-none");
 
-      try {
-        const firmware = hexImage.data;
-        const pageSize = 128; // Standard page size for most Arduino boards
+        try {
+          const firmware = hexImage.data;
+          const pageSize = 128; // Standard page size for most Arduino boards
 
-        // Give bootloader time to be ready
-        await sleep(100);
+          // Give bootloader time to be ready
+          await sleep(100);
 
-        // Check write option
-        if (optWrite.checked) {
-          log(`Flashing ${firmware.length} bytes to Arduino...`);
+          // Check write option
+          if (optWrite.checked) {
+            log(`Flashing ${firmware.length} bytes to Arduino...`);
 
-          // Flash with optional verification
-          await arduinoTools.flash(firmware, pageSize, optVerify.checked);
+            // Flash with optional verification
+            await arduinoTools.flash(firmware, pageSize, optVerify.checked);
 
-          //log("Flashing complete!");
+            //log("Flashing complete!");
 
-          if (optVerify.checked) {
-            log("Verification successful!");
-          }
-        } else if (optVerify.checked) {
-          // Only verify without writing
-          log("Verify-only mode: reading flash and comparing...");
-          const readData = await arduinoTools.readFlash(0, firmware.length, pageSize);
-
-          // Compare
-          let errors = 0;
-          for (let i = 0; i < firmware.length; i++) {
-            if (readData[i] !== firmware[i]) {
-              errors++;
-              if (errors <= 10) {
-                log(
-                  `Verify error at 0x${i.toString(16)}: expected 0x${firmware[i]
-                    .toString(16)
-                    .padStart(2, "0")}, got 0x${readData[i].toString(16).padStart(2, "0")}`,
-                );
+            if (optVerify.checked) {
+              log("Verification successful!");
+            }
+          } else if (optVerify.checked) {
+            // Only verify without writing
+            log("Verify-only mode: reading flash and comparing...");
+            const readData = await arduinoTools.readFlash(0, firmware.length, pageSize);
+
+            // Compare
+            let errors = 0;
+            for (let i = 0; i < firmware.length; i++) {
+              if (readData[i] !== firmware[i]) {
+                errors++;
+                if (errors <= 10) {
+                  log(
+                    `Verify error at 0x${i.toString(16)}: expected 0x${firmware[i]
+                      .toString(16)
+                      .padStart(2, "0")}, got 0x${readData[i].toString(16).padStart(2, "0")}`,
+                  );
+                }
               }
             }
-          }
 
-          if (errors > 0) {
-            throw new Error(`Verification failed: ${errors} byte(s) mismatch`);
-          }
-
-          log("Verification successful!");
-        } else {
-          throw new Error("Please enable Write or Verify option");
-        }
-
-        // Leave programming mode
-        await sleep(100);
+            if (errors > 0) {
+              throw new Error(`Verification failed: ${errors} byte(s) mismatch`);
+            }
 
-        await arduinoTools.reset();
-        // Device will reset automatically after leaving programming mode
-      } catch (e: any) {
-        log("Arduino flash error: " + (e?.message || String(e)));
-        throw e;
-      } finally {
-        setTimeout(() => flashWarning?.classList.add("d-none"), 500);
-      }
+            log("Verification successful!");
+          } else {
+            throw new Error("Please enable Write or Verify option");
+          }
 
-      return true;
-    } else if (family === "telink") {
-      // Telink flashing
-      if (!telinkTools && !telinkPgmTools) throw new Error("Any TelinkTools not initialized");
-      // Load files from multiFilesContainer
+          // Leave programming mode
+          await sleep(100);
 
-      if (optErase.checked && eraseMethodWrap?.value === EraseMethod.FULL) {
-        try {
-          log("Erasing flash...");
-          if (telinkTools) await telinkTools.eraseAllFlash();
-          else if (telinkPgmTools) await telinkPgmTools.eraseAllFlash();
-          log("Erase complete.");
+          await arduinoTools.reset();
+          // Device will reset automatically after leaving programming mode
         } catch (e: any) {
-          log("Telink erase error: " + (e?.message || String(e)));
+          log("Arduino flash error: " + (e?.message || String(e)));
           throw e;
+        } finally {
+          setTimeout(() => flashWarning?.classList.add("d-none"), 500);
         }
-      }
 
-      if (optWrite.checked) {
-        const files: { filename: string; data: string; startAddress: number }[] = [];
-        if (multiFilesContainer) {
-          if (files.length === 0) {
-            const rows = document.querySelectorAll(".multi-file-row");
-            for (let i = 0; i < rows.length; i++) {
-              const row = rows[i];
-              const addrInput = row.querySelector(".multi-addr-input") as HTMLInputElement;
-              const fileInput = row.querySelector(".multi-file-input") as HTMLInputElement;
-
-              const file = fileInput.files?.[0];
-              if (!file) continue; // Skip empty rows
-
-              let addrStr = addrInput.value.trim();
-              if (!addrStr) addrStr = "0x0";
-              const addr = parseInt(addrStr, 16);
-              if (isNaN(addr)) throw new Error(`Invalid address: ${addrStr}`);
-
-              log(`Reading ${file.name} for address 0x${addr.toString(16)}...`);
-              const data = await readAsBinaryString(file);
-              files.push({ filename: file.name, data: data, startAddress: addr });
-            }
-          }
+        return true;
+      } else if (family === "telink") {
+        // Telink flashing
+        if (!telinkTools && !telinkPgmTools) throw new Error("Any TelinkTools not initialized");
+        // Load files from multiFilesContainer
 
-          // Check if we have at least one file
-          if (files.length === 0) {
-            throw new Error("No firmware files selected. Please select firmware files first.");
+        if (optErase.checked && eraseMethodWrap?.value === EraseMethod.FULL) {
+          try {
+            log("Erasing flash...");
+            if (telinkTools) await telinkTools.eraseAllFlash();
+            else if (telinkPgmTools) await telinkPgmTools.eraseAllFlash();
+            log("Erase complete.");
+          } catch (e: any) {
+            log("Telink erase error: " + (e?.message || String(e)));
+            throw e;
           }
+        }
 
-          // Flash each file
-          flashWarning?.classList.remove("d-none");
-          try {
-            for (const file of files) {
-              log(`Flashing file: ${file.filename}, ${file.data.length} bytes...`);
-              // Convert string to Uint8Array for flash method
-              const dataArray = new Uint8Array(file.data.length);
-              for (let i = 0; i < file.data.length; i++) {
-                dataArray[i] = file.data.charCodeAt(i) & 0xff;
-              }
-              let sectorErase = false;
-              if (optErase.checked && eraseMethodWrap?.value === EraseMethod.SECTOR) {
-                sectorErase = true;
+        if (optWrite.checked) {
+          const files: { filename: string; data: string; startAddress: number }[] = [];
+          if (multiFilesContainer) {
+            if (files.length === 0) {
+              const rows = document.querySelectorAll(".multi-file-row");
+              for (let i = 0; i < rows.length; i++) {
+                const row = rows[i];
+                const addrInput = row.querySelector(".multi-addr-input") as HTMLInputElement;
+                const fileInput = row.querySelector(".multi-file-input") as HTMLInputElement;
+
+                const file = fileInput.files?.[0];
+                if (!file) continue; // Skip empty rows
+
+                let addrStr = addrInput.value.trim();
+                if (!addrStr) addrStr = "0x0";
+                const addr = parseInt(addrStr, 16);
+                if (isNaN(addr)) throw new Error(`Invalid address: ${addrStr}`);
+
+                log(`Reading ${file.name} for address 0x${addr.toString(16)}...`);
+                const data = await readAsBinaryString(file);
+                files.push({ filename: file.name, data: data, startAddress: addr });
               }
-              if (telinkTools) await telinkTools.flash(dataArray, file.startAddress, sectorErase, optVerify.checked);
-              else if (telinkPgmTools)
-                await telinkPgmTools.flash(dataArray, file.startAddress, sectorErase, optVerify.checked);
-              log(`Flashing of ${file.filename} complete!`);
             }
 
-            if (telinkTools) await telinkTools.reset();
-            else if (telinkPgmTools) await telinkPgmTools.mcuReboot();
-          } catch (e: any) {
-            log("Telink flash error: " + (e?.message || String(e)));
-            throw e;
-          } finally {
-            setTimeout(() => flashWarning?.classList.add("d-none"), 500);
+            // Check if we have at least one file
+            if (files.length === 0) {
+              throw new Error("No firmware files selected. Please select firmware files first.");
+            }
+
+            // Flash each file
+            flashWarning?.classList.remove("d-none");
+            try {
+              for (const file of files) {
+                log(`Flashing file: ${file.filename}, ${file.data.length} bytes...`);
+                // Convert string to Uint8Array for flash method
+                const dataArray = new Uint8Array(file.data.length);
+                for (let i = 0; i < file.data.length; i++) {
+                  dataArray[i] = file.data.charCodeAt(i) & 0xff;
+                }
+                let sectorErase = false;
+                if (optErase.checked && eraseMethodWrap?.value === EraseMethod.SECTOR) {
+                  sectorErase = true;
+                }
+                if (telinkTools) await telinkTools.flash(dataArray, file.startAddress, sectorErase, optVerify.checked);
+                else if (telinkPgmTools)
+                  await telinkPgmTools.flash(dataArray, file.startAddress, sectorErase, optVerify.checked);
+                log(`Flashing of ${file.filename} complete!`);
+              }
+
+              if (telinkTools) await telinkTools.reset();
+              else if (telinkPgmTools) await telinkPgmTools.mcuReboot();
+            } catch (e: any) {
+              log("Telink flash error: " + (e?.message || String(e)));
+              throw e;
+            } finally {
+              setTimeout(() => flashWarning?.classList.add("d-none"), 500);
+            }
           }
         }
-      }
-      return true;
-    } else {
-      try {
-        await flash(detectedTiChipFamily);
-        log("Flashing finished. Restarting device...");
+        return true;
+      } else {
         try {
-          await performReset();
-          log("Restart done");
-        } catch (e: any) {
-          log("Restart error: " + (e?.message || String(e)));
-        }
-
-        if (family == "esp") {
-          // don't ping and version check for ESP
-          return true;
-        }
-
-        if (family == "ti") {
-          //log("Pinging device...");
-          await sleep(1000);
+          await flash(detectedTiChipFamily);
+          log("Flashing finished. Restarting device...");
           try {
-            const ok = await pingWithBaudRetries();
-            if (!ok) log("Ping: timed out or no response");
+            await performReset();
+            log("Restart done");
           } catch (e: any) {
-            log("Ping error: " + (e?.message || String(e)));
+            log("Restart error: " + (e?.message || String(e)));
           }
-        }
 
-        log("Checking firmware version...");
-        if (family == "sl") {
-          // After flash, re-read device info
-          await sleep(1000);
-
-          if (!sl_tools) throw "SilabsTools not initialized"; //sl_tools = new SilabsTools(getActiveLink());
-          const result = await sl_tools.probe(
-            "auto",
-            findBaudToggle?.checked ? "auto" : bitrateInput ? Number(bitrateInput.value) || 115200 : 115200,
-            implyGateToggle?.checked ?? true,
-          );
-          if (firmwareVersionEl) firmwareVersionEl.value = result.version;
-          if (chipModelEl) chipModelEl.value = result.deviceModel ?? "EFR32MG21";
-          await refreshNetworkFirmwareList(chipModelEl?.value || "").catch((e) =>
-            log("Network FW list fetch failed: " + (e?.message || String(e))),
-          );
-        }
-        if (family == "ti") {
-          // use local wrapper to log and update UI
-          if (!ti_tools) throw new Error("TiTools not initialized");
-          const info = await ti_tools.getFwVersion();
-          if (info) {
-            if (firmwareVersionEl) firmwareVersionEl.value = String(info.fwRev);
-            log(`Zigbee FW version: ${info.fwRev}`);
+          if (family == "esp") {
+            // don't ping and version check for ESP
+            return true;
+          }
+
+          if (family == "ti") {
+            //log("Pinging device...");
+            await sleep(1000);
+            try {
+              const ok = await pingWithBaudRetries();
+              if (!ok) log("Ping: timed out or no response");
+            } catch (e: any) {
+              log("Ping error: " + (e?.message || String(e)));
+            }
           }
-          if (!info) {
-            log("FW version request: timed out or no response");
-            if (detectedTiChipFamily !== "cc2538") {
-              // TI with OpenThread RCP  support only 460800 baud
-              await changeBaud(460800);
-              await performReset();
-              await sleep(1000);
-              const rcpInfo = await ti_tools.detectOpenThreadRcp();
-              if (rcpInfo) {
-                if (firmwareVersionEl) firmwareVersionEl.value = rcpInfo.version;
-                log(`OpenThread RCP version: ${rcpInfo.version}`);
+
+          log("Checking firmware version...");
+          if (family == "sl") {
+            // After flash, re-read device info
+            await sleep(1000);
+
+            if (!sl_tools) throw "SilabsTools not initialized"; //sl_tools = new SilabsTools(getActiveLink());
+            const result = await sl_tools.probe(
+              "auto",
+              findBaudToggle?.checked ? "auto" : bitrateInput ? Number(bitrateInput.value) || 115200 : 115200,
+              implyGateToggle?.checked ?? true,
+            );
+            if (firmwareVersionEl) firmwareVersionEl.value = result.version;
+            if (chipModelEl) chipModelEl.value = result.deviceModel ?? "EFR32MG21";
+            await refreshNetworkFirmwareList(chipModelEl?.value || "").catch((e) =>
+              log("Network FW list fetch failed: " + (e?.message || String(e))),
+            );
+          }
+          if (family == "ti") {
+            // use local wrapper to log and update UI
+            if (!ti_tools) throw new Error("TiTools not initialized");
+            const info = await ti_tools.getFwVersion();
+            if (info) {
+              if (firmwareVersionEl) firmwareVersionEl.value = String(info.fwRev);
+              log(`Zigbee FW version: ${info.fwRev}`);
+            }
+            if (!info) {
+              log("FW version request: timed out or no response");
+              if (detectedTiChipFamily !== "cc2538") {
+                // TI with OpenThread RCP  support only 460800 baud
+                await changeBaud(460800);
+                await performReset();
+                await sleep(1000);
+                const rcpInfo = await ti_tools.detectOpenThreadRcp();
+                if (rcpInfo) {
+                  if (firmwareVersionEl) firmwareVersionEl.value = rcpInfo.version;
+                  log(`OpenThread RCP version: ${rcpInfo.version}`);
+                }
+                const originalBaudRate = parseInt(bitrateInput.value, 10) || 115200;
+                await changeBaud(originalBaudRate);
               }
-              const originalBaudRate = parseInt(bitrateInput.value, 10) || 115200;
-              await changeBaud(originalBaudRate);
             }
           }
+          return true;
+        } catch (e: any) {
+          log("Flash error: " + (e?.message || String(e)));
+          throw e;
         }
-        return true;
-      } catch (e: any) {
-        log("Flash error: " + (e?.message || String(e)));
-        throw e;
       }
-    }
-  });
+    })
+  );
 });
 
 swireFlashBtn.addEventListener("click", async () => {
-  await withButtonStatus(swireFlashBtn!, async () => {
-    // try {
-    const family = getSelectedFamily();
-    if (family === "telink") {
-      // Telink flashing
-      if (!telinkTools) throw new Error("TelinkTools not initialized");
-      log("Preparing to flash uart2swire...");
-      let file;
-      try {
+  await withButtonStatus(swireFlashBtn!, () =>
+    withBridgePortBusy(async () => {
+      // try {
+      const family = getSelectedFamily();
+      if (family === "telink") {
+        // Telink flashing
+        if (!telinkTools) throw new Error("TelinkTools not initialized");
+        log("Preparing to flash uart2swire...");
+        let file;
         try {
-          // we need to load ./bins/floader_825x.bin or ./bins/floader_826x.bin as unit8array and pass to telinkTools
-          // log("Loading Telink bootloader...");
-          const progFileUrl = "./bins/uart2swire.bin";
-
-          //  const fillByte = getSelectedFamily() === "arduino" ? 0xff : 0x00;
-          const img = await downloadFirmwareFromUrl(progFileUrl, 0xff);
-          file = img.data;
-        } catch (e) {
-          log(`Failed to load uart2swire: ${e}`);
+          try {
+            // we need to load ./bins/floader_825x.bin or ./bins/floader_826x.bin as unit8array and pass to telinkTools
+            // log("Loading Telink bootloader...");
+            const progFileUrl = "./bins/uart2swire.bin";
+
+            //  const fillByte = getSelectedFamily() === "arduino" ? 0xff : 0x00;
+            const img = await downloadFirmwareFromUrl(progFileUrl, 0xff);
+            file = img.data;
+          } catch (e) {
+            log(`Failed to load uart2swire: ${e}`);
+            throw e;
+          }
+          // Load files from multiFilesContainer
+          await telinkTools.eraseAllFlash();
+          // const data = await readAsBinaryString(file);
+          flashWarning?.classList.remove("d-none");
+          await telinkTools.flash(file, 0x0, false, optVerify.checked);
+          log(`Flashing of uart2swire complete!`);
+          await telinkTools.reset();
+          return true;
+        } catch (e: any) {
+          log("Telink flash error: " + (e?.message || String(e)));
           throw e;
+        } finally {
+          setTimeout(() => flashWarning?.classList.add("d-none"), 500);
         }
-        // Load files from multiFilesContainer
-        await telinkTools.eraseAllFlash();
-        // const data = await readAsBinaryString(file);
-        flashWarning?.classList.remove("d-none");
-        await telinkTools.flash(file, 0x0, false, optVerify.checked);
-        log(`Flashing of uart2swire complete!`);
-        await telinkTools.reset();
-        return true;
-      } catch (e: any) {
-        log("Telink flash error: " + (e?.message || String(e)));
-        throw e;
-      } finally {
-        setTimeout(() => flashWarning?.classList.add("d-none"), 500);
       }
-    }
 
-    // } catch (e: any) {
-    //   log("SWIRE error: " + (e?.message || String(e)));
-    //   throw e;
-    // }
-  });
+      // } catch (e: any) {
+      //   log("SWIRE error: " + (e?.message || String(e)));
+      //   throw e;
+      // }
+    })
+  );
 });
 
 bslUrlSelect?.addEventListener("change", () => applySelectToInput(bslUrlSelect, bslUrlInput));
@@ -1226,7 +1235,16 @@ mdnsSelect?.addEventListener("change", () => {
   // Capture metadata for strategy
   const t = opt?.getAttribute("data-type") || undefined;
   const pr = opt?.getAttribute("data-protocol") || undefined;
-  currentConnMeta = { type: t, protocol: pr };
+  const bu = opt?.getAttribute("data-bridge-url") || undefined;
+  let control: ControlConfig | undefined;
+  try {
+    const c = opt?.getAttribute("data-control");
+    if (c) control = JSON.parse(c);
+  } catch {
+    // ignore
+  }
+  currentConnMeta = { type: t, protocol: pr, bridgeUrl: bu, control };
+  applyProfileDefaults(opt?.getAttribute("data-chip") || "", Number(opt?.getAttribute("data-baud") || 0));
   // Auto-apply presets on selection change
   applyControlConfig(deriveControlConfig(currentConnMeta));
   updateConnectionUI();
@@ -1234,6 +1252,17 @@ mdnsSelect?.addEventListener("change", () => {
 
 btnAddEspFile?.addEventListener("click", addMultiFileRow);
 
+// Applies the chip family and baud rate of a matched device profile as defaults
+function applyProfileDefaults(chip: string, baud: number) {
+  const family = chip ? chipFamily(chip) : undefined;
+  if (family && family !== getSelectedFamily()) {
+    const { setSelectedFamilyValue } = require("./ui");
+    setSelectedFamilyValue(family);
+    updateUIForFamily();
+  }
+  if (baud > 0 && bitrateInput) bitrateInput.value = String(baud);
+}
+
 function applyControlConfig(cfg: ControlConfig) {
   if (pinModeSelect && cfg.pinMode !== undefined) pinModeSelect.checked = cfg.pinMode;
 
@@ -1284,11 +1313,13 @@ function getCtrlMode(): CtrlMode {
 
 // --- Unified control URL builder/sender for BSL/RST endpoints ---
 function buildCtrlUrl(template: string, setVal?: number): string {
-  const base = getBridgeBase("http");
+  const base = getControlBridgeBase();
   const devHost = hostInput.value.trim();
   const rawPort = Number(portInput.value) || 0;
   let t = (template || "").trim();
   if (setVal !== undefined) t = t.replace(/\{SET\}/g, String(setVal));
+  // bridge templates are stored as http://, a TLS bridge only answers https://
+  if (base.startsWith("https://")) t = t.replace(/^http:\/\/\{BRIDGE\}/i, "https://{BRIDGE}");
   t = t
     .replace(/\{PORT\}/g, String(rawPort))
     .replace(/\{HOST\}/g, devHost)
@@ -1301,8 +1332,24 @@ function buildCtrlUrl(template: string, setVal?: number): string {
   return t;
 }
 
+// Marks the bridge serial port busy while flashing so a bridge shutdown waits
+// for it instead of closing the session after the idle window.
+async function withBridgePortBusy<T>(fn: () => Promise<T>): Promise<T> {
+  if (getCtrlMode() !== "bridge-sc") return fn();
+  const mark = (on: boolean) =>
+    sendCtrlUrl(`http://{BRIDGE}/sc?port={PORT}&busy=${on ? 1 : 0}`).catch((e: any) =>
+      log("Bridge busy flag failed: " + (e?.message || String(e)))
+    );
+  await mark(true);
+  try {
+    return await fn();
+  } finally {
+    await mark(false);
+  }
+}
+
 async function sendCtrlUrl(template: string, setVal?: number, method: "GET" | "POST" = "GET"): Promise<void> {
-  const url = buildCtrlUrl(template, setVal);
+  const url = withBridgeToken(buildCtrlUrl(template, setVal));
   //log(`HTTP: ${method} ${url}`);
   const r = await httpGetWithFallback(url, 8000, method);
   if (r.opaque) {
@@ -1320,20 +1367,71 @@ export function getSelectedFamily(): string {
 // Bootstrap tooltip init moved to index.js
 
 // Settings: store bridge host/port in localStorage
-function getBridgeBase(base: string): string {
+function getBridgeAddress(): string {
   const host = bridgeHostInput?.value?.trim() || localStorage.getItem("bridgeHost") || "127.0.0.1";
   const port = Number(bridgePortInput?.value || localStorage.getItem("bridgePort") || 8765) || 8765;
-  return `${base}://${host}:${port}`;
+  return `${host}:${port}`;
+}
+
+// A bridge started with -tls serves HTTPS/WSS. Secure pages can only reach such
+// a bridge; for other pages it is remembered once plain HTTP failed and HTTPS
+// answered with tls=1.
+function isBridgeSecure(): boolean {
+  return window.location.protocol === "https:" || localStorage.getItem("bridgeTls") === getBridgeAddress();
+}
+
+function getBridgeBase(base: string): string {
+  const secure = isBridgeSecure();
+  const scheme = base === "ws" ? (secure ? "wss" : "ws") : secure ? "https" : "http";
+  return `${scheme}://${getBridgeAddress()}`;
+}
+
+// Checks whether the configured bridge answers over HTTPS, for plain pages
+// whose HTTP request failed.
+async function detectBridgeTls(): Promise<boolean> {
+  if (isBridgeSecure()) return false;
+  try {
+    const resp = await fetch(withBridgeToken(`https://${getBridgeAddress()}/version`));
+    if (!resp.ok) return false;
+    const j = await resp.json();
+    if (!j?.tls) return false;
+    localStorage.setItem("bridgeTls", getBridgeAddress());
+    return true;
+  } catch {
+    return false;
+  }
+}
+
+// Optional bridge auth token, sent as ?token= so it also works for WebSocket URLs
+function getBridgeToken(): string {
+  return bridgeTokenInput?.value?.trim() || localStorage.getItem("bridgeToken") || "";
+}
+
+// The token is only sent to the configured bridge, never to a peer bridge
+// (bridge.url) announced by it.
+function withBridgeToken(url: string): string {
+  const token = getBridgeToken();
+  const address = getBridgeAddress();
+  const known = url.startsWith(`http://${address}`) || url.startsWith(`https://${address}`);
+  if (!token || !known) return url;
+  return `${url}${url.includes("?") ? "&" : "?"}token=${encodeURIComponent(token)}`;
+}
+
+// Serial ports of a peer bridge in direct mode are controlled by that bridge
+function getControlBridgeBase(): string {
+  return currentConnMeta.bridgeUrl || getBridgeBase("http");
 }
 
 export function saveBridgeSettings() {
   if (bridgeHostInput) localStorage.setItem("bridgeHost", bridgeHostInput.value.trim() || "127.0.0.1");
   if (bridgePortInput) localStorage.setItem("bridgePort", String(Number(bridgePortInput.value || 8765) || 8765));
+  if (bridgeTokenInput) localStorage.setItem("bridgeToken", bridgeTokenInput.value.trim());
 }
 
 // init from localStorage
 if (bridgeHostInput) bridgeHostInput.value = localStorage.getItem("bridgeHost") || bridgeHostInput.value;
 if (bridgePortInput) bridgePortInput.value = localStorage.getItem("bridgePort") || bridgePortInput.value;
+if (bridgeTokenInput) bridgeTokenInput.value = localStorage.getItem("bridgeToken") || "";
 
 // Auto-fill bridge host/port from current page URL when opened as http://HOST:PORT
 // if no values are already stored in localStorage.
@@ -2508,14 +2606,14 @@ export const setLines = async (rstLevel: boolean, bslLevel: boolean) => {
       const combinedSet = `rts=${rst ? "1" : "0"}&dtr=${bsl ? "1" : "0"}`;
 
       const fullUrl = finalTplNoHttp
-        .replace("{BRIDGE}", getBridgeBase("http"))
+        .replace("{BRIDGE}", getControlBridgeBase())
         .replace("{PORT}", portInput.value || "");
       const endUrl = fullUrl + `&${combinedSet}`;
 
       // log(`  final URL with params: ${endUrl}`);
 
       // make link and send using httpGetWithFallback
-      await httpGetWithFallback(endUrl).catch((e: any) => {
+      await httpGetWithFallback(withBridgeToken(endUrl)).catch((e: any) => {
         log("send request failed: " + (e?.message || String(e)));
         sleep(1000);
       });
@@ -2633,13 +2731,117 @@ function applySelectToInput(sel: HTMLSelectElement | null, input: HTMLInputEleme
 }
 
 // --- mDNS discovery via local bridge ---
-async function refreshMdnsList() {
+type MdnsDevice = {
+  name?: string;
+  host: string;
+  port: number;
+  type?: string;
+  protocol?: string;
+  fqdn?: string;
+  txt?: Record<string, any>;
+  bridge?: { name: string; url: string; mode: string };
+  profile?: { name: string; model?: string; chip?: string; baud?: number; control?: ControlConfig };
+};
+
+// same key the bridge uses to match found/update/remove events
+function mdnsDeviceKey(d: MdnsDevice): string {
+  const key = `${d.type || ""}.${d.protocol || ""}|${d.name || `${d.host}:${d.port}`}`;
+  return d.bridge ? `${key}|${d.bridge.url}` : key;
+}
+
+function renderMdnsList(devices: MdnsDevice[], done: boolean) {
   if (!mdnsSelect) return;
-  //check if page loader over http
-  if (window.location.protocol === "https:") {
-    console.warn("Secure page - no request to bridge");
-    return;
+  const selected = mdnsSelect.value;
+  mdnsSelect.innerHTML = "";
+  const def = document.createElement("option");
+  def.value = "";
+  def.textContent = devices.length
+    ? "— Discovered devices —"
+    : done
+    ? "— No devices found —"
+    : "— Searching… —";
+  mdnsSelect.appendChild(def);
+  for (const d of devices) {
+    const o = document.createElement("option");
+    o.value = `${d.host}:${d.port}`;
+    const extras: string[] = [];
+    if (d.profile?.model) extras.push(d.profile.model);
+    else if (d.type) extras.push(d.type);
+    const txt = d.txt || {};
+    if (txt.board) extras.push(`board=${String(txt.board)}`);
+    if (txt.serial_number) extras.push(`sn=${String(txt.serial_number)}`);
+    if (txt.radio_type) extras.push(`radio=${String(txt.radio_type)}`);
+    if (d.bridge) extras.push(`@ ${d.bridge.name}`);
+    const suffix = extras.length ? ` — ${extras.join(", ")}` : "";
+    const main = `${d.host}:${d.port}`;
+    o.textContent = d.name ? `${d.name} (${main})${suffix}` : `${main}${suffix}`;
+    o.setAttribute("data-host", d.host);
+    o.setAttribute("data-port", String(d.port));
+    if (d.type) o.setAttribute("data-type", d.type);
+    if (d.protocol) o.setAttribute("data-protocol", d.protocol);
+    if (txt.board) o.setAttribute("data-board", String(txt.board));
+    if (txt.serial_number) o.setAttribute("data-serial-number", String(txt.serial_number));
+    if (txt.radio_type) o.setAttribute("data-radio-type", String(txt.radio_type));
+    if (d.bridge?.mode === "direct") o.setAttribute("data-bridge-url", d.bridge.url);
+    if (d.profile?.control) o.setAttribute("data-control", JSON.stringify(d.profile.control));
+    if (d.profile?.chip) o.setAttribute("data-chip", d.profile.chip);
+    if (d.profile?.baud) o.setAttribute("data-baud", String(d.profile.baud));
+    if (d.fqdn) o.title = d.fqdn;
+    mdnsSelect.appendChild(o);
+  }
+
+  // Add manual option after all discovered devices
+  const manual = document.createElement("option");
+  manual.value = "manual";
+  manual.textContent = "Manual";
+  manual.setAttribute("data-protocol", "tcp");
+  manual.setAttribute("data-type", "manual");
+  manual.setAttribute("data-port", "6638");
+  manual.setAttribute("data-host", "");
+  mdnsSelect.appendChild(manual);
+
+  // keep the user's choice while the list fills up
+  if (selected && Array.from(mdnsSelect.options).some((o) => o.value === selected)) {
+    mdnsSelect.value = selected;
   }
+}
+
+// Follow /mdns/stream until the bridge sends "done"; rejects if the stream
+// can't be opened at all (e.g. an older bridge without the endpoint)
+function streamMdnsDevices(url: string, onChange: (devices: MdnsDevice[]) => void): Promise<MdnsDevice[]> {
+  return new Promise((resolve, reject) => {
+    const devices = new Map<string, MdnsDevice>();
+    const es = new EventSource(url);
+    let opened = false;
+    const upsert = (ev: Event) => {
+      const d = JSON.parse((ev as MessageEvent).data) as MdnsDevice;
+      devices.set(mdnsDeviceKey(d), d);
+      onChange([...devices.values()]);
+    };
+    es.addEventListener("open", () => (opened = true));
+    es.addEventListener("found", upsert);
+    es.addEventListener("update", upsert);
+    es.addEventListener("remove", (ev) => {
+      const d = JSON.parse((ev as MessageEvent).data) as MdnsDevice & { reason?: string };
+      if (devices.delete(mdnsDeviceKey(d))) {
+        log(`mDNS: ${d.name || d.host} gone (${d.reason || "removed"})`);
+        onChange([...devices.values()]);
+      }
+    });
+    es.addEventListener("done", () => {
+      es.close();
+      resolve([...devices.values()]);
+    });
+    es.onerror = () => {
+      es.close();
+      if (opened) resolve([...devices.values()]);
+      else reject(new Error("mdns stream unavailable"));
+    };
+  });
+}
+
+async function refreshMdnsList(retryTls = true) {
+  if (!mdnsSelect) return;
   setBridgeLoading();
 
   // Refresh control lists
@@ -2655,63 +2857,32 @@ async function refreshMdnsList() {
       "local.serial",
     ].join(",");
     const base = getBridgeBase("http");
-    const url = `${base}/mdns?types=${encodeURIComponent(types)}&timeout=3000`;
+    const query = `types=${encodeURIComponent(types)}&timeout=3000`;
 
-    const resp = await fetch(url);
-    if (!resp.ok) throw new Error(`mdns http ${resp.status}`);
-    const j = await resp.json();
-    const devices: Array<{
-      name?: string;
-      host: string;
-      port: number;
-      type?: string;
-      protocol?: string;
-      fqdn?: string;
-      txt?: Record<string, any>;
-    }> = j.devices || [];
-    // rebuild options
-    mdnsSelect.innerHTML = "";
-    const def = document.createElement("option");
-    def.value = "";
-    def.textContent = devices.length ? "— Discovered devices —" : "— No devices found —";
-    mdnsSelect.appendChild(def);
-    for (const d of devices) {
-      const o = document.createElement("option");
-      o.value = `${d.host}:${d.port}`;
-      const extras: string[] = [];
-      if (d.type) extras.push(d.type);
-      const txt = d.txt || {};
-      if (txt.board) extras.push(`board=${String(txt.board)}`);
-      if (txt.serial_number) extras.push(`sn=${String(txt.serial_number)}`);
-      if (txt.radio_type) extras.push(`radio=${String(txt.radio_type)}`);
-      const suffix = extras.length ? ` — ${extras.join(", ")}` : "";
-      const main = `${d.host}:${d.port}`;
-      o.textContent = d.name ? `${d.name} (${main})${suffix}` : `${main}${suffix}`;
-      o.setAttribute("data-host", d.host);
-      o.setAttribute("data-port", String(d.port));
-      if (d.type) o.setAttribute("data-type", d.type);
-      if (d.protocol) o.setAttribute("data-protocol", d.protocol);
-      if (txt.board) o.setAttribute("data-board", String(txt.board));
-      if (txt.serial_number) o.setAttribute("data-serial-number", String(txt.serial_number));
-      if (txt.radio_type) o.setAttribute("data-radio-type", String(txt.radio_type));
-      if (d.fqdn) o.title = d.fqdn;
-      mdnsSelect.appendChild(o);
-    }
-
-    // Add manual option after all discovered devices
-    const manual = document.createElement("option");
-    manual.value = "manual";
-    manual.textContent = "Manual";
-    manual.setAttribute("data-protocol", "tcp");
-    manual.setAttribute("data-type", "manual");
-    manual.setAttribute("data-port", "6638");
-    manual.setAttribute("data-host", "");
-    mdnsSelect.appendChild(manual);
+    let devices: MdnsDevice[];
+    try {
+      // devices show up as soon as they resolve
+      renderMdnsList([], false);
+      devices = await streamMdnsDevices(withBridgeToken(`${base}/mdns/stream?${query}`), (list) =>
+        renderMdnsList(list, false)
+      );
+    } catch {
+      const resp = await fetch(withBridgeToken(`${base}/mdns?${query}`));
+      if (!resp.ok) throw new Error(`mdns http ${resp.status}`);
+      const j = await resp.json();
+      devices = j.devices || [];
+    }
+    renderMdnsList(devices, true);
 
     // success: mark bridge OK (green check)
     setBridgeStatus(true);
   } catch (e: any) {
+    if (retryTls && (await detectBridgeTls())) {
+      log("Bridge uses HTTPS, switching to https/wss");
+      return refreshMdnsList(false);
+    }
     log("mDNS refresh error: " + (e?.message || String(e)));
+    if (window.location.protocol === "https:") log("Secure page: the bridge must run with -tls and its certificate must be trusted");
     // error: mark bridge as problem (red x)
     setBridgeStatus(false);
     // clean up options
@@ -2728,7 +2899,7 @@ async function refreshControlLists() {
   if (!bslUrlSelect || !rstUrlSelect) return;
   try {
     const base = getBridgeBase("http");
-    const url = `${base}/gl`;
+    const url = withBridgeToken(`${base}/gl`);
     let j: any = {};
     try {
       const resp = await fetch(url);
@@ -1,10 +1,27 @@
 // TCP bridge over WebSocket
 // You need a local TCP bridge server that accepts a target host:port param and pipes bytes over the WS.
 // Example: ws://127.0.0.1:8765/connect?host=192.168.1.100&port=6638
+// Close code of the bridge for a target rejected by its target policy
+export const CLOSE_POLICY = 4004;
+
+// Readable text for a WebSocket close; a target blocked by the bridge's
+// target policy names the bridge options that allow it.
+export function describeWsClose(code: number, reason: string): string {
+  if (code === CLOSE_POLICY) {
+    return (
+      `${reason || "target not allowed by the bridge target policy"}. ` +
+      "Allow it when starting the bridge with -allow-targets host:port, or -target-policy cidr with -allow-cidrs"
+    );
+  }
+  return reason ? `${reason} (${code})` : `WebSocket closed (${code})`;
+}
+
 export class TcpClient {
   private ws: WebSocket | null = null;
   private onDataCbs: Array<(data: Uint8Array) => void> = [];
   private onTxCb: ((data: Uint8Array) => void) | null = null;
+  private onCloseCb: ((message: string) => void) | null = null;
+  private closeMessage = "";
   private wsBase: string;
 
   constructor(wsBase?: string) {
@@ -17,7 +34,10 @@ export class TcpClient {
 
   async connect(host: string, port: number): Promise<void> {
     // Bridge URL; can be made configurable via settings
-    const url = `${this.wsBase}/connect?host=${encodeURIComponent(host)}&port=${port}`;
+    const token = localStorage.getItem("bridgeToken") || "";
+    const url =
+      `${this.wsBase}/connect?host=${encodeURIComponent(host)}&port=${port}` +
+      (token ? `&token=${encodeURIComponent(token)}` : "");
     await new Promise<void>((resolve, reject) => {
       const ws = new WebSocket(url);
       ws.binaryType = "arraybuffer";
@@ -38,16 +58,22 @@ export class TcpClient {
         }
       };
       ws.onclose = (ev) => {
+        this.closeMessage = describeWsClose(ev.code, ev.reason);
         if (this.ws === null) {
           // Closed before open => connection failed
-          reject(new Error(`WebSocket closed (${ev.code})`));
+          reject(new Error(this.closeMessage));
+          return;
         }
+        // the bridge reports policy and dial errors by closing right after open
+        if (this.ws === ws) this.onCloseCb?.(this.closeMessage);
       };
     });
   }
 
   async write(data: Uint8Array): Promise<void> {
-    if (!this.ws || this.ws.readyState !== WebSocket.OPEN) throw new Error("tcp not connected");
+    if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+      throw new Error(this.closeMessage ? `tcp not connected: ${this.closeMessage}` : "tcp not connected");
+    }
     try {
       this.onTxCb?.(data);
     } catch {
@@ -72,6 +98,10 @@ export class TcpClient {
     this.onTxCb = cb;
   }
 
+  onClose(cb: (message: string) => void) {
+    this.onCloseCb = cb;
+  }
+
   close() {
     try {
       this.ws?.close();
@@ -81,5 +111,6 @@ export class TcpClient {
     this.ws = null;
     this.onDataCbs = [];
     this.onTxCb = null;
+    this.onCloseCb = null;
   }
 }
@@ -45,6 +45,7 @@ export const bridgeStatusIcon = document.getElementById("bridgeStatusIcon") as H
 export const tcpSettingsPanel = document.getElementById("tcpSettingsPanel") as HTMLDivElement | null;
 export const bridgeHostInput = document.getElementById("bridgeHostInput") as HTMLInputElement | null;
 export const bridgePortInput = document.getElementById("bridgePortInput") as HTMLInputElement | null;
+export const bridgeTokenInput = document.getElementById("bridgeTokenInput") as HTMLInputElement | null;
 export const tcpInfoBtn = document.getElementById("tcpInfoBtn") as HTMLButtonElement | null;
 export const bridgeInfoModal = document.getElementById("bridgeInfoModal") as HTMLDivElement | null;
 export const bridgeInfoClose = document.getElementById("bridgeInfoClose") as HTMLButtonElement | null;
@@ -216,6 +217,7 @@ invertLevel?.addEventListener("change", saveCtrlSettings);
 implyGateToggle?.addEventListener("change", saveCtrlSettings);
 bridgeHostInput?.addEventListener("input", scheduleBridgeRefresh);
 bridgePortInput?.addEventListener("input", scheduleBridgeRefresh);
+bridgeTokenInput?.addEventListener("input", scheduleBridgeRefresh);
 findBaudToggle?.addEventListener("change", saveCtrlSettings);
 bitrateInput?.addEventListener("change", saveCtrlSettings);
 
@@ -332,6 +334,7 @@ tcpLinksBtn?.addEventListener("click", () => {
 
 bridgeHostInput?.addEventListener("change", saveBridgeSettings);
 bridgePortInput?.addEventListener("change", saveBridgeSettings);
+bridgeTokenInput?.addEventListener("change", saveBridgeSettings);
 
 // Firmware Notes Modal Functions
 fwNotesCloseEl?.addEventListener("click", () => closeModalById("fwNotesModal"));
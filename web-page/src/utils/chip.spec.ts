@@ -0,0 +1,28 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { chipFamily } from "./chip";
+
+const cases: [string, string | undefined][] = [
+  ["cc2652p", "ti"],
+  ["CC2652P7", "ti"],
+  ["cc1352p2", "ti"],
+  ["cc26xx", "ti"],
+  ["cc2538", "ti"],
+  ["cc2538sf53", "ti"],
+  ["cc2530", "ti_old"],
+  ["CC2531", "ti_old"],
+  ["ti_old", "ti_old"],
+  ["efr32", "sl"],
+  ["EFR32MG21", "sl"],
+  ["mgm210p", "sl"],
+  ["esp32c6", "esp"],
+  ["tlsr8258", "telink"],
+  ["nrf52840", undefined],
+  ["", undefined],
+];
+
+test("chipFamily maps profile chips to UI families", () => {
+  for (const [chip, family] of cases) {
+    assert.equal(chipFamily(chip), family, chip);
+  }
+});
@@ -0,0 +1,13 @@
+// Chip family of the UI for a profile chip, e.g. cc2652p or a radio_type TXT value.
+// CC2538 uses the same bootloader as CC13xx/CC26xx, while CC2530/CC2531 need the
+// tools of the older TI family.
+export function chipFamily(chip: string): string | undefined {
+  const c = chip.toLowerCase();
+  if (/^cc2538/.test(c)) return "ti";
+  if (/^cc253|^ti_old/.test(c)) return "ti_old";
+  if (/^(cc13|cc26)|^ti/.test(c)) return "ti";
+  if (/efr32|^mgm|^sl|silabs/.test(c)) return "sl";
+  if (/^esp/.test(c)) return "esp";
+  if (/tlsr|telink/.test(c)) return "telink";
+  return undefined;
+}
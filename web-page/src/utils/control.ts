@@ -55,7 +55,9 @@ export const CONTROL_PRESETS: Array<{
   },
 ];
 
-export function deriveControlConfig(meta: { type?: string; protocol?: string }): ControlConfig {
+// The bridge's device profile wins; CONTROL_PRESETS covers older bridges
+export function deriveControlConfig(meta: { type?: string; protocol?: string; control?: ControlConfig }): ControlConfig {
+  if (meta.control) return meta.control;
   for (const p of CONTROL_PRESETS) {
     try {
       if (p.test(meta)) return p.config;
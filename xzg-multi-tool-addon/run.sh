@@ -6,6 +6,8 @@ OPTIONS_FILE="/data/options.json"
 PORT=8765
 ADVERTISE_HOST=""
 DEBUG_MODE="false"
+TARGET_POLICY=""
+ALLOW_TARGETS=""
 # SERIAL_SCAN_INTERVAL=5000
 
 if [ -f "$OPTIONS_FILE" ]; then
@@ -13,11 +15,15 @@ if [ -f "$OPTIONS_FILE" ]; then
         PORT=$(jq -r '.port // 8765' "$OPTIONS_FILE")
         ADVERTISE_HOST=$(jq -r '.advertise_host // ""' "$OPTIONS_FILE")
         DEBUG_MODE=$(jq -r '.debug_mode // false' "$OPTIONS_FILE")
+        TARGET_POLICY=$(jq -r '.target_policy // ""' "$OPTIONS_FILE")
+        ALLOW_TARGETS=$(jq -r '.allow_targets // ""' "$OPTIONS_FILE")
         # SERIAL_SCAN_INTERVAL=$(jq -r '.serial_scan_interval // 5000' "$OPTIONS_FILE")
     else
         PORT=$(grep -oP '"port"\s*:\s*\K[0-9]+' "$OPTIONS_FILE" || echo 8765)
         ADVERTISE_HOST=$(grep -oP '"advertise_host"\s*:\s*"\K[^"]+' "$OPTIONS_FILE" || true)
         if grep -q '"debug_mode"\s*:\s*true' "$OPTIONS_FILE"; then DEBUG_MODE=true; fi
+        TARGET_POLICY=$(grep -oP '"target_policy"\s*:\s*"\K[^"]+' "$OPTIONS_FILE" || true)
+        ALLOW_TARGETS=$(grep -oP '"allow_targets"\s*:\s*"\K[^"]+' "$OPTIONS_FILE" || true)
         # SERIAL_SCAN_INTERVAL=$(grep -oP '"serial_scan_interval"\s*:\s*\K[0-9]+' "$OPTIONS_FILE" || echo 5000)
     fi
 fi
@@ -27,6 +33,12 @@ export PORT
 if [ -n "$ADVERTISE_HOST" ] && [ "$ADVERTISE_HOST" != "null" ]; then
     export ADVERTISE_HOST
 fi
+if [ -n "$TARGET_POLICY" ] && [ "$TARGET_POLICY" != "null" ]; then
+    export TARGET_POLICY
+fi
+if [ -n "$ALLOW_TARGETS" ] && [ "$ALLOW_TARGETS" != "null" ]; then
+    export ALLOW_TARGETS
+fi
 if [ "$DEBUG_MODE" = "true" ]; then
     export DEBUG_MODE=1
 fi